@@ -0,0 +1,361 @@
+package jwt_sessions
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/core/errors"
+)
+
+
+// The audit log records the security-relevant lifecycle events (logins,
+// tokens issued and rejected, regenerations and destroys) as AuditRecords,
+// written to an AuditSink (see `UseAudit`). The records are enriched with
+// the request's IP and user agent, when the event comes from a request,
+// and with the session's subject (see Config.SubjectKey).
+//
+// Optionally, the records are chained: each one carries the hash of the
+// previous one, and its own hash covers it, so editing, removing or
+// inserting records breaks the chain (see `VerifyAuditChain`). A plain hash
+// chain can be rebuilt by whoever can edit the log: with a key (see
+// AuditOptions.HMACKey), the records are chained by their HMACs instead,
+// which can not be rebuilt without the key.
+
+
+var (
+	errAuditChain = errors.New("audit chain broken at record %d: %s")
+	errAuditLine  = errors.New("invalid audit record at line %d: %v")
+)
+
+// DefaultAuditEvents are the kinds of events audited by default.
+var DefaultAuditEvents = []EventKind{
+	EventAuthenticate, EventTokenIssued, EventTokenRejected, EventRegenerate, EventDestroy,
+}
+
+
+type (
+	// AuditRecord is an audited event.
+	AuditRecord struct {
+		// The position of the record in the log, starting at 1.
+		Seq  uint64    `json:"seq"`
+		Time time.Time `json:"time"`
+		// The kind of the event (see EventKind.String).
+		Action       string      `json:"action"`
+		SessionID    string      `json:"sid,omitempty"`
+		NewSessionID string      `json:"new_sid,omitempty"`
+		Subject      interface{} `json:"subject,omitempty"`
+		IP           string      `json:"ip,omitempty"`
+		UserAgent    string      `json:"user_agent,omitempty"`
+		// Why the session was destroyed.
+		Reason string `json:"reason,omitempty"`
+		// The method and assurance level of an authentication.
+		Method string `json:"method,omitempty"`
+		Level  int    `json:"level,omitempty"`
+		// Why the token was rejected.
+		Error string `json:"error,omitempty"`
+		// The hash of the previous record, and the hash of this one
+		// (covering the previous one), when chained.
+		PrevHash string `json:"prev_hash,omitempty"`
+		Hash     string `json:"hash,omitempty"`
+	}
+
+	// AuditSink stores the audit records, in order.
+	AuditSink interface {
+		Write(record AuditRecord) error
+	}
+
+	// AuditOptions configures the audit log.
+	AuditOptions struct {
+		// The kinds of events to audit.
+		// Default value: DefaultAuditEvents.
+		Events []EventKind
+		// Whether the records are chained by their hashes.
+		HashChain bool
+		// The key of the HMAC-SHA256 chaining the records, instead of their
+		// SHA-256 hashes, if HashChain is set (see VerifyAuditChainWithKey).
+		// Default value: nil.
+		HMACKey []byte
+	}
+
+	// Auditor turns the lifecycle events into audit records.
+	Auditor struct {
+		mu       sync.Mutex
+		sink     AuditSink
+		options  AuditOptions
+		sessions *JWTSessions
+		seq      uint64
+		last     string
+		err      error
+	}
+
+	// MemoryAuditSink keeps the audit records in memory, e.g. for tests.
+	MemoryAuditSink struct {
+		mu      sync.RWMutex
+		records []AuditRecord
+	}
+
+	// JSONLinesAuditSink appends the audit records to a file, one JSON
+	// object per line.
+	JSONLinesAuditSink struct {
+		mu      sync.Mutex
+		file    *os.File
+		last    AuditRecord
+		hasLast bool
+	}
+
+	// lastAuditRecord is implemented by the sinks which can tell their
+	// last record, so a chain can go on after a restart.
+	lastAuditRecord interface {
+		Last() (AuditRecord, bool)
+	}
+)
+
+var (
+	_ AuditSink = (*MemoryAuditSink)(nil)
+	_ AuditSink = (*JSONLinesAuditSink)(nil)
+)
+
+
+// UseAudit registers an auditor writing the events to the sink. If the
+// sink can tell its last record (like the sinks of this package do), the
+// sequence and the chain go on from it.
+func (sessions *JWTSessions) UseAudit(sink AuditSink, options AuditOptions) *Auditor {
+	if options.Events == nil {
+		options.Events = DefaultAuditEvents
+	}
+
+	auditor := &Auditor{sink: sink, options: options, sessions: sessions}
+	if withLast, ok := sink.(lastAuditRecord); ok {
+		if last, found := withLast.Last(); found {
+			auditor.seq, auditor.last = last.Seq, last.Hash
+		}
+	}
+	for _, kind := range options.Events {
+		sessions.On(kind, func(event Event) { auditor.record(event) })
+	}
+	return auditor
+}
+
+// Err returns the last error writing to the sink, if any. The records
+// failed to write are skipped: the sequence and the chain go on from the
+// last record written.
+func (auditor *Auditor) Err() error {
+	auditor.mu.Lock()
+	defer auditor.mu.Unlock()
+	return auditor.err
+}
+
+// record writes an event to the sink. The sequence and the chain only
+// advance once the record is written.
+func (auditor *Auditor) record(event Event) error {
+	record := AuditRecord{
+		Time:         event.Time,
+		Action:       event.Kind.String(),
+		SessionID:    event.SessionID,
+		NewSessionID: event.NewSessionID,
+		Subject:      auditor.subject(event),
+	}
+	if event.Kind == EventDestroy || event.Kind == EventExpire {
+		record.Reason = event.Reason.String()
+	}
+	if authEvent, ok := event.Value.(AuthEvent); ok && event.Kind == EventAuthenticate {
+		record.Method, record.Level = authEvent.Method, authEvent.Level
+	}
+	if event.Err != nil {
+		record.Error = event.Err.Error()
+	}
+	if ctx := event.Context; ctx != nil {
+		record.IP = ctx.RemoteAddr()
+		record.UserAgent = ctx.GetHeader("User-Agent")
+	}
+
+	auditor.mu.Lock()
+	defer auditor.mu.Unlock()
+	record.Seq = auditor.seq + 1
+	if auditor.options.HashChain {
+		record.PrevHash = auditor.last
+		record.Hash = auditHash(record, auditor.options.HMACKey)
+	}
+	if err := auditor.sink.Write(record); err != nil {
+		auditor.err = err
+		return err
+	}
+	auditor.seq, auditor.last = record.Seq, record.Hash
+	return nil
+}
+
+// subject returns the subject of the event's session: from its snapshot,
+// if destroyed, or from the database.
+func (auditor *Auditor) subject(event Event) interface{} {
+	key := auditor.sessions.config.SubjectKey
+	if event.Snapshot != nil {
+		return event.Snapshot.Get(key)
+	}
+	sid := event.SessionID
+	switch event.Kind {
+	case EventDestroy, EventExpire:
+		// already released.
+		return nil
+	case EventRegenerate:
+		sid = event.NewSessionID
+	}
+	if sid == "" {
+		return nil
+	}
+	return auditor.sessions.provider.db.Get(sid, key)
+}
+
+
+// auditHash returns the hash of a record (its hash field excluded),
+// which covers the hash of the previous record: its HMAC, if there is
+// a key. The record is hashed as read back from JSON, so the hash is the
+// same when verified from a log (e.g. the subject, if a struct, is read
+// back as a map).
+func auditHash(record AuditRecord, key []byte) string {
+	record.Hash = ""
+	encoded, _ := json.Marshal(record)
+	var decoded AuditRecord
+	if json.Unmarshal(encoded, &decoded) == nil {
+		encoded, _ = json.Marshal(decoded)
+	}
+	if key != nil {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(encoded)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyAuditChain checks the sequence and the hash chain of the records,
+// which must be all the records of a chained log, in order.
+func VerifyAuditChain(records []AuditRecord) error {
+	return VerifyAuditChainWithKey(records, nil)
+}
+
+// VerifyAuditChainWithKey checks the sequence and the HMAC chain of the
+// records of a log chained with a key (see AuditOptions.HMACKey).
+func VerifyAuditChainWithKey(records []AuditRecord, key []byte) error {
+	var prev AuditRecord
+	for i, record := range records {
+		if i > 0 && record.Seq != prev.Seq+1 {
+			return errAuditChain.Format(i, "the sequence is not continuous")
+		}
+		if record.PrevHash != prev.Hash {
+			return errAuditChain.Format(i, "the previous hash does not match")
+		}
+		if !hmac.Equal([]byte(record.Hash), []byte(auditHash(record, key))) {
+			return errAuditChain.Format(i, "the hash does not match")
+		}
+		prev = record
+	}
+	return nil
+}
+
+// ReadAuditLog reads all the records of a JSON-lines audit log.
+func ReadAuditLog(path string) ([]AuditRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, errAuditLine.Format(line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+
+// NewMemoryAuditSink returns an empty in-memory sink.
+func NewMemoryAuditSink() *MemoryAuditSink {
+	return &MemoryAuditSink{}
+}
+
+// Write appends a record.
+func (sink *MemoryAuditSink) Write(record AuditRecord) error {
+	sink.mu.Lock()
+	sink.records = append(sink.records, record)
+	sink.mu.Unlock()
+	return nil
+}
+
+// Records returns a copy of the records.
+func (sink *MemoryAuditSink) Records() []AuditRecord {
+	sink.mu.RLock()
+	defer sink.mu.RUnlock()
+	return append([]AuditRecord(nil), sink.records...)
+}
+
+// Last returns the last record, if any.
+func (sink *MemoryAuditSink) Last() (AuditRecord, bool) {
+	sink.mu.RLock()
+	defer sink.mu.RUnlock()
+	if len(sink.records) == 0 {
+		return AuditRecord{}, false
+	}
+	return sink.records[len(sink.records)-1], true
+}
+
+
+// NewJSONLinesAuditSink opens (or creates) a JSON-lines audit log.
+// The records are appended to the existing ones.
+func NewJSONLinesAuditSink(path string) (*JSONLinesAuditSink, error) {
+	records, err := ReadAuditLog(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sink := &JSONLinesAuditSink{file: file}
+	if len(records) > 0 {
+		sink.last, sink.hasLast = records[len(records)-1], true
+	}
+	return sink, nil
+}
+
+// Write appends a record, as a line.
+func (sink *JSONLinesAuditSink) Write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if _, err := sink.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	sink.last, sink.hasLast = record, true
+	return nil
+}
+
+// Last returns the last record, if any.
+func (sink *JSONLinesAuditSink) Last() (AuditRecord, bool) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.last, sink.hasLast
+}
+
+// Close closes the file.
+func (sink *JSONLinesAuditSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.file.Close()
+}
@@ -0,0 +1,151 @@
+package jwt_sessions
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+
+// failingAuditSink fails the writes while told to.
+type failingAuditSink struct {
+	*MemoryAuditSink
+	fail bool
+}
+
+func (sink *failingAuditSink) Write(record AuditRecord) error {
+	if sink.fail {
+		return errors.New("write failed")
+	}
+	return sink.MemoryAuditSink.Write(record)
+}
+
+// auditSessions starts a session, and destroys it.
+func auditSessions(sessions *JWTSessions) {
+	ctx := newTestContext("")
+	sessions.Start(ctx).Set("user_id", 7)
+	sessions.Destroy(ctx)
+}
+
+
+func TestAuditRecordsTheEvents(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour, SubjectKey: "user_id", DestroySnapshot: true})
+	sink := NewMemoryAuditSink()
+	sessions.UseAudit(sink, AuditOptions{HashChain: true})
+	auditSessions(sessions)
+
+	records := sink.Records()
+	if len(records) != 2 || records[0].Action != EventTokenIssued.String() || records[1].Action != EventDestroy.String() {
+		t.Fatalf("got %+v", records)
+	}
+	if records[1].Reason != DestroyLogout.String() || records[1].Subject != 7 {
+		t.Fatalf("got %+v, want the reason and the subject", records[1])
+	}
+	if err := VerifyAuditChain(records); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditChainSkipsTheRecordsFailedToWrite(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	sink := &failingAuditSink{MemoryAuditSink: NewMemoryAuditSink()}
+	auditor := sessions.UseAudit(sink, AuditOptions{HashChain: true})
+
+	destroyed := Event{Kind: EventDestroy, SessionID: "a", Reason: DestroyRevoked, Time: time.Now()}
+	if err := auditor.record(destroyed); err != nil {
+		t.Fatal(err)
+	}
+	sink.fail = true
+	if err := auditor.record(destroyed); err == nil || auditor.Err() == nil {
+		t.Fatal("the write error was not reported")
+	}
+	sink.fail = false
+	auditSessions(sessions)
+
+	records := sink.Records()
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3", len(records))
+	}
+	if err := VerifyAuditChain(records); err != nil {
+		t.Fatalf("the chain broke after a failed write: %v", err)
+	}
+}
+
+func TestAuditChainDetectsEditedRecords(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	sink := NewMemoryAuditSink()
+	sessions.UseAudit(sink, AuditOptions{HashChain: true})
+	auditSessions(sessions)
+
+	for name, edit := range map[string]func(records []AuditRecord) []AuditRecord{
+		"edited":   func(records []AuditRecord) []AuditRecord { records[0].IP = "10.0.0.1"; return records },
+		"removed":  func(records []AuditRecord) []AuditRecord { return records[1:] },
+		"reversed": func(records []AuditRecord) []AuditRecord { return []AuditRecord{records[1], records[0]} },
+	} {
+		if err := VerifyAuditChain(edit(sink.Records())); err == nil {
+			t.Fatalf("%s records were not detected", name)
+		}
+	}
+}
+
+func TestAuditHMACChainCanNotBeRebuiltWithoutTheKey(t *testing.T) {
+	key := []byte("audit key")
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	sink := NewMemoryAuditSink()
+	sessions.UseAudit(sink, AuditOptions{HashChain: true, HMACKey: key})
+	auditSessions(sessions)
+
+	records := sink.Records()
+	if err := VerifyAuditChainWithKey(records, key); err != nil {
+		t.Fatal(err)
+	}
+	if VerifyAuditChain(records) == nil || VerifyAuditChainWithKey(records, []byte("other key")) == nil {
+		t.Fatal("the chain was verified without its key")
+	}
+
+	// an edited record, whose chain is rebuilt without the key.
+	records[0].IP = "10.0.0.1"
+	for i := range records {
+		if i > 0 {
+			records[i].PrevHash = records[i-1].Hash
+		}
+		records[i].Hash = auditHash(records[i], nil)
+	}
+	if err := VerifyAuditChainWithKey(records, key); err == nil {
+		t.Fatal("a chain rebuilt without the key was verified")
+	}
+}
+
+func TestJSONLinesAuditSinkGoesOnAfterReopening(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	for i := 0; i < 2; i++ {
+		sink, err := NewJSONLinesAuditSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions := newTestSessions(Config{Expires: time.Hour})
+		sessions.UseAudit(sink, AuditOptions{HashChain: true})
+		auditSessions(sessions)
+		sink.Close()
+	}
+
+	records, err := ReadAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[3].Seq != 4 {
+		t.Fatalf("got %d records, the last one being %+v", len(records), records[len(records)-1])
+	}
+	if err := VerifyAuditChain(records); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,196 @@
+package jwt_sessions
+
+import (
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/context"
+)
+
+
+// Roles are read from the verified token claims and from the session values
+// (both sources are combined), expanded through the role hierarchy and then
+// resolved into permissions. The result is computed once per request (and
+// again if the session's roles change), and kept in the request's values.
+
+
+const grantsContextKey = "iris.jwt_sessions.grants"
+
+
+type (
+	// PermissionResolver returns the permissions granted to a single role.
+	PermissionResolver func(role string) []string
+
+	// Authorization tells how to resolve roles and permissions of a session.
+	Authorization struct {
+		// The claim holding the roles: either a string or a list of strings.
+		// Default value: "roles".
+		RolesClaim string
+		// The session key holding the roles: either a string or a list of strings.
+		// Default value: "roles".
+		RolesKey string
+		// Roles inheriting other roles (and their permissions): each role
+		// is mapped to its parent roles.
+		Hierarchy map[string][]string
+		// Resolves the permissions of each role.
+		// Default value: nil (roles grant no permissions).
+		Resolver PermissionResolver
+	}
+
+	// Grants holds the resolved roles and permissions of a session.
+	Grants struct {
+		roles       map[string]bool
+		permissions map[string]bool
+	}
+
+	// requestGrants are the grants of a request, resolved for a session
+	// (if any) when its roles were at a given version.
+	requestGrants struct {
+		sess    *JWTSession
+		version uint64
+		grants  *Grants
+	}
+)
+
+
+// StaticPermissions returns a resolver backed by a fixed role -> permissions map.
+func StaticPermissions(permissions map[string][]string) PermissionResolver {
+	return func(role string) []string {
+		return permissions[role]
+	}
+}
+
+// Validate corrects missing fields and returns a copy.
+func (authorization Authorization) Validate() Authorization {
+	if authorization.RolesClaim == "" {
+		authorization.RolesClaim = "roles"
+	}
+	if authorization.RolesKey == "" {
+		authorization.RolesKey = "roles"
+	}
+	return authorization
+}
+
+// resolve computes the grants from the claims and the session (both optional).
+func (authorization *Authorization) resolve(claims jwt.MapClaims, sess *JWTSession) *Grants {
+	grants := &Grants{roles: make(map[string]bool), permissions: make(map[string]bool)}
+
+	pending := stringList(claims[authorization.RolesClaim])
+	if sess != nil {
+		pending = append(pending, stringList(sess.Get(authorization.RolesKey))...)
+	}
+
+	// expand the hierarchy (guarding against cycles).
+	for len(pending) > 0 {
+		role := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if role == "" || grants.roles[role] {
+			continue
+		}
+		grants.roles[role] = true
+		pending = append(pending, authorization.Hierarchy[role]...)
+	}
+
+	if authorization.Resolver != nil {
+		for role := range grants.roles {
+			for _, permission := range authorization.Resolver(role) {
+				grants.permissions[permission] = true
+			}
+		}
+	}
+
+	if sess != nil {
+		sess.Impersonation().restrict(grants)
+	}
+
+	return grants
+}
+
+// grants returns the grants of the request for the session (if any), resolved
+// from the request's claims only once, unless the session's roles change.
+func (authorization *Authorization) grants(ctx context.Context, claims jwt.MapClaims, sess *JWTSession) *Grants {
+	var version uint64
+	if sess != nil {
+		version = sess.rolesVersion()
+	}
+	if cached, ok := ctx.Values().Get(grantsContextKey).(*requestGrants); ok && cached.sess == sess && cached.version == version {
+		return cached.grants
+	}
+
+	grants := authorization.resolve(claims, sess)
+	ctx.Values().Set(grantsContextKey, &requestGrants{sess: sess, version: version, grants: grants})
+	return grants
+}
+
+// HasRole tells whether the role was granted, directly or by inheritance.
+func (grants *Grants) HasRole(role string) bool {
+	return grants.roles[role]
+}
+
+// Can tells whether the permission was granted by any of the roles.
+func (grants *Grants) Can(permission string) bool {
+	return grants.permissions[permission]
+}
+
+// Roles returns all the granted roles.
+func (grants *Grants) Roles() []string {
+	roles := make([]string, 0, len(grants.roles))
+	for role := range grants.roles {
+		roles = append(roles, role)
+	}
+	return roles
+}
+
+// Grants returns the roles and permissions for this request,
+// resolving them only once per request (see JWTSession.Can).
+func (sessions *JWTSessions) Grants(ctx context.Context) *Grants {
+	claims := sessions.claimsFromContext(ctx)
+	return sessions.config.Authorization.grants(ctx, claims, sessions.existingSession(ctx))
+}
+
+// RequireRole returns a middleware which only lets the request go on if the
+// role was granted (directly or by inheritance). Otherwise, it responds with 403.
+func (sessions *JWTSessions) RequireRole(role string, onFailure context.Handler) context.Handler {
+	fail := failWith(iris.StatusForbidden, onFailure)
+	return func(ctx context.Context) {
+		if !sessions.Grants(ctx).HasRole(role) {
+			fail(ctx)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RequirePermission returns a middleware which only lets the request go on if
+// the permission was granted. Otherwise, it responds with 403.
+func (sessions *JWTSessions) RequirePermission(permission string, onFailure context.Handler) context.Handler {
+	fail := failWith(iris.StatusForbidden, onFailure)
+	return func(ctx context.Context) {
+		if !sessions.Grants(ctx).Can(permission) {
+			fail(ctx)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// stringList reads a string or a list of strings (as stored in a session,
+// or as parsed from a JSON claim). A string may hold space-separated items.
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []string:
+		return append([]string(nil), v...)
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				items = append(items, s)
+			}
+		}
+		return items
+	}
+	return nil
+}
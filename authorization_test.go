@@ -0,0 +1,96 @@
+package jwt_sessions
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/kataras/iris/context"
+)
+
+
+func newAuthorizationTestSessions() *JWTSessions {
+	return newTestSessions(Config{Expires: time.Hour, Authorization: Authorization{
+		Hierarchy: map[string][]string{"admin": {"user"}},
+		Resolver: StaticPermissions(map[string][]string{
+			"admin": {"delete"},
+			"user":  {"read"},
+		}),
+	}})
+}
+
+// requestWithRoles returns a request with a token of the session, claiming the roles.
+func requestWithRoles(t *testing.T, sessions *JWTSessions, sess *JWTSession, roles string) context.Context {
+	ctx := newTestContext(signedToken(t, sessions, jwt.MapClaims{"session_id": sess.ID(), "roles": roles}))
+	if sessions.Start(ctx) != sess {
+		t.Fatal("the token did not start its session")
+	}
+	return ctx
+}
+
+
+func TestCanKeepsTheGrantsOfEachRequest(t *testing.T) {
+	sessions := newAuthorizationTestSessions()
+	sess := sessions.Start(newTestContext(""))
+
+	admin := requestWithRoles(t, sessions, sess, "admin")
+	user := requestWithRoles(t, sessions, sess, "user")
+	if !sess.Can(admin, "delete") || !sess.Can(admin, "read") {
+		t.Fatal("the admin request lacks its permissions")
+	}
+	if sess.Can(user, "delete") {
+		t.Fatal("the admin grants leaked into the user request")
+	}
+	if !sess.Can(user, "read") {
+		t.Fatal("the user request lacks its permission")
+	}
+}
+
+func TestCanInConcurrentRequests(t *testing.T) {
+	sessions := newAuthorizationTestSessions()
+	sess := sessions.Start(newTestContext(""))
+
+	var wg sync.WaitGroup
+	failures := make(chan string, 100)
+	for i := 0; i < 50; i++ {
+		roles, want := "user", false
+		if i%2 == 0 {
+			roles, want = "admin", true
+		}
+		ctx := requestWithRoles(t, sessions, sess, roles)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if sess.Can(ctx, "delete") != want {
+					failures <- roles
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(failures)
+	for roles := range failures {
+		t.Errorf("wrong grants for a %s request", roles)
+	}
+}
+
+func TestGrantsAreResolvedAgainWhenTheRolesChange(t *testing.T) {
+	sessions := newAuthorizationTestSessions()
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	if sess.Can(ctx, "read") {
+		t.Fatal("granted without roles")
+	}
+
+	sess.Set("roles", "user")
+	if !sess.Can(ctx, "read") || !sessions.Grants(ctx).HasRole("user") {
+		t.Fatal("the new role was not granted")
+	}
+	sess.Delete("roles")
+	if sess.Can(ctx, "read") || sessions.Grants(ctx).HasRole("user") {
+		t.Fatal("the removed role is still granted")
+	}
+}
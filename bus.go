@@ -0,0 +1,358 @@
+package jwt_sessions
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/core/errors"
+)
+
+
+// An invalidation bus broadcasts the changes made to the sessions among the
+// instances of a multi-instance deployment (see `UseInvalidationBus`), so each
+// instance evicts (or updates) its in-memory copy of the sessions destroyed,
+// regenerated or shifted by the others, and fires its own listeners.
+//
+// The instances share the bus' messages, but they are expected to share the
+// session database as well: the bus only tells which sessions changed.
+
+
+// InvalidationKind tells what happened to the session(s) of an event.
+type InvalidationKind uint8
+
+const (
+	// InvalidateDestroy tells that a session was destroyed, or expired.
+	InvalidateDestroy InvalidationKind = iota + 1
+	// InvalidateDestroyAll tells that all the sessions were destroyed.
+	InvalidateDestroyAll
+	// InvalidateRegenerate tells that a session was moved to a new ID.
+	InvalidateRegenerate
+	// InvalidateExpiration tells that a session's expiration changed.
+	InvalidateExpiration
+)
+
+var (
+	errBusClosed = errors.New("invalidation bus closed")
+	errBusSecret = errors.New("the invalidation bus needs a shared secret")
+)
+
+// UDPBusFreshness is how far from the time it is received an event can be
+// issued (either way, for the clocks' skew): older events are dropped.
+var UDPBusFreshness = 10 * time.Second
+
+// The backoff of the UDP bus after an error reading a datagram.
+const (
+	udpBusMinBackoff = 10 * time.Millisecond
+	udpBusMaxBackoff = time.Second
+)
+
+const (
+	// udpBusNonceSize is the size of the random nonce of each datagram.
+	udpBusNonceSize = 16
+	// udpBusHeaderSize is the size of the issue time and the nonce.
+	udpBusHeaderSize = 8 + udpBusNonceSize
+	// udpBusMaxNonces bounds the nonces kept to detect the replays: the
+	// events received when it is reached are dropped.
+	udpBusMaxNonces = 100000
+)
+
+
+type (
+	// InvalidationEvent is a change broadcast through an InvalidationBus.
+	InvalidationEvent struct {
+		Kind InvalidationKind `json:"kind"`
+		// Origin identifies the instance which published the event.
+		Origin    string `json:"origin"`
+		SessionID string `json:"sid,omitempty"`
+		// NewSessionID is the new ID of a regenerated session.
+		NewSessionID string `json:"new_sid,omitempty"`
+		// Expires is the new expiration of a session.
+		Expires time.Duration `json:"expires,omitempty"`
+		// Reason tells why a session was destroyed.
+		Reason DestroyReason `json:"reason,omitempty"`
+	}
+
+	// InvalidationBus broadcasts the events published by each instance to
+	// all the subscribed instances. An instance may receive its own events.
+	InvalidationBus interface {
+		Publish(event InvalidationEvent) error
+		Subscribe(handler func(event InvalidationEvent))
+	}
+
+	// LocalBus is an in-process InvalidationBus, which delivers the events
+	// synchronously. It is meant for several managers in the same process,
+	// e.g. in tests.
+	LocalBus struct {
+		mu       sync.RWMutex
+		handlers []func(event InvalidationEvent)
+	}
+
+	// UDPBus is an InvalidationBus sending each event, as a JSON datagram,
+	// to a fixed set of peers. Delivery is not guaranteed, so it fits a
+	// local network (or the loopback interface, e.g. in tests).
+	//
+	// Each datagram is signed with an HMAC-SHA256 of a secret shared by the
+	// peers, and the datagrams not coming from a peer, or not signed with
+	// the secret, are dropped: otherwise anyone reaching the port could e.g.
+	// destroy all the sessions. The signed payload carries its issue time
+	// and a random nonce as well, so a captured datagram cannot be replayed:
+	// the events not issued within UDPBusFreshness, or already received,
+	// are dropped.
+	UDPBus struct {
+		conn     net.PacketConn
+		secret   []byte
+		mu       sync.RWMutex
+		peers    []*net.UDPAddr
+		handlers []func(event InvalidationEvent)
+		closed   bool
+		// the nonces received, and the order they were received in.
+		// They are only used by the receiving goroutine.
+		nonces     map[udpBusNonce]struct{}
+		nonceOrder []receivedNonce
+	}
+
+	udpBusNonce [udpBusNonceSize]byte
+
+	receivedNonce struct {
+		nonce    udpBusNonce
+		received time.Time
+	}
+)
+
+var (
+	_ InvalidationBus = (*LocalBus)(nil)
+	_ InvalidationBus = (*UDPBus)(nil)
+)
+
+
+// NewLocalBus returns a new in-process bus.
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+// Publish delivers the event to every subscriber.
+func (bus *LocalBus) Publish(event InvalidationEvent) error {
+	bus.mu.RLock()
+	handlers := bus.handlers
+	bus.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+	return nil
+}
+
+// Subscribe registers a handler for all the published events.
+func (bus *LocalBus) Subscribe(handler func(event InvalidationEvent)) {
+	bus.mu.Lock()
+	bus.handlers = append(bus.handlers, handler)
+	bus.mu.Unlock()
+}
+
+
+// NewUDPBus returns a bus listening on the given UDP address (e.g.
+// "127.0.0.1:0" for a random port), and sending to the given peers. The
+// events are signed with the secret, which all the peers must share.
+func NewUDPBus(addr string, secret []byte, peers ...string) (*UDPBus, error) {
+	if len(secret) == 0 {
+		return nil, errBusSecret
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	bus := &UDPBus{conn: conn, secret: secret, nonces: make(map[udpBusNonce]struct{})}
+	for _, peer := range peers {
+		if err := bus.AddPeer(peer); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	go bus.receive()
+	return bus, nil
+}
+
+// Addr returns the address the bus listens on.
+func (bus *UDPBus) Addr() string {
+	return bus.conn.LocalAddr().String()
+}
+
+// AddPeer adds a peer the events are sent to, and received from.
+func (bus *UDPBus) AddPeer(addr string) error {
+	peer, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	bus.mu.Lock()
+	bus.peers = append(bus.peers, peer)
+	bus.mu.Unlock()
+	return nil
+}
+
+// sign returns the HMAC of a payload.
+func (bus *UDPBus) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, bus.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// isPeer tells whether a datagram comes from one of the peers.
+func (bus *UDPBus) isPeer(addr net.Addr) bool {
+	from, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	for _, peer := range bus.peers {
+		if peer.Port == from.Port && peer.IP.Equal(from.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// seal returns the datagram of an event: the HMAC of the payload, followed
+// by the payload, which is the issue time (in Unix nanoseconds), a random
+// nonce and the JSON event.
+func (bus *UDPBus) seal(event InvalidationEvent, issued time.Time) ([]byte, error) {
+	payload := make([]byte, udpBusHeaderSize, 256)
+	binary.BigEndian.PutUint64(payload, uint64(issued.UnixNano()))
+	if _, err := rand.Read(payload[8:udpBusHeaderSize]); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	payload = append(payload, encoded...)
+	return append(bus.sign(payload), payload...), nil
+}
+
+// open returns the event of a datagram, if it is signed with the secret,
+// fresh and not a replay.
+func (bus *UDPBus) open(datagram []byte, now time.Time) (InvalidationEvent, bool) {
+	var event InvalidationEvent
+	if len(datagram) < sha256.Size+udpBusHeaderSize {
+		return event, false
+	}
+	signature, payload := datagram[:sha256.Size], datagram[sha256.Size:]
+	if !hmac.Equal(signature, bus.sign(payload)) {
+		return event, false
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+	var nonce udpBusNonce
+	copy(nonce[:], payload[8:udpBusHeaderSize])
+	if json.Unmarshal(payload[udpBusHeaderSize:], &event) != nil || !bus.fresh(issued, nonce, now) {
+		return event, false
+	}
+	return event, true
+}
+
+// fresh tells whether an event issued at the given time, with the given
+// nonce, is fresh and not a replay, keeping its nonce if so.
+func (bus *UDPBus) fresh(issued time.Time, nonce udpBusNonce, now time.Time) bool {
+	if issued.Before(now.Add(-UDPBusFreshness)) || issued.After(now.Add(UDPBusFreshness)) {
+		return false
+	}
+
+	// an event received is issued at most UDPBusFreshness earlier, so it
+	// is not fresh any more UDPBusFreshness after that: its nonce is not
+	// needed after 2*UDPBusFreshness.
+	for len(bus.nonceOrder) > 0 && now.Sub(bus.nonceOrder[0].received) > 2*UDPBusFreshness {
+		delete(bus.nonces, bus.nonceOrder[0].nonce)
+		bus.nonceOrder = bus.nonceOrder[1:]
+	}
+	if _, replayed := bus.nonces[nonce]; replayed || len(bus.nonces) >= udpBusMaxNonces {
+		return false
+	}
+	bus.nonces[nonce] = struct{}{}
+	bus.nonceOrder = append(bus.nonceOrder, receivedNonce{nonce: nonce, received: now})
+	return true
+}
+
+// Publish sends the event to every peer, returning the last error, if any.
+// See seal for the format of the datagram.
+func (bus *UDPBus) Publish(event InvalidationEvent) error {
+	message, err := bus.seal(event, time.Now())
+	if err != nil {
+		return err
+	}
+
+	bus.mu.RLock()
+	peers, closed := bus.peers, bus.closed
+	bus.mu.RUnlock()
+	if closed {
+		return errBusClosed
+	}
+
+	for _, peer := range peers {
+		if _, sendErr := bus.conn.WriteTo(message, peer); sendErr != nil {
+			err = sendErr
+		}
+	}
+	return err
+}
+
+// Subscribe registers a handler for the events received from the peers.
+func (bus *UDPBus) Subscribe(handler func(event InvalidationEvent)) {
+	bus.mu.Lock()
+	bus.handlers = append(bus.handlers, handler)
+	bus.mu.Unlock()
+}
+
+// receive delivers the events received from the peers, until closed.
+// After a read error, it backs off (exponentially) before reading again.
+func (bus *UDPBus) receive() {
+	buffer := make([]byte, 64*1024)
+	backoff := time.Duration(0)
+	for {
+		n, from, err := bus.conn.ReadFrom(buffer)
+		if err != nil {
+			bus.mu.RLock()
+			closed := bus.closed
+			bus.mu.RUnlock()
+			if closed {
+				return
+			}
+			if backoff *= 2; backoff < udpBusMinBackoff {
+				backoff = udpBusMinBackoff
+			} else if backoff > udpBusMaxBackoff {
+				backoff = udpBusMaxBackoff
+			}
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		if !bus.isPeer(from) {
+			continue
+		}
+		event, ok := bus.open(buffer[:n], time.Now())
+		if !ok {
+			continue
+		}
+
+		bus.mu.RLock()
+		handlers := bus.handlers
+		bus.mu.RUnlock()
+		for _, handler := range handlers {
+			handler(event)
+		}
+	}
+}
+
+// Close stops listening.
+func (bus *UDPBus) Close() error {
+	bus.mu.Lock()
+	bus.closed = true
+	bus.mu.Unlock()
+	return bus.conn.Close()
+}
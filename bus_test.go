@@ -0,0 +1,248 @@
+package jwt_sessions
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+
+var testBusSecret = []byte("bus secret")
+
+// newTestUDPBuses returns two buses peering each other, delivering
+// their events to channels.
+func newTestUDPBuses(t *testing.T) (a, b *UDPBus, fromA, fromB chan InvalidationEvent) {
+	var err error
+	if a, err = NewUDPBus("127.0.0.1:0", testBusSecret); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = NewUDPBus("127.0.0.1:0", testBusSecret, a.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	a.AddPeer(b.Addr())
+
+	fromA, fromB = make(chan InvalidationEvent, 10), make(chan InvalidationEvent, 10)
+	a.Subscribe(func(event InvalidationEvent) { fromB <- event })
+	b.Subscribe(func(event InvalidationEvent) { fromA <- event })
+	return a, b, fromA, fromB
+}
+
+func receiveEvent(t *testing.T, events chan InvalidationEvent) InvalidationEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out receiving an event")
+	}
+	return InvalidationEvent{}
+}
+
+// sealDatagram returns the datagram of an event, signed with the given secret.
+func sealDatagram(t *testing.T, secret []byte, event InvalidationEvent, issued time.Time) []byte {
+	datagram, err := (&UDPBus{secret: secret}).seal(event, issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return datagram
+}
+
+// sendDatagram sends a datagram from the given socket.
+func sendDatagram(t *testing.T, conn net.PacketConn, to string, datagram []byte) {
+	addr, err := net.ResolveUDPAddr("udp", to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(datagram, addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestPeer returns a bus, delivering its events to a channel, and
+// a socket it takes as a peer.
+func newTestPeer(t *testing.T) (*UDPBus, net.PacketConn, chan InvalidationEvent) {
+	bus, err := NewUDPBus("127.0.0.1:0", testBusSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan InvalidationEvent, 10)
+	bus.Subscribe(func(event InvalidationEvent) { events <- event })
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus.AddPeer(peer.LocalAddr().String())
+	return bus, peer, events
+}
+
+// noMoreEvents fails if an event is delivered shortly.
+func noMoreEvents(t *testing.T, events chan InvalidationEvent) {
+	t.Helper()
+	select {
+	case event := <-events:
+		t.Fatalf("got an unexpected event: %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// failingPacketConn fails every read, counting them.
+type failingPacketConn struct {
+	net.PacketConn
+	reads int64
+}
+
+func (conn *failingPacketConn) ReadFrom([]byte) (int, net.Addr, error) {
+	atomic.AddInt64(&conn.reads, 1)
+	return 0, nil, errors.New("read failed")
+}
+
+
+func TestLocalBusDeliversToEverySubscriber(t *testing.T) {
+	bus := NewLocalBus()
+	var delivered int64
+	for i := 0; i < 3; i++ {
+		bus.Subscribe(func(event InvalidationEvent) {
+			if event.SessionID == "a" {
+				atomic.AddInt64(&delivered, 1)
+			}
+		})
+	}
+	bus.Publish(InvalidationEvent{Kind: InvalidateDestroy, SessionID: "a"})
+	if delivered != 3 {
+		t.Fatalf("delivered %d times, want 3", delivered)
+	}
+}
+
+func TestUDPBusDeliversToThePeers(t *testing.T) {
+	a, b, fromA, fromB := newTestUDPBuses(t)
+	defer a.Close()
+	defer b.Close()
+
+	a.Publish(InvalidationEvent{Kind: InvalidateRegenerate, Origin: "a", SessionID: "x", NewSessionID: "y"})
+	if event := receiveEvent(t, fromA); event.SessionID != "x" || event.NewSessionID != "y" || event.Kind != InvalidateRegenerate {
+		t.Fatalf("got %+v", event)
+	}
+	b.Publish(InvalidationEvent{Kind: InvalidateExpiration, Origin: "b", SessionID: "z", Expires: time.Minute})
+	if event := receiveEvent(t, fromB); event.SessionID != "z" || event.Expires != time.Minute {
+		t.Fatalf("got %+v", event)
+	}
+}
+
+func TestUDPBusDropsForgedDatagrams(t *testing.T) {
+	bus, peer, events := newTestPeer(t)
+	defer bus.Close()
+	defer peer.Close()
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+
+	destroyAll := InvalidationEvent{Kind: InvalidateDestroyAll}
+	signed := sealDatagram(t, testBusSecret, destroyAll, time.Now())
+	sendDatagram(t, stranger, bus.Addr(), signed)
+	sendDatagram(t, peer, bus.Addr(), signed[32:])
+	sendDatagram(t, peer, bus.Addr(), sealDatagram(t, []byte("wrong secret"), destroyAll, time.Now()))
+	sendDatagram(t, peer, bus.Addr(), sealDatagram(t, testBusSecret, InvalidationEvent{Kind: InvalidateDestroy, SessionID: "a"}, time.Now()))
+
+	if event := receiveEvent(t, events); event.Kind != InvalidateDestroy || event.SessionID != "a" {
+		t.Fatalf("got a forged event: %+v", event)
+	}
+	noMoreEvents(t, events)
+}
+
+func TestUDPBusDropsReplayedDatagrams(t *testing.T) {
+	bus, peer, events := newTestPeer(t)
+	defer bus.Close()
+	defer peer.Close()
+
+	// a datagram captured, and replayed.
+	captured := sealDatagram(t, testBusSecret, InvalidationEvent{Kind: InvalidateDestroyAll}, time.Now())
+	sendDatagram(t, peer, bus.Addr(), captured)
+	sendDatagram(t, peer, bus.Addr(), captured)
+	if event := receiveEvent(t, events); event.Kind != InvalidateDestroyAll {
+		t.Fatalf("got %+v", event)
+	}
+	noMoreEvents(t, events)
+
+	// datagrams issued out of the freshness window.
+	stale := sealDatagram(t, testBusSecret, InvalidationEvent{Kind: InvalidateDestroyAll}, time.Now().Add(-2*UDPBusFreshness))
+	future := sealDatagram(t, testBusSecret, InvalidationEvent{Kind: InvalidateDestroyAll}, time.Now().Add(2*UDPBusFreshness))
+	sendDatagram(t, peer, bus.Addr(), stale)
+	sendDatagram(t, peer, bus.Addr(), future)
+	noMoreEvents(t, events)
+}
+
+func TestUDPBusBoundsTheNonces(t *testing.T) {
+	bus := &UDPBus{nonces: make(map[udpBusNonce]struct{})}
+	now := time.Now()
+	var nonce udpBusNonce
+	for i := 0; i < udpBusMaxNonces; i++ {
+		binary.BigEndian.PutUint32(nonce[:], uint32(i))
+		if !bus.fresh(now, nonce, now) {
+			t.Fatalf("nonce %d was dropped", i)
+		}
+	}
+	binary.BigEndian.PutUint32(nonce[:], udpBusMaxNonces)
+	if bus.fresh(now, nonce, now) {
+		t.Fatal("a nonce was kept past the bound")
+	}
+
+	// the nonces of the events which are not fresh any more are forgotten.
+	later := now.Add(2*UDPBusFreshness + time.Second)
+	if !bus.fresh(later, nonce, later) || len(bus.nonces) != 1 || len(bus.nonceOrder) != 1 {
+		t.Fatalf("got %d nonces, want only the last one", len(bus.nonces))
+	}
+}
+
+func TestUDPBusNeedsASecret(t *testing.T) {
+	if _, err := NewUDPBus("127.0.0.1:0", nil); err == nil {
+		t.Fatal("a bus was created without a secret")
+	}
+}
+
+func TestUDPBusBacksOffAfterReadErrors(t *testing.T) {
+	conn := &failingPacketConn{}
+	bus := &UDPBus{conn: conn, secret: testBusSecret}
+	go bus.receive()
+	time.Sleep(100 * time.Millisecond)
+	bus.mu.Lock()
+	bus.closed = true
+	bus.mu.Unlock()
+
+	// 10ms, 20ms, 40ms, 80ms...
+	if reads := atomic.LoadInt64(&conn.reads); reads > 10 {
+		t.Fatalf("read %d times in 100ms, without backing off", reads)
+	}
+}
+
+func TestInvalidationBusEvictsDestroyedSessionsFromOtherInstances(t *testing.T) {
+	bus := NewLocalBus()
+	first := newTestSessions(Config{Expires: time.Hour})
+	second := newTestSessions(Config{Expires: time.Hour})
+	first.UseInvalidationBus(bus)
+	second.UseInvalidationBus(bus)
+
+	ctx := newTestContext("")
+	first.Start(ctx).Set("user_id", 7)
+	sess := second.Start(newTestContext(issuedToken(ctx)))
+	if sess.ID() != Get(ctx).ID() {
+		t.Fatal("the other instance did not load the session")
+	}
+
+	destroyed := make(chan struct{})
+	second.OnDestroy(func(sid string) {
+		if sid == sess.ID() {
+			close(destroyed)
+		}
+	})
+	first.DestroyByID(sess.ID())
+	waitFor(t, destroyed, 5*time.Second, "the destroy event of the other instance")
+	if _, found := second.provider.find(sess.ID()); found {
+		t.Fatal("the other instance kept the destroyed session")
+	}
+}
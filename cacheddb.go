@@ -0,0 +1,596 @@
+package jwt_sessions
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/sessions"
+)
+
+
+// CachedDB is a session database decorator which keeps a bounded, in-process
+// cache of whole sessions in front of an inner (typically remote) database,
+// so reading a session's values does not hit the inner database each time.
+//
+// Sessions are loaded whole on their first read, and evicted in LRU order
+// when the cache is full, or when they are older than the TTL or past their
+// lifetime. On a multi-instance deployment, broadcast the sessions reported
+// by OnInvalidate, and call Invalidate with the ones received from others.
+
+
+// CacheMode tells how a CachedDB treats the writes.
+type CacheMode uint8
+
+const (
+	// CacheReadThrough writes to the inner database, and evicts the
+	// cached session, which is reloaded on its next read.
+	CacheReadThrough CacheMode = iota
+	// CacheWriteThrough writes to both the cache and the inner database.
+	CacheWriteThrough
+	// CacheWriteBehind writes to the cache, and queues the writes to be
+	// flushed to the inner database periodically, and on Flush or Close.
+	CacheWriteBehind
+)
+
+// Default values of CachedDBOptions.
+var (
+	DefaultCacheMaxSessions   = 1000
+	DefaultCacheFlushInterval = time.Second
+)
+
+const (
+	cachedSet byte = iota
+	cachedDelete
+)
+
+
+type (
+	// CachedDBOptions configures a CachedDB.
+	CachedDBOptions struct {
+		Mode CacheMode
+		// The maximum number of cached sessions.
+		// Default value: DefaultCacheMaxSessions.
+		MaxSessions int
+		// The maximum age of a cached session. Zero means that the sessions
+		// are cached until they are evicted, or their lifetime ends.
+		TTL time.Duration
+		// How often the queued writes are flushed in CacheWriteBehind mode.
+		// Default value: DefaultCacheFlushInterval.
+		FlushInterval time.Duration
+	}
+
+	// CacheStats are the counters of a CachedDB.
+	CacheStats struct {
+		Hits      uint64
+		Misses    uint64
+		Evictions uint64
+		Sessions  int
+	}
+
+	// CacheInvalidationListener is notified of the sessions written through
+	// this cache, so they can be invalidated in the caches of other instances.
+	CacheInvalidationListener func(sid string)
+
+	// CachedDB is the caching decorator. See NewCachedDB.
+	CachedDB struct {
+		inner     sessions.Database
+		options   CachedDBOptions
+		mu        sync.Mutex
+		entries   map[string]*list.Element
+		lru       *list.List
+		lifetimes map[string]sessions.LifeTime
+		pending   map[string][]cachedWrite
+		loads     map[string]*cacheLoad
+		stats     CacheStats
+		listeners []CacheInvalidationListener
+		flushMu   sync.Mutex
+		stop      chan struct{}
+		done      chan struct{}
+		closeOnce sync.Once
+		closed    bool
+	}
+
+	cacheEntry struct {
+		sid     string
+		values  map[string]interface{}
+		expires time.Time
+	}
+
+	// cacheLoad tracks the loads of a session in progress: a write
+	// meanwhile makes them stale, so what they loaded is not cached.
+	cacheLoad struct {
+		loading int
+		stale   bool
+	}
+
+	cachedWrite struct {
+		op        byte
+		key       string
+		value     interface{}
+		immutable bool
+		lifetime  sessions.LifeTime
+	}
+)
+
+var _ sessions.Database = (*CachedDB)(nil)
+
+
+// NewCachedDB returns a database caching the sessions of the inner database.
+// In CacheWriteBehind mode, it starts a goroutine flushing the writes: call
+// Close to stop it, and to flush the remaining writes.
+func NewCachedDB(inner sessions.Database, options CachedDBOptions) *CachedDB {
+	if options.MaxSessions <= 0 {
+		options.MaxSessions = DefaultCacheMaxSessions
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultCacheFlushInterval
+	}
+
+	db := &CachedDB{
+		inner:     inner,
+		options:   options,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		lifetimes: make(map[string]sessions.LifeTime),
+		pending:   make(map[string][]cachedWrite),
+		loads:     make(map[string]*cacheLoad),
+	}
+	if options.Mode == CacheWriteBehind {
+		db.stop, db.done = make(chan struct{}), make(chan struct{})
+		go db.flushLoop()
+	}
+	return db
+}
+
+func (db *CachedDB) flushLoop() {
+	defer close(db.done)
+	ticker := time.NewTicker(db.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			db.Flush()
+		case <-db.stop:
+			db.Flush()
+			return
+		}
+	}
+}
+
+// Flush writes the queued writes to the inner database.
+func (db *CachedDB) Flush() {
+	// flushMu is held until the writes are done, so the inner database
+	// is not read (or cleared) while it misses some of them.
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+	db.flushAll()
+}
+
+// flushAll is Flush, with flushMu held.
+func (db *CachedDB) flushAll() {
+	db.mu.Lock()
+	pending := db.pending
+	db.pending = make(map[string][]cachedWrite)
+	db.mu.Unlock()
+
+	for sid, writes := range pending {
+		db.apply(sid, writes)
+	}
+}
+
+// flushSession writes the queued writes of a single session.
+func (db *CachedDB) flushSession(sid string) {
+	db.flushMu.Lock()
+	db.flushLocked(sid)
+	db.flushMu.Unlock()
+}
+
+// flushLocked is flushSession, with flushMu held.
+func (db *CachedDB) flushLocked(sid string) {
+	db.mu.Lock()
+	writes := db.pending[sid]
+	delete(db.pending, sid)
+	db.mu.Unlock()
+
+	db.apply(sid, writes)
+}
+
+func (db *CachedDB) apply(sid string, writes []cachedWrite) {
+	for _, write := range writes {
+		switch write.op {
+		case cachedSet:
+			db.inner.Set(sid, write.lifetime, write.key, write.value, write.immutable)
+		case cachedDelete:
+			db.inner.Delete(sid, write.key)
+		}
+	}
+}
+
+// Close stops flushing the writes periodically, after flushing them.
+// The writes after closing are written to the inner database right away.
+// It is safe to call it more than once, and concurrently.
+func (db *CachedDB) Close() error {
+	db.closeOnce.Do(func() {
+		if db.stop != nil {
+			close(db.stop)
+			<-db.done
+		}
+
+		// the writes queued until closed are flushed before the next ones.
+		db.flushMu.Lock()
+		db.mu.Lock()
+		db.closed = true
+		db.mu.Unlock()
+		db.flushAll()
+		db.flushMu.Unlock()
+	})
+	return nil
+}
+
+// writesBehind tells whether the writes are queued. The lock must be held.
+func (db *CachedDB) writesBehind() bool {
+	return db.options.Mode == CacheWriteBehind && !db.closed
+}
+
+// direct runs a write to the inner database. Once a CacheWriteBehind
+// database is closed, it waits for the last flush, so the queued writes
+// do not overwrite it.
+func (db *CachedDB) direct(write func()) {
+	if db.options.Mode == CacheWriteBehind {
+		db.flushMu.Lock()
+		defer db.flushMu.Unlock()
+	}
+	write()
+}
+
+// OnInvalidate registers a listener notified of the sessions written
+// through this cache.
+func (db *CachedDB) OnInvalidate(listener CacheInvalidationListener) {
+	db.mu.Lock()
+	db.listeners = append(db.listeners, listener)
+	db.mu.Unlock()
+}
+
+func (db *CachedDB) fireInvalidate(sid string) {
+	db.mu.Lock()
+	listeners := db.listeners
+	db.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener(sid)
+	}
+}
+
+// Invalidate evicts a session from the cache, e.g. when it was written by
+// another instance. The queued writes of the session are kept.
+func (db *CachedDB) Invalidate(sid string) {
+	db.mu.Lock()
+	db.changed(sid)
+	db.evict(sid)
+	db.mu.Unlock()
+}
+
+// InvalidateAll evicts all the sessions from the cache.
+func (db *CachedDB) InvalidateAll() {
+	db.mu.Lock()
+	for _, load := range db.loads {
+		load.stale = true
+	}
+	db.entries = make(map[string]*list.Element)
+	db.lru.Init()
+	db.mu.Unlock()
+}
+
+// Stats returns the cache's counters.
+func (db *CachedDB) Stats() CacheStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stats := db.stats
+	stats.Sessions = db.lru.Len()
+	return stats
+}
+
+// changed makes the loads of a session in progress stale, since
+// they may miss a change. The lock must be held.
+func (db *CachedDB) changed(sid string) {
+	if load, ok := db.loads[sid]; ok {
+		load.stale = true
+	}
+}
+
+// evict removes a cached session. The lock must be held.
+func (db *CachedDB) evict(sid string) {
+	if element, ok := db.entries[sid]; ok {
+		db.lru.Remove(element)
+		delete(db.entries, sid)
+	}
+}
+
+// cached returns a live cached session, if any. The lock must be held.
+func (db *CachedDB) cached(sid string) *cacheEntry {
+	element, ok := db.entries[sid]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		db.evict(sid)
+		return nil
+	}
+	db.lru.MoveToFront(element)
+	return entry
+}
+
+// expiration is the time a session can be cached until. The lock must be held.
+func (db *CachedDB) expiration(sid string) time.Time {
+	var expires time.Time
+	now := time.Now()
+	if db.options.TTL > 0 {
+		expires = now.Add(db.options.TTL)
+	}
+	if lifetime, ok := db.lifetimes[sid]; ok && lifetime.Before(now) {
+		// the session is over: forget its lifetime.
+		delete(db.lifetimes, sid)
+	} else if ok && (expires.IsZero() || lifetime.Before(expires)) {
+		expires = lifetime.Time
+	}
+	return expires
+}
+
+// setLifetime keeps the lifetime of a session. The zero lifetime (e.g. of a
+// write keeping the expiration as it is) is not kept. The lock must be held.
+func (db *CachedDB) setLifetime(sid string, lifetime sessions.LifeTime) {
+	if lifetime.IsZero() {
+		return
+	}
+	db.lifetimes[sid] = lifetime
+	if len(db.lifetimes) > 2*db.options.MaxSessions {
+		db.pruneLifetimes()
+	}
+}
+
+// pruneLifetimes forgets the ended lifetimes, and the ones of the sessions
+// which are neither cached nor queued: they are kept again on their next
+// write. The lock must be held.
+func (db *CachedDB) pruneLifetimes() {
+	now := time.Now()
+	for sid, lifetime := range db.lifetimes {
+		_, cached := db.entries[sid]
+		_, queued := db.pending[sid]
+		if lifetime.Before(now) || (!cached && !queued) {
+			delete(db.lifetimes, sid)
+		}
+	}
+}
+
+// load returns the cached session, loading it from the inner database on a miss.
+func (db *CachedDB) load(sid string) *cacheEntry {
+	db.mu.Lock()
+	if entry := db.cached(sid); entry != nil {
+		db.stats.Hits++
+		db.mu.Unlock()
+		return entry
+	}
+	db.stats.Misses++
+	writesBehind := db.writesBehind()
+	db.mu.Unlock()
+
+	if writesBehind {
+		// nothing is flushed until the values are loaded: the writes
+		// queued meanwhile are merged into them instead (see below).
+		db.flushMu.Lock()
+		defer db.flushMu.Unlock()
+		db.flushLocked(sid)
+	}
+
+	db.mu.Lock()
+	load, ok := db.loads[sid]
+	if !ok {
+		load = &cacheLoad{}
+		db.loads[sid] = load
+	}
+	load.loading++
+	db.mu.Unlock()
+
+	values := make(map[string]interface{})
+	db.inner.Visit(sid, func(key string, value interface{}) {
+		values[key] = value
+	})
+	entry := &cacheEntry{sid: sid, values: values}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if load.loading--; load.loading == 0 {
+		delete(db.loads, sid)
+	}
+	// the writes queued while loading are not in the inner database yet.
+	for _, write := range db.pending[sid] {
+		switch write.op {
+		case cachedSet:
+			values[write.key] = write.value
+		case cachedDelete:
+			delete(values, write.key)
+		}
+	}
+	// the session was written meanwhile: the loaded values may be stale.
+	if load.stale {
+		return entry
+	}
+	entry.expires = db.expiration(sid)
+	db.evict(sid)
+	db.entries[sid] = db.lru.PushFront(entry)
+	for db.lru.Len() > db.options.MaxSessions {
+		oldest := db.lru.Back()
+		db.lru.Remove(oldest)
+		delete(db.entries, oldest.Value.(*cacheEntry).sid)
+		db.stats.Evictions++
+	}
+	return entry
+}
+
+// write applies a write according to the mode. Except in CacheWriteBehind
+// mode, the inner database is written first, so a concurrent load does not
+// cache the session without the write.
+func (db *CachedDB) write(sid string, write cachedWrite) {
+	db.mu.Lock()
+	writesBehind := db.writesBehind()
+	if writesBehind {
+		// the queued writes are flushed before the session is loaded.
+		db.pending[sid] = append(db.pending[sid], write)
+	}
+	db.mu.Unlock()
+	if !writesBehind {
+		db.direct(func() { db.apply(sid, []cachedWrite{write}) })
+	}
+
+	db.mu.Lock()
+	db.changed(sid)
+	if write.op == cachedSet {
+		db.setLifetime(sid, write.lifetime)
+	}
+	if db.options.Mode == CacheReadThrough {
+		db.evict(sid)
+	} else if entry := db.cached(sid); entry != nil {
+		switch write.op {
+		case cachedSet:
+			entry.values[write.key] = write.value
+		case cachedDelete:
+			delete(entry.values, write.key)
+		}
+	}
+	db.mu.Unlock()
+
+	db.fireInvalidate(sid)
+}
+
+// Acquire flushes the session's queued writes, and delegates to the inner database.
+func (db *CachedDB) Acquire(sid string, expires time.Duration) sessions.LifeTime {
+	db.flushSession(sid)
+	lifetime := db.inner.Acquire(sid, expires)
+
+	db.mu.Lock()
+	db.changed(sid)
+	db.setLifetime(sid, lifetime)
+	db.evict(sid)
+	db.mu.Unlock()
+	return lifetime
+}
+
+// OnUpdateExpiration delegates to the inner database, and
+// aligns the cached session's expiration with the new one.
+func (db *CachedDB) OnUpdateExpiration(sid string, newExpires time.Duration) error {
+	db.mu.Lock()
+	db.setLifetime(sid, sessions.LifeTime{Time: time.Now().Add(newExpires)})
+	if entry := db.cached(sid); entry != nil {
+		entry.expires = db.expiration(sid)
+	}
+	db.mu.Unlock()
+
+	err := db.inner.OnUpdateExpiration(sid, newExpires)
+	db.fireInvalidate(sid)
+	return err
+}
+
+// Set stores a value according to the mode.
+func (db *CachedDB) Set(sid string, lifetime sessions.LifeTime, key string, value interface{}, immutable bool) {
+	db.write(sid, cachedWrite{op: cachedSet, key: key, value: value, immutable: immutable, lifetime: lifetime})
+}
+
+// Get retrieves a value from the cache, loading the session on a miss.
+func (db *CachedDB) Get(sid string, key string) interface{} {
+	entry := db.load(sid)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return entry.values[key]
+}
+
+// Visit loops through all the session's keys and values, from the cache.
+func (db *CachedDB) Visit(sid string, cb func(key string, value interface{})) {
+	entry := db.load(sid)
+	db.mu.Lock()
+	values := make(map[string]interface{}, len(entry.values))
+	for key, value := range entry.values {
+		values[key] = value
+	}
+	db.mu.Unlock()
+
+	for key, value := range values {
+		cb(key, value)
+	}
+}
+
+// Len returns the number of the session's keys, from the cache.
+func (db *CachedDB) Len(sid string) int {
+	entry := db.load(sid)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(entry.values)
+}
+
+// Delete removes a key according to the mode, telling whether it existed.
+func (db *CachedDB) Delete(sid string, key string) bool {
+	db.mu.Lock()
+	writesBehind := db.writesBehind()
+	db.mu.Unlock()
+	if !writesBehind {
+		var deleted bool
+		db.direct(func() { deleted = db.inner.Delete(sid, key) })
+		db.mu.Lock()
+		db.changed(sid)
+		if entry := db.cached(sid); entry != nil && db.options.Mode == CacheWriteThrough {
+			delete(entry.values, key)
+		} else {
+			db.evict(sid)
+		}
+		db.mu.Unlock()
+		db.fireInvalidate(sid)
+		return deleted
+	}
+
+	entry := db.load(sid)
+	db.mu.Lock()
+	_, existed := entry.values[key]
+	db.mu.Unlock()
+
+	db.write(sid, cachedWrite{op: cachedDelete, key: key})
+	return existed
+}
+
+// Clear discards the session's queued writes, and clears it
+// in both the cache and the inner database.
+func (db *CachedDB) Clear(sid string) {
+	db.flushMu.Lock()
+	db.mu.Lock()
+	db.changed(sid)
+	delete(db.pending, sid)
+	if entry := db.cached(sid); entry != nil && db.options.Mode != CacheReadThrough {
+		entry.values = make(map[string]interface{})
+	} else {
+		db.evict(sid)
+	}
+	db.mu.Unlock()
+
+	db.inner.Clear(sid)
+	db.flushMu.Unlock()
+
+	db.fireInvalidate(sid)
+}
+
+// Release discards the session's queued writes, and removes
+// it from both the cache and the inner database.
+func (db *CachedDB) Release(sid string) {
+	db.flushMu.Lock()
+	db.mu.Lock()
+	db.changed(sid)
+	delete(db.pending, sid)
+	delete(db.lifetimes, sid)
+	db.evict(sid)
+	db.mu.Unlock()
+
+	db.inner.Release(sid)
+	db.flushMu.Unlock()
+
+	db.fireInvalidate(sid)
+}
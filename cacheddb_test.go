@@ -0,0 +1,193 @@
+package jwt_sessions
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/sessions"
+)
+
+
+// duringVisitDB runs a function once, in the middle of the first visit
+// of its inner database, e.g. to interleave a write with a load.
+type duringVisitDB struct {
+	sessions.Database
+	duringVisit func()
+}
+
+func (db *duringVisitDB) Visit(sid string, cb func(key string, value interface{})) {
+	if duringVisit := db.duringVisit; duringVisit != nil {
+		db.duringVisit = nil
+		duringVisit()
+	}
+	db.Database.Visit(sid, cb)
+}
+
+var cacheModes = map[string]CacheMode{
+	"read-through":  CacheReadThrough,
+	"write-through": CacheWriteThrough,
+	"write-behind":  CacheWriteBehind,
+}
+
+
+func TestCachedDBModes(t *testing.T) {
+	for name, mode := range cacheModes {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			inner := NewMemDB()
+			db := NewCachedDB(inner, CachedDBOptions{Mode: mode, FlushInterval: time.Hour})
+			defer db.Close()
+
+			lifetime := db.Acquire("a", time.Hour)
+			db.Set("a", lifetime, "name", "alice", false)
+			db.Set("a", lifetime, "count", 1, false)
+			if got := db.Get("a", "name"); got != "alice" {
+				t.Fatalf("name: got %#v", got)
+			}
+			db.Set("a", lifetime, "name", "bob", false)
+			if !db.Delete("a", "count") {
+				t.Fatal("count was not deleted")
+			}
+			if got := db.Get("a", "name"); got != "bob" || db.Len("a") != 1 {
+				t.Fatalf("name: got %#v, with %d values", got, db.Len("a"))
+			}
+
+			db.Flush()
+			if got := inner.Get("a", "name"); got != "bob" || inner.Len("a") != 1 {
+				t.Fatalf("inner name: got %#v, with %d values", got, inner.Len("a"))
+			}
+			db.Clear("a")
+			if db.Len("a") != 0 || inner.Len("a") != 0 {
+				t.Fatal("the session was not cleared")
+			}
+		})
+	}
+}
+
+func TestCachedDBCachesWhileOtherSessionsAreWritten(t *testing.T) {
+	inner := &duringVisitDB{Database: NewMemDB()}
+	db := NewCachedDB(inner, CachedDBOptions{Mode: CacheWriteThrough})
+	db.Set("a", db.Acquire("a", time.Hour), "name", "alice", false)
+	lifetime := db.Acquire("b", time.Hour)
+
+	inner.duringVisit = func() { db.Set("b", lifetime, "name", "bob", false) }
+	db.Get("a", "name")
+	hits := db.Stats().Hits
+	if got := db.Get("a", "name"); got != "alice" || db.Stats().Hits != hits+1 {
+		t.Fatal("the session was not cached, because another one was written")
+	}
+}
+
+func TestCachedDBDoesNotCacheAStaleLoad(t *testing.T) {
+	inner := &duringVisitDB{Database: NewMemDB()}
+	db := NewCachedDB(inner, CachedDBOptions{Mode: CacheReadThrough})
+	lifetime := db.Acquire("a", time.Hour)
+	db.Set("a", lifetime, "name", "alice", false)
+
+	inner.duringVisit = func() { inner.Database.Set("a", lifetime, "name", "bob", false); db.Invalidate("a") }
+	db.Get("a", "name")
+	if got := db.Get("a", "name"); got != "bob" {
+		t.Fatalf("got %#v: the values loaded while written were cached", got)
+	}
+	if len(db.loads) != 0 {
+		t.Fatal("the finished loads are still tracked")
+	}
+}
+
+func TestCachedDBForgetsReleasedSessions(t *testing.T) {
+	db := NewCachedDB(NewMemDB(), CachedDBOptions{Mode: CacheWriteThrough})
+	for _, sid := range []string{"a", "b", "c"} {
+		db.Set(sid, db.Acquire(sid, time.Hour), "name", sid, false)
+		db.Get(sid, "name")
+		db.Release(sid)
+	}
+	// an ended lifetime is forgotten when the session is loaded again.
+	db.Acquire("d", time.Hour)
+	db.Set("d", sessionsLifeTime(-time.Second), "name", "d", false)
+	db.Get("d", "name")
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.lifetimes) != 0 || len(db.loads) != 0 {
+		t.Fatalf("got %d lifetimes and %d loads, want none", len(db.lifetimes), len(db.loads))
+	}
+}
+
+func TestCachedDBMergesTheWritesQueuedWhileLoading(t *testing.T) {
+	inner := &duringVisitDB{Database: NewMemDB()}
+	db := NewCachedDB(inner, CachedDBOptions{Mode: CacheWriteBehind, FlushInterval: time.Hour})
+	defer db.Close()
+	lifetime := db.Acquire("a", time.Hour)
+	db.Set("a", lifetime, "name", "alice", false)
+	db.Set("a", lifetime, "role", "admin", false)
+	db.Invalidate("a")
+
+	inner.duringVisit = func() {
+		db.Set("a", lifetime, "name", "bob", false)
+		db.Set("a", lifetime, "role", "user", false)
+	}
+	if got := db.Get("a", "name"); got != "bob" {
+		t.Fatalf("name: got %#v, want the write queued while loading", got)
+	}
+	if got := db.Get("a", "role"); got != "user" {
+		t.Fatalf("role: got %#v, want the write queued while loading", got)
+	}
+	db.Flush()
+	if got := inner.Get("a", "name"); got != "bob" || inner.Len("a") != 2 {
+		t.Fatalf("inner name: got %#v, with %d values", got, inner.Len("a"))
+	}
+}
+
+func TestCachedDBBoundsTheLifetimes(t *testing.T) {
+	db := NewCachedDB(NewMemDB(), CachedDBOptions{Mode: CacheWriteThrough, MaxSessions: 2})
+	for i := 0; i < 100; i++ {
+		sid := string(rune('a' + i%26)) + string(rune('a' + i/26))
+		db.Set(sid, db.Acquire(sid, time.Hour), "name", sid, false)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.lifetimes) > 2*db.options.MaxSessions {
+		t.Fatalf("got %d lifetimes, want at most %d", len(db.lifetimes), 2*db.options.MaxSessions)
+	}
+}
+
+func TestCachedDBCloseConcurrently(t *testing.T) {
+	inner := NewMemDB()
+	db := NewCachedDB(inner, CachedDBOptions{Mode: CacheWriteBehind, FlushInterval: time.Millisecond})
+	lifetime := db.Acquire("a", time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.Set("a", lifetime, "name", "alice", false)
+			db.Close()
+		}()
+	}
+	wg.Wait()
+	// written right away, once closed.
+	db.Set("a", lifetime, "name", "bob", false)
+	if got := inner.Get("a", "name"); got != "bob" {
+		t.Fatalf("got %#v, want the write after closing", got)
+	}
+}
+
+func TestCachedDBEvictsAfterTheTTL(t *testing.T) {
+	db := NewCachedDB(NewMemDB(), CachedDBOptions{Mode: CacheWriteThrough, TTL: 10 * time.Millisecond, MaxSessions: 1})
+	db.Set("a", db.Acquire("a", time.Hour), "name", "alice", false)
+	db.Set("b", db.Acquire("b", time.Hour), "name", "bob", false)
+	db.Get("a", "name")
+	db.Get("b", "name")
+	if stats := db.Stats(); stats.Sessions != 1 || stats.Evictions != 1 {
+		t.Fatalf("got %+v, want a single session cached", stats)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	misses := db.Stats().Misses
+	if db.Get("b", "name") != "bob" || db.Stats().Misses != misses+1 {
+		t.Fatal("the session was cached past its TTL")
+	}
+}
@@ -0,0 +1,541 @@
+package jwt_sessions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/core/errors"
+	"github.com/kataras/iris/sessions"
+)
+
+
+// Persistent databases (FileDB, SQLDB, RedisDB) store each value in an
+// envelope telling the envelope version, the codec used to encode it, and
+// the name of the value's type. Values are decoded with the codec they were
+// encoded with, so the default codec can be changed without breaking stored
+// sessions, and into their registered type, so e.g. an int is still an int
+// (not a JSON float64) after a round trip.
+//
+// Values of unregistered types are always encoded with the JSON codec and
+// decoded into generic values (float64, string, map[string]interface{}...).
+// Register custom types with `RegisterType` at startup, before any session
+// is read.
+
+
+type (
+	// Codec marshals and unmarshals stored values. Iris transcoders are codecs.
+	Codec interface {
+		Marshal(value interface{}) ([]byte, error)
+		Unmarshal(data []byte, ptr interface{}) error
+	}
+
+	jsonCodec   struct{}
+	gobCodec    struct{}
+	binaryCodec struct{}
+)
+
+// The IDs of the provided codecs. They are stored in the envelopes, so never change them.
+const (
+	JSONCodecID   byte = 1
+	GobCodecID    byte = 2
+	BinaryCodecID byte = 3
+)
+
+const (
+	envelopeMagic   byte = 0xC5
+	envelopeVersion byte = 1
+)
+
+// DefaultCodecID is the codec used to encode values of registered types.
+// Changing it does not affect already stored values.
+var DefaultCodecID = JSONCodecID
+
+var (
+	errUnknownCodec = errors.New("unknown codec: %d")
+	errBinaryCodec  = errors.New("binary codec: %s")
+)
+
+var (
+	codecsMu    sync.RWMutex
+	codecs      = map[byte]Codec{JSONCodecID: jsonCodec{}, GobCodecID: gobCodec{}, BinaryCodecID: binaryCodec{}}
+	typesMu     sync.RWMutex
+	typesByName = map[string]reflect.Type{}
+	namesByType = map[reflect.Type]string{}
+)
+
+
+func init() {
+	for _, sample := range []interface{}{
+		"", false, int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0), float32(0), float64(0),
+		[]byte(nil), []string(nil), []int(nil), []interface{}(nil),
+		map[string]interface{}(nil), map[string]string(nil),
+		time.Time{}, time.Duration(0),
+		[]AuthEvent(nil), Impersonation{},
+	} {
+		RegisterType(sample)
+	}
+}
+
+// RegisterCodec registers a codec under an ID, which is stored alongside the
+// values it encodes. IDs up to 15 are reserved for this package.
+func RegisterCodec(id byte, codec Codec) {
+	codecsMu.Lock()
+	codecs[id] = codec
+	codecsMu.Unlock()
+}
+
+// RegisterType registers the type of the sample value, named after the
+// type itself (e.g. "main.Cart"), so stored values are decoded into it.
+func RegisterType(sample interface{}) {
+	RegisterTypeName(fmt.Sprintf("%T", sample), sample)
+}
+
+// RegisterTypeName is like RegisterType, but with an explicit name
+// which is kept when the type is moved or renamed.
+func RegisterTypeName(name string, sample interface{}) {
+	typ := reflect.TypeOf(sample)
+	typesMu.Lock()
+	typesByName[name] = typ
+	namesByType[typ] = name
+	typesMu.Unlock()
+}
+
+func codecByID(id byte) (Codec, error) {
+	codecsMu.RLock()
+	codec, ok := codecs[id]
+	codecsMu.RUnlock()
+	if !ok {
+		return nil, errUnknownCodec.Format(id)
+	}
+	return codec, nil
+}
+
+// encodeStoredValue encodes a value in an envelope.
+func encodeStoredValue(value interface{}) ([]byte, error) {
+	typesMu.RLock()
+	name, registered := "", false
+	if value != nil {
+		name, registered = namesByType[reflect.TypeOf(value)]
+	}
+	typesMu.RUnlock()
+
+	codecID := JSONCodecID
+	if registered {
+		codecID = DefaultCodecID
+	}
+	codec, err := codecByID(codecID)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := codec.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := make([]byte, 0, 3+binary.MaxVarintLen64+len(name)+len(payload))
+	envelope = append(envelope, envelopeMagic, envelopeVersion, codecID)
+	envelope = appendUvarint(envelope, uint64(len(name)))
+	envelope = append(envelope, name...)
+	return append(envelope, payload...), nil
+}
+
+// decodeStoredValue decodes an envelope, returning nil on any error. Values
+// stored without an envelope are decoded with the iris' default transcoder.
+func decodeStoredValue(encoded []byte) interface{} {
+	if encoded == nil {
+		return nil
+	}
+
+	if len(encoded) < 3 || encoded[0] != envelopeMagic || encoded[1] != envelopeVersion {
+		var value interface{}
+		if err := sessions.DefaultTranscoder.Unmarshal(encoded, &value); err != nil {
+			return nil
+		}
+		return value
+	}
+
+	codec, err := codecByID(encoded[2])
+	if err != nil {
+		return nil
+	}
+	size, n := binary.Uvarint(encoded[3:])
+	if n <= 0 || uint64(len(encoded)-3-n) < size {
+		return nil
+	}
+	name := string(encoded[3+n : 3+n+int(size)])
+	payload := encoded[3+n+int(size):]
+
+	typesMu.RLock()
+	typ, registered := typesByName[name]
+	typesMu.RUnlock()
+
+	if !registered {
+		var value interface{}
+		if err := codec.Unmarshal(payload, &value); err != nil {
+			return nil
+		}
+		return value
+	}
+
+	ptr := reflect.New(typ)
+	if err := codec.Unmarshal(payload, ptr.Interface()); err != nil {
+		return nil
+	}
+	return ptr.Elem().Interface()
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], x)]...)
+}
+
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error)    { return json.Marshal(value) }
+func (jsonCodec) Unmarshal(data []byte, ptr interface{}) error { return json.Unmarshal(data, ptr) }
+
+func (gobCodec) Marshal(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(value)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, ptr interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(ptr)
+}
+
+
+// The binary codec is a compact, msgpack-like, encoding: each value is a tag
+// byte followed by its data. Structs are encoded as maps of their exported
+// fields, and time.Time by its own binary encoding.
+const (
+	binaryNil byte = iota
+	binaryFalse
+	binaryTrue
+	binaryInt
+	binaryUint
+	binaryFloat
+	binaryString
+	binaryBytes
+	binaryArray
+	binaryMap
+	binaryTime
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (binaryCodec) Marshal(value interface{}) ([]byte, error) {
+	return appendBinary(nil, reflect.ValueOf(value))
+}
+
+func appendBinary(buf []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(buf, binaryNil), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return append(buf, binaryNil), nil
+		}
+		return appendBinary(buf, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, binaryTrue), nil
+		}
+		return append(buf, binaryFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var tmp [binary.MaxVarintLen64]byte
+		return append(append(buf, binaryInt), tmp[:binary.PutVarint(tmp[:], v.Int())]...), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendUvarint(append(buf, binaryUint), v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		var tmp [8]byte
+		binary.BigEndian.PutUint64(tmp[:], math.Float64bits(v.Float()))
+		return append(append(buf, binaryFloat), tmp[:]...), nil
+	case reflect.String:
+		buf = appendUvarint(append(buf, binaryString), uint64(v.Len()))
+		return append(buf, v.String()...), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return append(buf, binaryNil), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf = appendUvarint(append(buf, binaryBytes), uint64(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				buf = append(buf, byte(v.Index(i).Uint()))
+			}
+			return buf, nil
+		}
+		buf = appendUvarint(append(buf, binaryArray), uint64(v.Len()))
+		var err error
+		for i := 0; i < v.Len() && err == nil; i++ {
+			buf, err = appendBinary(buf, v.Index(i))
+		}
+		return buf, err
+	case reflect.Map:
+		if v.IsNil() {
+			return append(buf, binaryNil), nil
+		}
+		buf = appendUvarint(append(buf, binaryMap), uint64(v.Len()))
+		var err error
+		iter := v.MapRange()
+		for iter.Next() && err == nil {
+			if buf, err = appendBinary(buf, iter.Key()); err == nil {
+				buf, err = appendBinary(buf, iter.Value())
+			}
+		}
+		return buf, err
+	case reflect.Struct:
+		if v.Type() == timeType {
+			data, err := v.Interface().(time.Time).MarshalBinary()
+			buf = appendUvarint(append(buf, binaryTime), uint64(len(data)))
+			return append(buf, data...), err
+		}
+		fields := exportedFields(v.Type())
+		buf = appendUvarint(append(buf, binaryMap), uint64(len(fields)))
+		var err error
+		for _, i := range fields {
+			buf = appendUvarint(append(buf, binaryString), uint64(len(v.Type().Field(i).Name)))
+			buf = append(buf, v.Type().Field(i).Name...)
+			if buf, err = appendBinary(buf, v.Field(i)); err != nil {
+				break
+			}
+		}
+		return buf, err
+	}
+	return nil, errBinaryCodec.Format("unsupported type " + v.Type().String())
+}
+
+func exportedFields(typ reflect.Type) []int {
+	var fields []int
+	for i := 0; i < typ.NumField(); i++ {
+		if typ.Field(i).PkgPath == "" {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
+
+func (binaryCodec) Unmarshal(data []byte, ptr interface{}) error {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errBinaryCodec.Format("expected a non-nil pointer")
+	}
+	rest, err := readBinary(data, v.Elem())
+	if err == nil && len(rest) > 0 {
+		err = errBinaryCodec.Format("trailing data")
+	}
+	return err
+}
+
+var errBinaryTruncated = errBinaryCodec.Format("truncated data")
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, errBinaryTruncated
+	}
+	return x, data[n:], nil
+}
+
+func readLength(data []byte) (int, []byte, error) {
+	n, rest, err := readUvarint(data)
+	if err == nil && n > uint64(len(rest)) {
+		// every item takes at least one byte, so this is a safe upper bound.
+		err = errBinaryTruncated
+	}
+	return int(n), rest, err
+}
+
+// readBinary decodes a value into the (settable) target, converting
+// among compatible kinds. Empty interfaces receive generic values.
+func readBinary(data []byte, target reflect.Value) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errBinaryTruncated
+	}
+	tag := data[0]
+
+	if target.Kind() == reflect.Ptr && tag != binaryNil {
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		return readBinary(data, target.Elem())
+	}
+
+	if target.Kind() == reflect.Interface && target.NumMethod() == 0 && tag != binaryNil {
+		generic, rest, err := readGeneric(data)
+		if err == nil {
+			target.Set(reflect.ValueOf(generic))
+		}
+		return rest, err
+	}
+
+	data = data[1:]
+	switch tag {
+	case binaryNil:
+		target.Set(reflect.Zero(target.Type()))
+		return data, nil
+	case binaryFalse, binaryTrue:
+		if target.Kind() != reflect.Bool {
+			break
+		}
+		target.SetBool(tag == binaryTrue)
+		return data, nil
+	case binaryInt, binaryUint, binaryFloat:
+		var i int64
+		var u uint64
+		var f float64
+		switch tag {
+		case binaryInt:
+			n, size := binary.Varint(data)
+			if size <= 0 {
+				return nil, errBinaryTruncated
+			}
+			i, u, f, data = n, uint64(n), float64(n), data[size:]
+		case binaryUint:
+			n, rest, err := readUvarint(data)
+			if err != nil {
+				return nil, err
+			}
+			i, u, f, data = int64(n), n, float64(n), rest
+		default:
+			if len(data) < 8 {
+				return nil, errBinaryTruncated
+			}
+			f = math.Float64frombits(binary.BigEndian.Uint64(data))
+			i, u, data = int64(f), uint64(f), data[8:]
+		}
+		switch target.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			target.SetInt(i)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			target.SetUint(u)
+		case reflect.Float32, reflect.Float64:
+			target.SetFloat(f)
+		default:
+			return nil, errBinaryCodec.Format("cannot decode a number into " + target.Type().String())
+		}
+		return data, nil
+	case binaryString, binaryBytes:
+		n, rest, err := readLength(data)
+		if err != nil {
+			return nil, err
+		}
+		raw := rest[:n]
+		if target.Kind() == reflect.String {
+			target.SetString(string(raw))
+		} else if target.Kind() == reflect.Slice && target.Type().Elem().Kind() == reflect.Uint8 {
+			target.SetBytes(append([]byte(nil), raw...))
+		} else {
+			break
+		}
+		return rest[n:], nil
+	case binaryTime:
+		n, rest, err := readLength(data)
+		if err != nil {
+			return nil, err
+		}
+		if target.Type() != timeType {
+			break
+		}
+		var t time.Time
+		if err := t.UnmarshalBinary(rest[:n]); err != nil {
+			return nil, err
+		}
+		target.Set(reflect.ValueOf(t))
+		return rest[n:], nil
+	case binaryArray:
+		n, rest, err := readLength(data)
+		if err != nil {
+			return nil, err
+		}
+		switch target.Kind() {
+		case reflect.Slice:
+			target.Set(reflect.MakeSlice(target.Type(), n, n))
+		case reflect.Array:
+			if target.Len() < n {
+				return nil, errBinaryCodec.Format("array too short")
+			}
+		default:
+			return nil, errBinaryCodec.Format("cannot decode an array into " + target.Type().String())
+		}
+		for i := 0; i < n && err == nil; i++ {
+			rest, err = readBinary(rest, target.Index(i))
+		}
+		return rest, err
+	case binaryMap:
+		n, rest, err := readLength(data)
+		if err != nil {
+			return nil, err
+		}
+		switch target.Kind() {
+		case reflect.Map:
+			target.Set(reflect.MakeMapWithSize(target.Type(), n))
+			for i := 0; i < n && err == nil; i++ {
+				key := reflect.New(target.Type().Key()).Elem()
+				value := reflect.New(target.Type().Elem()).Elem()
+				if rest, err = readBinary(rest, key); err == nil {
+					if rest, err = readBinary(rest, value); err == nil {
+						target.SetMapIndex(key, value)
+					}
+				}
+			}
+		case reflect.Struct:
+			for i := 0; i < n && err == nil; i++ {
+				var name string
+				if rest, err = readBinary(rest, reflect.ValueOf(&name).Elem()); err != nil {
+					break
+				}
+				field := target.FieldByName(name)
+				if !field.IsValid() || !field.CanSet() {
+					var ignored interface{}
+					field = reflect.ValueOf(&ignored).Elem()
+				}
+				rest, err = readBinary(rest, field)
+			}
+		default:
+			return nil, errBinaryCodec.Format("cannot decode a map into " + target.Type().String())
+		}
+		return rest, err
+	default:
+		return nil, errBinaryCodec.Format("unknown tag")
+	}
+	return nil, errBinaryCodec.Format("cannot decode into " + target.Type().String())
+}
+
+// readGeneric decodes a value into its generic representation.
+func readGeneric(data []byte) (interface{}, []byte, error) {
+	var target reflect.Value
+	switch data[0] {
+	case binaryFalse, binaryTrue:
+		target = reflect.New(reflect.TypeOf(false)).Elem()
+	case binaryInt:
+		target = reflect.New(reflect.TypeOf(int64(0))).Elem()
+	case binaryUint:
+		target = reflect.New(reflect.TypeOf(uint64(0))).Elem()
+	case binaryFloat:
+		target = reflect.New(reflect.TypeOf(float64(0))).Elem()
+	case binaryString:
+		target = reflect.New(reflect.TypeOf("")).Elem()
+	case binaryBytes:
+		target = reflect.New(reflect.TypeOf([]byte(nil))).Elem()
+	case binaryTime:
+		target = reflect.New(timeType).Elem()
+	case binaryArray:
+		target = reflect.New(reflect.TypeOf([]interface{}(nil))).Elem()
+	case binaryMap:
+		target = reflect.New(reflect.TypeOf(map[string]interface{}(nil))).Elem()
+	default:
+		return nil, nil, errBinaryCodec.Format("unknown tag")
+	}
+	rest, err := readBinary(data, target)
+	return target.Interface(), rest, err
+}
@@ -0,0 +1,200 @@
+package jwt_sessions
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+
+var testCodecs = []struct {
+	name string
+	id   byte
+}{
+	{"json", JSONCodecID},
+	{"gob", GobCodecID},
+	{"binary", BinaryCodecID},
+}
+
+// forEachCodec runs the test with each provided codec as the default one.
+func forEachCodec(t *testing.T, test func(t *testing.T, id byte)) {
+	defer func(previous byte) { DefaultCodecID = previous }(DefaultCodecID)
+	for _, codec := range testCodecs {
+		DefaultCodecID = codec.id
+		t.Run(codec.name, func(t *testing.T) { test(t, codec.id) })
+	}
+}
+
+// roundTrip encodes and decodes a value, checking the codec it was encoded with.
+func roundTrip(t *testing.T, value interface{}, codecID byte) interface{} {
+	t.Helper()
+	encoded, err := encodeStoredValue(value)
+	if err != nil {
+		t.Fatalf("encoding %#v: %v", value, err)
+	}
+	if encoded[0] != envelopeMagic || encoded[1] != envelopeVersion || encoded[2] != codecID {
+		t.Fatalf("encoding %#v: got the envelope % x", value, encoded[:3])
+	}
+	return decodeStoredValue(encoded)
+}
+
+type unregisteredCart struct {
+	Items []string
+}
+
+type registeredCart struct {
+	Items []string
+	Total int
+}
+
+func init() {
+	RegisterTypeName("jwt_sessions_test.cart", registeredCart{})
+}
+
+
+func TestCodecsRoundTrip(t *testing.T) {
+	when := time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+	values := []interface{}{
+		"alice", true, 7, int64(-7), uint32(7), 1.5, float32(2.5),
+		[]byte("raw"), []string{"a", "b"}, []int{1, 2},
+		map[string]string{"a": "b"}, time.Minute,
+	}
+	forEachCodec(t, func(t *testing.T, id byte) {
+		for _, value := range values {
+			if got := roundTrip(t, value, id); !reflect.DeepEqual(got, value) {
+				t.Errorf("got %#v, want %#v", got, value)
+			}
+		}
+		if got, ok := roundTrip(t, when, id).(time.Time); !ok || !got.Equal(when) {
+			t.Errorf("got %#v, want %v", got, when)
+		}
+	})
+}
+
+func TestCodecsRoundTripTheRegisteredStructs(t *testing.T) {
+	events := []AuthEvent{
+		{Method: "pwd", Level: 1, Time: time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)},
+		{Method: "otp", Level: 2, Time: time.Date(2020, 5, 17, 10, 31, 0, 0, time.UTC)},
+	}
+	impersonation := Impersonation{
+		Actor:             "staff",
+		Target:            "customer",
+		OriginalSessionID: "sid",
+		Options:           ImpersonationOptions{AllowedKeys: []string{"cart"}, Permissions: []string{"read"}},
+	}
+	cart := registeredCart{Items: []string{"book"}, Total: 12}
+
+	forEachCodec(t, func(t *testing.T, id byte) {
+		got, ok := roundTrip(t, events, id).([]AuthEvent)
+		if !ok || len(got) != 2 {
+			t.Fatalf("got %#v", got)
+		}
+		for i := range events {
+			if got[i].Method != events[i].Method || got[i].Level != events[i].Level || !got[i].Time.Equal(events[i].Time) {
+				t.Errorf("event %d: got %+v, want %+v", i, got[i], events[i])
+			}
+		}
+		if got := roundTrip(t, impersonation, id); !reflect.DeepEqual(got, impersonation) {
+			t.Errorf("got %#v, want %#v", got, impersonation)
+		}
+		if got := roundTrip(t, cart, id); !reflect.DeepEqual(got, cart) {
+			t.Errorf("got %#v, want %#v", got, cart)
+		}
+	})
+}
+
+func TestCodecsEncodeUnregisteredTypesAsJSON(t *testing.T) {
+	forEachCodec(t, func(t *testing.T, id byte) {
+		got := roundTrip(t, unregisteredCart{Items: []string{"book"}}, JSONCodecID)
+		want := map[string]interface{}{"Items": []interface{}{"book"}}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %#v, want %#v", got, want)
+		}
+	})
+}
+
+func TestDecodeAnUnknownTypeName(t *testing.T) {
+	encoded, err := encodeStoredValue(registeredCart{Items: []string{"book"}, Total: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same envelope, naming a type which is not registered (any more).
+	renamed := append([]byte{envelopeMagic, envelopeVersion, JSONCodecID}, appendUvarint(nil, uint64(len("gone.Cart")))...)
+	renamed = append(renamed, "gone.Cart"...)
+	renamed = append(renamed, encoded[3+1+len("jwt_sessions_test.cart"):]...)
+
+	want := map[string]interface{}{"Items": []interface{}{"book"}, "Total": 12.0}
+	if got := decodeStoredValue(renamed); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestDecodeBadEnvelopes(t *testing.T) {
+	encoded, err := encodeStoredValue("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(i int, b byte) []byte {
+		copied := append([]byte(nil), encoded...)
+		copied[i] = b
+		return copied
+	}
+
+	cases := []struct {
+		name    string
+		encoded []byte
+		want    interface{}
+	}{
+		{"an unknown codec", corrupt(2, 200), nil},
+		{"a bad magic byte", corrupt(0, 'x'), nil},
+		{"an unknown version", corrupt(1, envelopeVersion+1), nil},
+		{"a name longer than the envelope", corrupt(3, 100), nil},
+		{"a truncated envelope", encoded[:2], nil},
+		{"a corrupt payload", append(encoded[:len(encoded)-2:len(encoded)-2], "}}"...), nil},
+		// values stored before the envelopes, by the iris' transcoder.
+		{"a value without an envelope", []byte(`"legacy"`), "legacy"},
+	}
+	for _, c := range cases {
+		if got := decodeStoredValue(c.encoded); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %#v, want %#v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestEncodeWithAnUnknownDefaultCodec(t *testing.T) {
+	defer func(previous byte) { DefaultCodecID = previous }(DefaultCodecID)
+	DefaultCodecID = 200
+	if _, err := encodeStoredValue(7); err == nil || !errUnknownCodec.Equal(err) {
+		t.Fatalf("got %v, want errUnknownCodec", err)
+	}
+	// unregistered types do not use it.
+	if _, err := encodeStoredValue(unregisteredCart{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBinaryCodecErrors(t *testing.T) {
+	var codec binaryCodec
+	if _, err := codec.Marshal(make(chan int)); err == nil {
+		t.Error("a channel was encoded")
+	}
+
+	encoded, err := codec.Marshal([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if err := codec.Unmarshal(encoded[:len(encoded)-1], &got); err == nil {
+		t.Error("truncated data was decoded")
+	}
+	if err := codec.Unmarshal(append(encoded, 0), &got); err == nil {
+		t.Error("trailing data was decoded")
+	}
+	var number int
+	if err := codec.Unmarshal(encoded, &number); err == nil {
+		t.Error("an array was decoded into an int")
+	}
+	if err := codec.Unmarshal(encoded, got); err == nil {
+		t.Error("a value was decoded into a non-pointer")
+	}
+}
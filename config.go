@@ -3,6 +3,7 @@ package jwt_sessions
 import (
 	"time"
 	"github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris/sessions"
 )
 
 
@@ -20,6 +21,46 @@ type (
 		// if any. Client token will not expire.
 		Expires time.Duration
 
+		// Lazy sessions are not stored (and no token is issued for them) until
+		// something is written into them (a value or a flash message). This
+		// avoids creating storage and timers for clients that never need a
+		// session, like crawlers or health checks.
+		Lazy bool
+
+		// The session key holding the user's identifier (the subject).
+		// Default value: "user_id".
+		SubjectKey string
+
+		// How long an authentication event counts for the assurance level of
+		// the session (see `Authenticate`). Zero means they never decay.
+		AssuranceDecay time.Duration
+
+		// How roles and permissions are resolved for a session.
+		Authorization Authorization
+
+		// The maximum number of sessions, and the approximate size of their
+		// values in bytes, kept in memory. Zero means no limit. Over them, the
+		// least recently used sessions are evicted (see `OnEvict`).
+		MaxSessions int
+		MaxBytes    int64
+
+		// Spill, if set, receives the values of the evicted sessions, which
+		// are moved back when the sessions are read again.
+		Spill sessions.Database
+
+		// Whether the destroy (and expire) events carry a read-only copy of
+		// the session's values (see Snapshot), taken before they are released.
+		// It costs a read of all the values on each destroy, but only when
+		// there are listeners for those events.
+		DestroySnapshot bool
+
+		// The number of shards the in-memory sessions (and the values of the
+		// default MemDB) are split in, each with its own lock.
+		// The least recently used sessions are evicted shard by shard, so
+		// with more than one shard the eviction order is approximate.
+		// Default value: DefaultShards.
+		Shards int
+
 		// SessionIDGenerator should returns a random session id.
 		// By default we will use a uuid impl package to generate
 		// that, but developers can change that with simple assignment.
@@ -31,6 +72,13 @@ type (
 // Validate corrects missing fields configuration fields and returns the right configuration.
 func (c Config) Validate() Config {
 	c.Parser = c.Parser.Validate()
+	c.Authorization = c.Authorization.Validate()
+	if c.SubjectKey == "" {
+		c.SubjectKey = "user_id"
+	}
+	if c.Shards <= 0 {
+		c.Shards = DefaultShards
+	}
 	if c.SessionIDGenerator == nil {
 		c.SessionIDGenerator = func() string {
 			id, _ := uuid.NewV4()
@@ -0,0 +1,308 @@
+package jwt_sessions
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"hash/fnv"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/core/errors"
+	"github.com/kataras/iris/sessions"
+)
+
+
+// EncryptedDB is a session database decorator which encrypts the values with
+// AES-GCM before delegating them to an inner database, so they never sit in
+// plaintext in the storage. Each value is stored as:
+//
+//     [key id length][key id][nonce][ciphertext]
+//
+// and it is bound to its session and key, so a ciphertext cannot be moved to
+// another session or key. Keys are rotated by adding a new current key: values
+// encrypted with an older key are still readable, and they are re-encrypted
+// with the current key when they are read. A re-encryption is a compare-and-swap:
+// it is only written if the stored value is still the one read, so it never
+// overwrites a concurrent write (through the same EncryptedDB).
+
+
+var (
+	errEncryptionKeyID      = errors.New("invalid encryption key id: %q")
+	errUnknownEncryptionKey = errors.New("unknown encryption key: %q")
+	errCiphertext           = errors.New("malformed encrypted value")
+	errNoEncryptionKeys     = errors.New("no encryption keys")
+)
+
+
+type (
+	// EncryptionKey is an AES key (16, 24 or 32 bytes long) and its ID,
+	// which is stored alongside the values it encrypts.
+	EncryptionKey struct {
+		ID  string
+		Key []byte
+	}
+
+	// EncryptedDB is the encrypting decorator. See NewEncryptedDB.
+	EncryptedDB struct {
+		inner   sessions.Database
+		mu      sync.RWMutex
+		keys    map[string]cipher.AEAD
+		current string
+		err     error
+		// the writes of a session (by its shard) are serialized, so
+		// a re-encryption can tell whether the value changed meanwhile.
+		writes []sync.Mutex
+	}
+)
+
+var _ sessions.Database = (*EncryptedDB)(nil)
+
+// encryptedDBWriteLocks is the number of locks the writes are spread over,
+// by session ID.
+const encryptedDBWriteLocks = 32
+
+
+// NewEncryptedDB returns a database encrypting the values stored in the inner
+// database. The last given key is the current one, which encrypts new values.
+func NewEncryptedDB(inner sessions.Database, keys ...EncryptionKey) (*EncryptedDB, error) {
+	if len(keys) == 0 {
+		return nil, errNoEncryptionKeys
+	}
+
+	db := &EncryptedDB{
+		inner:  inner,
+		keys:   make(map[string]cipher.AEAD, len(keys)),
+		writes: make([]sync.Mutex, encryptedDBWriteLocks),
+	}
+	for _, key := range keys {
+		if err := db.Rotate(key); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// Rotate adds a key and makes it the current one. Existing values keep
+// being readable with their keys, until they are re-encrypted.
+func (db *EncryptedDB) Rotate(key EncryptionKey) error {
+	if key.ID == "" || len(key.ID) > 255 {
+		return errEncryptionKeyID.Format(key.ID)
+	}
+	block, err := aes.NewCipher(key.Key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	db.keys[key.ID] = aead
+	db.current = key.ID
+	db.mu.Unlock()
+	return nil
+}
+
+// RemoveKey forgets an old key. The values still encrypted with it
+// are read as nil. The current key cannot be removed.
+func (db *EncryptedDB) RemoveKey(id string) {
+	db.mu.Lock()
+	if id != db.current {
+		delete(db.keys, id)
+	}
+	db.mu.Unlock()
+}
+
+// Err returns the last encryption or decryption error, if any.
+func (db *EncryptedDB) Err() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.err
+}
+
+func (db *EncryptedDB) fail(err error) {
+	if err != nil {
+		db.mu.Lock()
+		db.err = err
+		db.mu.Unlock()
+	}
+}
+
+// additionalData binds a ciphertext to its session and key.
+func additionalData(sid string, key string) []byte {
+	return []byte(sid + "\x00" + key)
+}
+
+func (db *EncryptedDB) encrypt(sid string, key string, value interface{}) ([]byte, error) {
+	plaintext, err := encodeStoredValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	id, aead := db.current, db.keys[db.current]
+	db.mu.RUnlock()
+
+	sealed := make([]byte, 0, 1+len(id)+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	sealed = append(append(sealed, byte(len(id))), id...)
+	nonce := sealed[len(sealed) : len(sealed)+aead.NonceSize()]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed = sealed[:len(sealed)+len(nonce)]
+	return aead.Seal(sealed, nonce, plaintext, additionalData(sid, key)), nil
+}
+
+// decrypt returns the value, and whether it was encrypted with an old key.
+func (db *EncryptedDB) decrypt(sid string, key string, sealed []byte) (interface{}, bool, error) {
+	if len(sealed) == 0 || len(sealed) < 1+int(sealed[0]) {
+		return nil, false, errCiphertext
+	}
+	idEnd := 1 + int(sealed[0])
+	id, sealed := string(sealed[1:idEnd]), sealed[idEnd:]
+
+	db.mu.RLock()
+	aead, ok := db.keys[id]
+	stale := id != db.current
+	db.mu.RUnlock()
+	if !ok {
+		return nil, false, errUnknownEncryptionKey.Format(id)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, false, errCiphertext
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData(sid, key))
+	if err != nil {
+		return nil, false, err
+	}
+	return decodeStoredValue(plaintext), stale, nil
+}
+
+// open decrypts a stored value, telling whether it was encrypted with an old key.
+func (db *EncryptedDB) open(sid string, key string, stored interface{}) (interface{}, bool) {
+	if stored == nil {
+		return nil, false
+	}
+	sealed, ok := stored.([]byte)
+	if !ok {
+		db.fail(errCiphertext)
+		return nil, false
+	}
+
+	value, stale, err := db.decrypt(sid, key, sealed)
+	if err != nil {
+		db.fail(err)
+		return nil, false
+	}
+	return value, stale
+}
+
+// lockWrites serializes the writes of a session, returning the unlocking function.
+func (db *EncryptedDB) lockWrites(sid string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(sid))
+	mu := &db.writes[hash.Sum32()%uint32(len(db.writes))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// reencrypt encrypts a value read with an old key with the current one, and
+// stores it if the stored value is still the one read. The zero lifetime
+// leaves the stored expiration time as it is.
+func (db *EncryptedDB) reencrypt(sid string, key string, read []byte, value interface{}) {
+	sealed, err := db.encrypt(sid, key, value)
+	if err != nil {
+		db.fail(err)
+		return
+	}
+
+	defer db.lockWrites(sid)()
+	if stored, ok := db.inner.Get(sid, key).([]byte); ok && bytes.Equal(stored, read) {
+		db.inner.Set(sid, sessions.LifeTime{}, key, sealed, false)
+	}
+}
+
+// Acquire delegates to the inner database.
+func (db *EncryptedDB) Acquire(sid string, expires time.Duration) sessions.LifeTime {
+	return db.inner.Acquire(sid, expires)
+}
+
+// OnUpdateExpiration delegates to the inner database.
+func (db *EncryptedDB) OnUpdateExpiration(sid string, newExpires time.Duration) error {
+	return db.inner.OnUpdateExpiration(sid, newExpires)
+}
+
+// Set encrypts a value with the current key, and stores it.
+func (db *EncryptedDB) Set(sid string, lifetime sessions.LifeTime, key string, value interface{}, immutable bool) {
+	sealed, err := db.encrypt(sid, key, value)
+	if err != nil {
+		db.fail(err)
+		return
+	}
+
+	defer db.lockWrites(sid)()
+	db.inner.Set(sid, lifetime, key, sealed, immutable)
+}
+
+// Get retrieves and decrypts a value, or returns nil if it is
+// not found or it cannot be decrypted.
+func (db *EncryptedDB) Get(sid string, key string) interface{} {
+	stored := db.inner.Get(sid, key)
+	value, stale := db.open(sid, key, stored)
+	if stale {
+		db.reencrypt(sid, key, stored.([]byte), value)
+	}
+	return value
+}
+
+// Visit loops through all the session's keys and decrypted values.
+func (db *EncryptedDB) Visit(sid string, cb func(key string, value interface{})) {
+	type staleValue struct {
+		read  []byte
+		value interface{}
+	}
+	var stale map[string]staleValue
+	db.inner.Visit(sid, func(key string, stored interface{}) {
+		value, isStale := db.open(sid, key, stored)
+		if isStale {
+			if stale == nil {
+				stale = make(map[string]staleValue)
+			}
+			stale[key] = staleValue{read: stored.([]byte), value: value}
+		}
+		cb(key, value)
+	})
+
+	// the inner database may be locked while visiting.
+	for key, v := range stale {
+		db.reencrypt(sid, key, v.read, v.value)
+	}
+}
+
+// Len delegates to the inner database.
+func (db *EncryptedDB) Len(sid string) int {
+	return db.inner.Len(sid)
+}
+
+// Delete delegates to the inner database.
+func (db *EncryptedDB) Delete(sid string, key string) bool {
+	defer db.lockWrites(sid)()
+	return db.inner.Delete(sid, key)
+}
+
+// Clear delegates to the inner database.
+func (db *EncryptedDB) Clear(sid string) {
+	defer db.lockWrites(sid)()
+	db.inner.Clear(sid)
+}
+
+// Release delegates to the inner database.
+func (db *EncryptedDB) Release(sid string) {
+	defer db.lockWrites(sid)()
+	db.inner.Release(sid)
+}
@@ -0,0 +1,149 @@
+package jwt_sessions
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/sessions"
+)
+
+
+// afterGetDB runs a function once, right after the first read of its
+// inner database, e.g. to interleave a write with a read.
+type afterGetDB struct {
+	sessions.Database
+	afterGet func()
+}
+
+func (db *afterGetDB) Get(sid string, key string) interface{} {
+	value := db.Database.Get(sid, key)
+	if afterGet := db.afterGet; afterGet != nil {
+		db.afterGet = nil
+		afterGet()
+	}
+	return value
+}
+
+func testEncryptionKey(id string) EncryptionKey {
+	return EncryptionKey{ID: id, Key: bytes.Repeat([]byte(id[:1]), 32)}
+}
+
+func newTestEncryptedDB(t *testing.T, inner sessions.Database, ids ...string) *EncryptedDB {
+	keys := make([]EncryptionKey, len(ids))
+	for i, id := range ids {
+		keys[i] = testEncryptionKey(id)
+	}
+	db, err := NewEncryptedDB(inner, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// storedKeyID returns the ID of the key a stored value was encrypted with.
+func storedKeyID(t *testing.T, inner sessions.Database, sid string, key string) string {
+	sealed, ok := inner.Get(sid, key).([]byte)
+	if !ok || len(sealed) == 0 {
+		t.Fatalf("%s is not stored encrypted", key)
+	}
+	return string(sealed[1 : 1+int(sealed[0])])
+}
+
+
+func TestEncryptedDBStoresCiphertexts(t *testing.T) {
+	inner := NewMemDB()
+	db := newTestEncryptedDB(t, inner, "a")
+	lifetime := db.Acquire("s", time.Hour)
+	db.Set("s", lifetime, "email", "alice@example.com", false)
+
+	if bytes.Contains(inner.Get("s", "email").([]byte), []byte("alice")) {
+		t.Fatal("the value is stored in plaintext")
+	}
+	if got := db.Get("s", "email"); got != "alice@example.com" {
+		t.Fatalf("got %#v", got)
+	}
+	visited := make(map[string]interface{})
+	db.Visit("s", func(key string, value interface{}) { visited[key] = value })
+	if visited["email"] != "alice@example.com" {
+		t.Fatalf("visited %v", visited)
+	}
+}
+
+func TestEncryptedDBReencryptsWithTheCurrentKey(t *testing.T) {
+	inner := NewMemDB()
+	db := newTestEncryptedDB(t, inner, "a")
+	lifetime := db.Acquire("s", time.Hour)
+	db.Set("s", lifetime, "email", "alice@example.com", false)
+	db.Set("s", lifetime, "name", "alice", false)
+
+	if err := db.Rotate(testEncryptionKey("b")); err != nil {
+		t.Fatal(err)
+	}
+	if storedKeyID(t, inner, "s", "email") != "a" {
+		t.Fatal("the value was re-encrypted before being read")
+	}
+	if got := db.Get("s", "email"); got != "alice@example.com" {
+		t.Fatalf("got %#v with the old key", got)
+	}
+	db.Visit("s", func(string, interface{}) {})
+	if storedKeyID(t, inner, "s", "email") != "b" || storedKeyID(t, inner, "s", "name") != "b" {
+		t.Fatal("the values read were not re-encrypted with the current key")
+	}
+
+	db.RemoveKey("a")
+	if got := db.Get("s", "name"); got != "alice" {
+		t.Fatalf("got %#v after removing the old key", got)
+	}
+	if err := db.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedDBReencryptionKeepsAConcurrentWrite(t *testing.T) {
+	inner := &afterGetDB{Database: NewMemDB()}
+	db := newTestEncryptedDB(t, inner, "a")
+	lifetime := db.Acquire("s", time.Hour)
+	db.Set("s", lifetime, "name", "alice", false)
+	db.Rotate(testEncryptionKey("b"))
+
+	// written between the read of the old value and its re-encryption.
+	inner.afterGet = func() { db.Set("s", lifetime, "name", "bob", false) }
+	if got := db.Get("s", "name"); got != "alice" {
+		t.Fatalf("got %#v, want the value read", got)
+	}
+	if got := db.Get("s", "name"); got != "bob" {
+		t.Fatalf("got %#v: the re-encryption overwrote the concurrent write", got)
+	}
+}
+
+func TestEncryptedDBRejectsTamperedValues(t *testing.T) {
+	inner := NewMemDB()
+	db := newTestEncryptedDB(t, inner, "a")
+	lifetime := db.Acquire("s", time.Hour)
+	db.Set("s", lifetime, "role", "user", false)
+	db.Set("s", lifetime, "name", "alice", false)
+
+	// a value moved to another key.
+	inner.Set("s", lifetime, "admin", inner.Get("s", "role"), false)
+	if got := db.Get("s", "admin"); got != nil {
+		t.Fatalf("got %#v from a value moved to another key", got)
+	}
+
+	// a flipped bit.
+	sealed := append([]byte(nil), inner.Get("s", "name").([]byte)...)
+	sealed[len(sealed)-1] ^= 1
+	inner.Set("s", lifetime, "name", sealed, false)
+	if got := db.Get("s", "name"); got != nil {
+		t.Fatalf("got %#v from a tampered value", got)
+	}
+
+	// an unknown key.
+	other := newTestEncryptedDB(t, inner, "c")
+	if got := other.Get("s", "role"); got != nil || other.Err() == nil {
+		t.Fatalf("got %#v with an unknown key", got)
+	}
+	if db.Err() == nil {
+		t.Fatal("the tampered values were not reported")
+	}
+}
@@ -0,0 +1,279 @@
+package jwt_sessions
+
+import (
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/kataras/iris/context"
+	"github.com/kataras/iris/sessions"
+)
+
+
+// Besides the destroy and regenerate listeners (kept as they were), every
+// step of a session's lifecycle fires a structured Event to the listeners
+// registered for its kind (see `On`): creation, start, writes, expiration,
+// destruction (with a reason), regeneration, and the tokens issued and
+// rejected. The listeners are fired synchronously: use a goroutine inside
+// a listener which blocks.
+
+
+// EventKind tells which step of the lifecycle an event is about.
+type EventKind uint8
+
+const (
+	// EventCreate is fired when a session is created (for lazy sessions,
+	// when something is written into them).
+	EventCreate EventKind = iota
+	// EventStart is fired when a session is started for a request.
+	EventStart
+	// EventSet is fired when a value has been set.
+	EventSet
+	// EventDelete is fired when a value has been deleted.
+	EventDelete
+	// EventExpire is fired when a session expired, before its EventDestroy.
+	EventExpire
+	// EventDestroy is fired when a session has been destroyed.
+	EventDestroy
+	// EventRegenerate is fired when a session has been moved to a new ID.
+	EventRegenerate
+	// EventTokenIssued is fired when a new token is issued for a request.
+	EventTokenIssued
+	// EventTokenRejected is fired when the token of a request is not valid.
+	EventTokenRejected
+	// EventAuthenticate is fired when the user of a session authenticates
+	// (see `Authenticate`).
+	EventAuthenticate
+
+	eventKinds
+)
+
+func (kind EventKind) String() string {
+	switch kind {
+	case EventCreate:
+		return "create"
+	case EventStart:
+		return "start"
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	case EventDestroy:
+		return "destroy"
+	case EventRegenerate:
+		return "regenerate"
+	case EventTokenIssued:
+		return "token_issued"
+	case EventTokenRejected:
+		return "token_rejected"
+	case EventAuthenticate:
+		return "authenticate"
+	default:
+		return "unknown"
+	}
+}
+
+
+// DestroyReason tells why a session was destroyed.
+type DestroyReason uint8
+
+const (
+	// DestroyLogout tells the session was destroyed by its own request
+	// (see `JWTSessions.Destroy` and `JWTSession.Destroy`).
+	DestroyLogout DestroyReason = iota + 1
+	// DestroyExpired tells the session's expiration time came.
+	DestroyExpired
+	// DestroyEvicted tells the session was evicted from memory, with
+	// the default MemDB (see Config.MaxSessions and Config.MaxBytes).
+	DestroyEvicted
+	// DestroyRevoked tells the session was destroyed by its ID
+	// (see `JWTSessions.DestroyByID`).
+	DestroyRevoked
+	// DestroyAdmin tells all the sessions were destroyed at once
+	// (see `JWTSessions.DestroyAll`).
+	DestroyAdmin
+	// DestroyRegenerated tells the session was moved to a new ID.
+	DestroyRegenerated
+	// DestroyMerged tells the session was merged into another one.
+	DestroyMerged
+)
+
+func (reason DestroyReason) String() string {
+	switch reason {
+	case DestroyLogout:
+		return "logout"
+	case DestroyExpired:
+		return "expired"
+	case DestroyEvicted:
+		return "evicted"
+	case DestroyRevoked:
+		return "revoked"
+	case DestroyAdmin:
+		return "admin"
+	case DestroyRegenerated:
+		return "regenerated"
+	case DestroyMerged:
+		return "merged"
+	default:
+		return "unknown"
+	}
+}
+
+
+type (
+	// Event describes a step of a session's lifecycle. Only the fields
+	// making sense for its kind are set.
+	Event struct {
+		Kind      EventKind
+		SessionID string
+		// When did it happen.
+		Time time.Time
+		// The verified claims of the last token of the session (for token
+		// events, the claims of the token issued), if known.
+		Claims jwt.MapClaims
+		// The request being handled, for the events fired by it (start,
+		// authenticate, token and most create events). Nil otherwise.
+		Context context.Context
+
+		// The key, and the value, set or deleted. For authenticate
+		// events, the value is the AuthEvent.
+		Key   string
+		Value interface{}
+		// The new ID of a regenerated session.
+		NewSessionID string
+		// Why the session was destroyed.
+		Reason DestroyReason
+		// A read-only copy of the values of an expired or destroyed
+		// session, taken before they were released. Only taken when
+		// Config.DestroySnapshot is set, nil otherwise.
+		Snapshot *Snapshot
+		// Why the token of the request was rejected.
+		Err error
+	}
+
+	// EventListener is fired for the events of the kind it was registered for.
+	EventListener func(event Event)
+)
+
+
+// On registers one or more listeners for the events of a kind.
+// This is also the way to receive the structured destroy (with its
+// reason) and regenerate events.
+// Like the other listeners, they must be registered before serving:
+// registering them is not safe while events are fired.
+func (sessions *JWTSessions) On(kind EventKind, listeners ...EventListener) {
+	for _, ln := range listeners {
+		sessions.provider.registerEventListener(kind, ln)
+	}
+}
+
+// OnCreate registers one or more listeners fired when a session is created.
+func (sessions *JWTSessions) OnCreate(listeners ...EventListener) {
+	sessions.On(EventCreate, listeners...)
+}
+
+// OnStart registers one or more listeners fired when a session is started
+// for a request (once per request).
+func (sessions *JWTSessions) OnStart(listeners ...EventListener) {
+	sessions.On(EventStart, listeners...)
+}
+
+// OnSet registers one or more listeners fired when a value is set.
+func (sessions *JWTSessions) OnSet(listeners ...EventListener) {
+	sessions.On(EventSet, listeners...)
+}
+
+// OnDelete registers one or more listeners fired when a value is deleted.
+func (sessions *JWTSessions) OnDelete(listeners ...EventListener) {
+	sessions.On(EventDelete, listeners...)
+}
+
+// OnExpire registers one or more listeners fired when a session expires
+// (with a copy of its values, see Config.DestroySnapshot).
+func (sessions *JWTSessions) OnExpire(listeners ...EventListener) {
+	sessions.On(EventExpire, listeners...)
+}
+
+// OnTokenIssued registers one or more listeners fired when a new token
+// is issued for a request.
+func (sessions *JWTSessions) OnTokenIssued(listeners ...EventListener) {
+	sessions.On(EventTokenIssued, listeners...)
+}
+
+// OnAuthenticate registers one or more listeners fired when the user of
+// a session authenticates.
+func (sessions *JWTSessions) OnAuthenticate(listeners ...EventListener) {
+	sessions.On(EventAuthenticate, listeners...)
+}
+
+// OnTokenRejected registers one or more listeners fired when the token
+// of a request is malformed, or does not verify.
+func (sessions *JWTSessions) OnTokenRejected(listeners ...EventListener) {
+	sessions.On(EventTokenRejected, listeners...)
+}
+
+
+// registerEventListener is not guarded: the listeners are read, unlocked,
+// by every event fired, so they are all registered before serving.
+func (p *provider) registerEventListener(kind EventKind, ln EventListener) {
+	if ln == nil || kind >= eventKinds {
+		return
+	}
+	p.eventListeners[kind] = append(p.eventListeners[kind], ln)
+}
+
+// listening tells whether there are listeners for the events of a kind.
+func (p *provider) listening(kind EventKind) bool {
+	return len(p.eventListeners[kind]) > 0
+}
+
+func (p *provider) fireEvent(event Event) {
+	listeners := p.eventListeners[event.Kind]
+	if len(listeners) == 0 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, ln := range listeners {
+		ln(event)
+	}
+}
+
+// fireSessionEvent fires an event about a session, with its claims.
+func (p *provider) fireSessionEvent(sess *JWTSession, event Event) {
+	if !p.listening(event.Kind) {
+		return
+	}
+	event.SessionID = sess.sid
+	sess.mu.RLock()
+	event.Claims = sess.claims
+	sess.mu.RUnlock()
+	p.fireEvent(event)
+}
+
+// snapshot copies the values of a session from a database, if enabled
+// and there is anyone to receive them: the listeners of its destroy (or
+// expire) events.
+func (p *provider) snapshot(db sessions.Database, sid string, expires time.Time, reason DestroyReason) *Snapshot {
+	if !p.config.DestroySnapshot {
+		return nil
+	}
+	if !p.listening(EventDestroy) && !(reason == DestroyExpired && p.listening(EventExpire)) {
+		return nil
+	}
+	return newSnapshot(db, sid, expires)
+}
+
+// fireDestroyEvents fires the events of a destroyed session: an expire
+// event first, if it expired.
+func (p *provider) fireDestroyEvents(sid string, claims jwt.MapClaims, reason DestroyReason, snapshot *Snapshot) {
+	event := Event{SessionID: sid, Claims: claims, Reason: reason, Snapshot: snapshot}
+	if reason == DestroyExpired {
+		event.Kind = EventExpire
+		p.fireEvent(event)
+	}
+	event.Kind = EventDestroy
+	p.fireEvent(event)
+}
@@ -0,0 +1,197 @@
+package jwt_sessions
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+
+// eventRecorder records the events of every kind.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func recordEvents(sessions *JWTSessions) *eventRecorder {
+	recorder := new(eventRecorder)
+	for kind := EventKind(0); kind < eventKinds; kind++ {
+		sessions.On(kind, func(event Event) {
+			recorder.mu.Lock()
+			recorder.events = append(recorder.events, event)
+			recorder.mu.Unlock()
+		})
+	}
+	return recorder
+}
+
+// take returns the events recorded since it was last called.
+func (recorder *eventRecorder) take() []Event {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	events := recorder.events
+	recorder.events = nil
+	return events
+}
+
+// kindsOf returns the kinds of the events, in order.
+func kindsOf(events []Event) []string {
+	kinds := make([]string, len(events))
+	for i, event := range events {
+		kinds[i] = event.Kind.String()
+	}
+	return kinds
+}
+
+// destroyedBy returns the session IDs and reasons of the destroy events.
+func destroyedBy(events []Event) []string {
+	var destroyed []string
+	for _, event := range events {
+		if event.Kind == EventDestroy {
+			destroyed = append(destroyed, event.SessionID+" "+event.Reason.String())
+		}
+	}
+	return destroyed
+}
+
+
+func TestEventsOfTheLifecycle(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	recorder := recordEvents(sessions)
+	check := func(step string, want ...string) []Event {
+		t.Helper()
+		events := recorder.take()
+		if got := kindsOf(events); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got the events %v, want %v", step, got, want)
+		}
+		return events
+	}
+
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	events := check("start", "create", "token_issued", "start")
+	for _, event := range events {
+		if event.SessionID != sess.ID() || event.Context != ctx || event.Time.IsZero() {
+			t.Fatalf("%s: got %+v", event.Kind, event)
+		}
+	}
+	if events[1].Claims["session_id"] != sess.ID() {
+		t.Fatalf("token_issued: got the claims %v", events[1].Claims)
+	}
+
+	next := newTestContext(issuedToken(ctx))
+	sessions.Start(next)
+	if events := check("start with the token", "start"); events[0].Claims["session_id"] != sess.ID() {
+		t.Fatalf("start: got the claims %v", events[0].Claims)
+	}
+
+	sess.Set("cart", 2)
+	if events := check("set", "set"); events[0].Key != "cart" || events[0].Value != 2 {
+		t.Fatalf("set: got %+v", events[0])
+	}
+	sess.Delete("cart")
+	if events := check("delete", "delete"); events[0].Key != "cart" {
+		t.Fatalf("delete: got %+v", events[0])
+	}
+
+	regenerated, err := sessions.Regenerate(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the session is moved, not created.
+	events = check("regenerate", "destroy", "regenerate", "token_issued")
+	if events[0].SessionID != sess.ID() || events[0].Reason != DestroyRegenerated {
+		t.Fatalf("destroy: got %+v", events[0])
+	}
+	if events[1].SessionID != sess.ID() || events[1].NewSessionID != regenerated.ID() {
+		t.Fatalf("regenerate: got %+v", events[1])
+	}
+	if events[2].SessionID != regenerated.ID() {
+		t.Fatalf("token_issued: got %+v", events[2])
+	}
+
+	rejected := newTestContext("Bearer not.a.token")
+	sessions.Start(rejected)
+	events = check("a rejected token", "token_rejected", "create", "token_issued", "start")
+	if events[0].Err == nil || events[0].Context != rejected || events[0].SessionID != "" {
+		t.Fatalf("token_rejected: got %+v", events[0])
+	}
+}
+
+func TestDestroyEventsTellTheReason(t *testing.T) {
+	cases := []struct {
+		reason  DestroyReason
+		config  Config
+		destroy func(sessions *JWTSessions, sess *JWTSession, token string)
+	}{
+		{DestroyLogout, Config{}, func(sessions *JWTSessions, sess *JWTSession, token string) {
+			sessions.Destroy(newTestContext(token))
+		}},
+		{DestroyRevoked, Config{}, func(sessions *JWTSessions, sess *JWTSession, token string) {
+			sessions.DestroyByID(sess.ID())
+		}},
+		{DestroyAdmin, Config{}, func(sessions *JWTSessions, sess *JWTSession, token string) {
+			sessions.DestroyAll()
+		}},
+		{DestroyEvicted, Config{MaxSessions: 1}, func(sessions *JWTSessions, sess *JWTSession, token string) {
+			sessions.Start(newTestContext(""))
+		}},
+		{DestroyMerged, Config{}, func(sessions *JWTSessions, sess *JWTSession, token string) {
+			into := sessions.Start(newTestContext(""))
+			if err := sessions.Merge(newTestContext(""), sess, into, MergeStrategy{}); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.reason.String(), func(t *testing.T) {
+			c.config.Expires = time.Hour
+			sessions := newTestSessions(c.config)
+			ctx := newTestContext("")
+			sess := sessions.Start(ctx)
+			sess.Set("cart", 2)
+			recorder := recordEvents(sessions)
+
+			c.destroy(sessions, sess, issuedToken(ctx))
+			want := []string{sess.ID() + " " + c.reason.String()}
+			if got := destroyedBy(recorder.take()); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got the destroy events %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestExpiredSessionsFireExpireThenDestroy(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: 20 * time.Millisecond})
+	recorder := recordEvents(sessions)
+	destroyed := make(chan struct{})
+	sessions.On(EventDestroy, func(Event) { close(destroyed) })
+	sess := sessions.Start(newTestContext(""))
+	recorder.take()
+
+	waitFor(t, destroyed, time.Second, "the session did not expire")
+	events := recorder.take()
+	if got := kindsOf(events); !reflect.DeepEqual(got, []string{"expire", "destroy"}) {
+		t.Fatalf("got the events %v", got)
+	}
+	for _, event := range events {
+		if event.SessionID != sess.ID() || event.Reason != DestroyExpired {
+			t.Fatalf("%s: got %+v", event.Kind, event)
+		}
+	}
+}
+
+func TestEventKindsAndReasonsHaveNames(t *testing.T) {
+	for kind := EventKind(0); kind < eventKinds; kind++ {
+		if kind.String() == "unknown" {
+			t.Errorf("the event kind %d has no name", kind)
+		}
+	}
+	for reason := DestroyLogout; reason <= DestroyMerged; reason++ {
+		if reason.String() == "unknown" {
+			t.Errorf("the destroy reason %d has no name", reason)
+		}
+	}
+}
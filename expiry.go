@@ -0,0 +1,212 @@
+package jwt_sessions
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+
+// The expiry scheduler replaces the per-session timers of the iris' LifeTime
+// (one `time.AfterFunc` per session) with a single timer, armed for the
+// earliest expiration of a min-heap of sessions. Scheduling, shifting and
+// cancelling an expiration take O(log n), and all the sessions expiring at
+// once are handed together (in a batch) to the callback.
+
+
+type (
+	expiryEntry struct {
+		sid   string
+		at    time.Time
+		index int
+	}
+
+	// expiryHeap is a container/heap of entries, by expiration time.
+	expiryHeap []*expiryEntry
+
+	expiryScheduler struct {
+		mu       sync.Mutex
+		heap     expiryHeap
+		entries  map[string]*expiryEntry
+		timer    *time.Timer
+		next     time.Time
+		onExpire func(sids []string)
+	}
+)
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(*expiryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	entry.index = -1
+	return entry
+}
+
+
+// newExpiryScheduler returns a scheduler calling onExpire, from its own
+// goroutine, with the sessions whose expiration time has come.
+func newExpiryScheduler(onExpire func(sids []string)) *expiryScheduler {
+	return &expiryScheduler{
+		entries:  make(map[string]*expiryEntry),
+		onExpire: onExpire,
+	}
+}
+
+// Schedule sets (or moves) the expiration time of a session.
+func (s *expiryScheduler) Schedule(sid string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, found := s.entries[sid]; found {
+		entry.at = at
+		heap.Fix(&s.heap, entry.index)
+	} else {
+		entry = &expiryEntry{sid: sid, at: at}
+		s.entries[sid] = entry
+		heap.Push(&s.heap, entry)
+	}
+	s.rearm()
+}
+
+// Shift moves the expiration time of a session, telling whether
+// it was scheduled. Unscheduled sessions never expire.
+func (s *expiryScheduler) Shift(sid string, at time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, found := s.entries[sid]
+	if !found {
+		return false
+	}
+	entry.at = at
+	heap.Fix(&s.heap, entry.index)
+	s.rearm()
+	return true
+}
+
+// Cancel unschedules the expiration of a session.
+func (s *expiryScheduler) Cancel(sid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, found := s.entries[sid]; found {
+		heap.Remove(&s.heap, entry.index)
+		delete(s.entries, sid)
+		s.rearm()
+	}
+}
+
+// Len returns the number of scheduled sessions.
+func (s *expiryScheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.heap)
+}
+
+// rearm sets the timer for the earliest expiration. The lock must be held.
+func (s *expiryScheduler) rearm() {
+	if len(s.heap) == 0 {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		s.next = time.Time{}
+		return
+	}
+
+	earliest := s.heap[0].at
+	if earliest.Equal(s.next) {
+		return
+	}
+	s.next = earliest
+	if s.timer == nil {
+		s.timer = time.AfterFunc(time.Until(earliest), s.expire)
+	} else {
+		s.timer.Stop()
+		s.timer.Reset(time.Until(earliest))
+	}
+}
+
+// expire pops all the due sessions, and hands them to the callback.
+func (s *expiryScheduler) expire() {
+	s.mu.Lock()
+	now := time.Now()
+	var sids []string
+	for len(s.heap) > 0 && !s.heap[0].at.After(now) {
+		entry := heap.Pop(&s.heap).(*expiryEntry)
+		delete(s.entries, entry.sid)
+		sids = append(sids, entry.sid)
+	}
+	s.next = time.Time{}
+	s.rearm()
+	s.mu.Unlock()
+
+	if len(sids) > 0 {
+		s.onExpire(sids)
+	}
+}
+
+
+// expire destroys the sessions whose expiration time has come.
+func (p *provider) expire(sids []string) {
+	now := time.Now()
+	var expired []string
+
+	for _, sid := range sids {
+		var notify func()
+		sh := p.shard(sid)
+		sh.mu.Lock()
+		if sess, found := sh.sessions[sid]; found {
+			// the session may have been replaced since it was popped.
+			sess.mu.RLock()
+			due := !sess.Lifetime.After(now)
+			sess.mu.RUnlock()
+			if due {
+				notify = p.deleteSession(sess, DestroyExpired)
+				expired = append(expired, sid)
+			}
+		}
+		sh.mu.Unlock()
+		if notify != nil {
+			notify()
+		}
+	}
+
+	for _, sid := range expired {
+		p.publish(InvalidationEvent{Kind: InvalidateDestroy, SessionID: sid, Reason: DestroyExpired})
+	}
+}
+
+// shift moves the expiration of a session, if it expires at all.
+func (p *provider) shift(sess *JWTSession, expires time.Duration) {
+	at := time.Now().Add(expires)
+	sess.mu.Lock()
+	if p.expiry.Shift(sess.sid, at) {
+		sess.Lifetime.Time = at
+	}
+	sess.mu.Unlock()
+}
+
+// unschedule cancels the expiration of a session leaving memory, which
+// would destroy it again, and reduces its lifetime completely.
+func (p *provider) unschedule(sess *JWTSession) {
+	sess.mu.Lock()
+	sess.Lifetime.ExpireNow()
+	sess.mu.Unlock()
+	p.expiry.Cancel(sess.sid)
+}
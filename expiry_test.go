@@ -0,0 +1,220 @@
+package jwt_sessions
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/sessions"
+)
+
+
+// scheduledAt returns when a session is scheduled to expire, if it is.
+func scheduledAt(s *expiryScheduler, sid string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, found := s.entries[sid]
+	if !found {
+		return time.Time{}, false
+	}
+	return entry.at, true
+}
+
+// newBenchmarkScheduler returns a scheduler with n sessions, expiring
+// far enough not to fire during the benchmark.
+func newBenchmarkScheduler(n int) (*expiryScheduler, time.Time) {
+	s := newExpiryScheduler(func([]string) {})
+	base := time.Now().Add(time.Hour)
+	for i := 0; i < n; i++ {
+		s.Schedule(fmt.Sprintf("session-%d", i), base.Add(time.Duration(i)*time.Millisecond))
+	}
+	return s, base
+}
+
+// newBenchmarkLifetimes returns n lifetimes, each with its own timer (the
+// iris' way, which the scheduler replaces), expiring like the scheduler's.
+func newBenchmarkLifetimes(n int) []*sessions.LifeTime {
+	lifetimes := make([]*sessions.LifeTime, n)
+	for i := range lifetimes {
+		lifetimes[i] = new(sessions.LifeTime)
+		lifetimes[i].Begin(time.Hour+time.Duration(i)*time.Millisecond, func() {})
+	}
+	return lifetimes
+}
+
+func stopBenchmarkLifetimes(b *testing.B, lifetimes []*sessions.LifeTime) {
+	b.StopTimer()
+	for _, lifetime := range lifetimes {
+		lifetime.ExpireNow()
+	}
+}
+
+var benchmarkSchedulerSizes = []int{1000, 100000}
+
+
+func TestExpirySchedulerExpiresInOrder(t *testing.T) {
+	expired := make(chan []string, 10)
+	s := newExpiryScheduler(func(sids []string) { expired <- sids })
+	now := time.Now()
+	s.Schedule("c", now.Add(30*time.Millisecond))
+	s.Schedule("a", now.Add(10*time.Millisecond))
+	s.Schedule("b", now.Add(time.Hour))
+	s.Shift("b", now.Add(20*time.Millisecond))
+	s.Schedule("d", now.Add(40*time.Millisecond))
+	s.Cancel("d")
+
+	var order []string
+	for len(order) < 3 {
+		select {
+		case sids := <-expired:
+			order = append(order, sids...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out, expired %v", order)
+		}
+	}
+	if fmt.Sprint(order) != "[a b c]" {
+		t.Fatalf("expired %v, want [a b c]", order)
+	}
+	if s.Len() != 0 {
+		t.Fatalf("%d sessions are still scheduled", s.Len())
+	}
+}
+
+func TestUpdateExpirationReschedules(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	expired := make(chan struct{})
+	sessions.OnDestroy(func(string) { close(expired) })
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	sess.Set("user_id", 7)
+
+	before, _ := scheduledAt(sessions.provider.expiry, sess.ID())
+	if err := sessions.UpdateExpiration(ctx, 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	at, scheduled := scheduledAt(sessions.provider.expiry, sess.ID())
+	if !scheduled || at.Sub(before) < 59*time.Minute || !sess.Lifetime.Time.Equal(at) {
+		t.Fatalf("rescheduled from %v to %v, with the lifetime ending at %v", before, at, sess.Lifetime.Time)
+	}
+
+	if err := sessions.UpdateExpiration(ctx, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, expired, 5*time.Second, "the rescheduled expiration")
+	if _, found := sessions.provider.find(sess.ID()); found {
+		t.Fatal("the expired session is still in memory")
+	}
+}
+
+func TestDestroyCancelsTheExpiration(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: 20 * time.Millisecond})
+	expired := make(chan struct{}, 1)
+	sess := sessions.Start(newTestContext(""))
+	sess.Set("user_id", 7)
+	if _, scheduled := scheduledAt(sessions.provider.expiry, sess.ID()); !scheduled {
+		t.Fatal("the session was not scheduled")
+	}
+
+	sessions.DestroyByID(sess.ID())
+	sessions.OnDestroy(func(string) { expired <- struct{}{} })
+	if sessions.provider.expiry.Len() != 0 {
+		t.Fatal("the destroyed session is still scheduled")
+	}
+	select {
+	case <-expired:
+		t.Fatal("the destroyed session expired")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+
+func BenchmarkExpiryScheduleNew(b *testing.B) {
+	for _, n := range benchmarkSchedulerSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			s, base := newBenchmarkScheduler(n)
+			sids := make([]string, b.N)
+			for i := range sids {
+				sids[i] = fmt.Sprintf("new-%d", i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Schedule(sids[i], base.Add(time.Duration(i%n)*time.Millisecond))
+			}
+		})
+	}
+}
+
+func BenchmarkExpiryReschedule(b *testing.B) {
+	for _, n := range benchmarkSchedulerSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			s, base := newBenchmarkScheduler(n)
+			sids := make([]string, n)
+			for i := range sids {
+				sids[i] = fmt.Sprintf("session-%d", i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// moves each session past the last one, as a sliding expiration does.
+				s.Shift(sids[i%n], base.Add(time.Duration(n+i)*time.Millisecond))
+			}
+		})
+	}
+}
+
+func BenchmarkExpiryScheduleAndCancel(b *testing.B) {
+	for _, n := range benchmarkSchedulerSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			s, base := newBenchmarkScheduler(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Schedule("cancelled", base.Add(time.Duration(i%n)*time.Millisecond))
+				s.Cancel("cancelled")
+			}
+		})
+	}
+}
+
+// The baselines: the same operations with a timer per session.
+
+func BenchmarkTimersScheduleNew(b *testing.B) {
+	for _, n := range benchmarkSchedulerSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			lifetimes := newBenchmarkLifetimes(n)
+			added := make([]*sessions.LifeTime, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				added[i] = new(sessions.LifeTime)
+				added[i].Begin(time.Hour+time.Duration(i%n)*time.Millisecond, func() {})
+			}
+			stopBenchmarkLifetimes(b, append(lifetimes, added...))
+		})
+	}
+}
+
+func BenchmarkTimersReschedule(b *testing.B) {
+	for _, n := range benchmarkSchedulerSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			lifetimes := newBenchmarkLifetimes(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lifetimes[i%n].Shift(time.Hour + time.Duration(n+i)*time.Millisecond)
+			}
+			stopBenchmarkLifetimes(b, lifetimes)
+		})
+	}
+}
+
+func BenchmarkTimersScheduleAndCancel(b *testing.B) {
+	for _, n := range benchmarkSchedulerSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			lifetimes := newBenchmarkLifetimes(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var cancelled sessions.LifeTime
+				cancelled.Begin(time.Hour+time.Duration(i%n)*time.Millisecond, func() {})
+				cancelled.ExpireNow()
+			}
+			stopBenchmarkLifetimes(b, lifetimes)
+		})
+	}
+}
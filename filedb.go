@@ -0,0 +1,546 @@
+package jwt_sessions
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/core/errors"
+	"github.com/kataras/iris/sessions"
+)
+
+
+// FileDB is an embedded, single-file, session database. Every change is
+// appended to a log file as a checksummed record, and the whole log is
+// replayed when the database is opened, so values and expiration times
+// survive a restart. A torn record (e.g. after a crash while writing) is
+// detected by its checksum and discarded, together with anything after it.
+//
+// The log is periodically compacted: the live sessions are written to a new
+// file which atomically replaces the old one.
+//
+// A change is applied only once its record is written. A failed write is
+// truncated away, so the log stays replayable; if even that fails, the
+// database refuses any further change until it is compacted.
+
+
+// Record operations.
+const (
+	fileOpAcquire = "acquire"
+	fileOpExpire  = "expire"
+	fileOpSet     = "set"
+	fileOpDelete  = "delete"
+	fileOpClear   = "clear"
+	fileOpRelease = "release"
+)
+
+// DefaultFileDBCompactInterval is the default interval between compactions.
+var DefaultFileDBCompactInterval = 10 * time.Minute
+
+var (
+	errFileDBClosed = errors.New("file database is closed")
+	errFileDBFailed = errors.New("file database failed to write its log")
+)
+
+
+type (
+	// FileDBOptions configures a FileDB.
+	FileDBOptions struct {
+		// The mode to create the file (and its directories) with.
+		// Default value: 0600 (0700 for the directories).
+		FileMode os.FileMode
+		// Whether to fsync the file after each record. Safer, but slower.
+		SyncWrites bool
+		// The interval between compaction attempts. A compaction only happens
+		// when at least half of the log is garbage.
+		// Default value: DefaultFileDBCompactInterval.
+		CompactInterval time.Duration
+	}
+
+	// FileDB is the single-file session database. See NewFileDB.
+	FileDB struct {
+		path    string
+		options FileDBOptions
+		mu      sync.Mutex
+		file    fileLog
+		// the end of the last record written in full.
+		offset   int64
+		sessions map[string]*fileSession
+		// records written since the last compaction,
+		// used to tell when to compact.
+		records int
+		err     error
+		// whether a failed write could not be truncated away.
+		failed bool
+		closed chan struct{}
+	}
+
+	// fileLog is the open log file.
+	fileLog interface {
+		io.Writer
+		io.Seeker
+		Truncate(size int64) error
+		Sync() error
+		Close() error
+	}
+
+	fileSession struct {
+		expires time.Time
+		values  map[string][]byte
+	}
+
+	fileRecord struct {
+		Op      string `json:"op"`
+		SID     string `json:"sid"`
+		Key     string `json:"key,omitempty"`
+		Value   []byte `json:"value,omitempty"`
+		Expires int64  `json:"expires,omitempty"`
+	}
+)
+
+var _ sessions.Database = (*FileDB)(nil)
+
+
+// NewFileDB opens (or creates) the session database stored in the given path,
+// replaying its log. Expired sessions are discarded.
+func NewFileDB(path string, options FileDBOptions) (*FileDB, error) {
+	if options.FileMode == 0 {
+		options.FileMode = 0600
+	}
+	if options.CompactInterval <= 0 {
+		options.CompactInterval = DefaultFileDBCompactInterval
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	db := &FileDB{
+		path:     path,
+		options:  options,
+		sessions: make(map[string]*fileSession),
+		closed:   make(chan struct{}),
+	}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+
+	go db.compactLoop()
+	return db, nil
+}
+
+// load replays the log and leaves the file open for appending,
+// truncated right after the last valid record.
+func (db *FileDB) load() error {
+	file, err := os.OpenFile(db.path, os.O_RDWR|os.O_CREATE, db.options.FileMode)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	var valid int64
+	for {
+		record, size, err := readFileRecord(reader, info.Size()-valid)
+		if err != nil {
+			// io.EOF, or a torn/corrupt record: discard from here on.
+			break
+		}
+		db.apply(record)
+		db.records++
+		valid += size
+	}
+
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	now := time.Now()
+	for sid, sess := range db.sessions {
+		if !sess.expires.IsZero() && sess.expires.Before(now) {
+			delete(db.sessions, sid)
+		}
+	}
+
+	db.file = file
+	db.offset = valid
+	return nil
+}
+
+// Record framing: 4 bytes length, 4 bytes CRC32 (IEEE) of the payload, payload.
+// The length is not trusted before the CRC is checked: a record longer than
+// the rest of the file (remaining bytes, header included) is a torn one.
+func readFileRecord(reader io.Reader, remaining int64) (fileRecord, int64, error) {
+	var record fileRecord
+	var header [8]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return record, 0, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if int64(size) > remaining-int64(len(header)) {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return record, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+
+	err := json.Unmarshal(payload, &record)
+	return record, int64(len(header)) + int64(size), err
+}
+
+// writeFileRecord writes a record and returns its size.
+func writeFileRecord(writer io.Writer, record fileRecord) (int64, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+
+	frame := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[8:], payload)
+	_, err = writer.Write(frame)
+	return int64(len(frame)), err
+}
+
+// apply changes the in-memory state according to a record.
+func (db *FileDB) apply(record fileRecord) {
+	switch record.Op {
+	case fileOpAcquire:
+		db.sessions[record.SID] = &fileSession{expires: unixNanoTime(record.Expires), values: make(map[string][]byte)}
+	case fileOpExpire:
+		if sess, ok := db.sessions[record.SID]; ok {
+			sess.expires = unixNanoTime(record.Expires)
+		}
+	case fileOpSet:
+		if sess, ok := db.sessions[record.SID]; ok {
+			sess.values[record.Key] = record.Value
+		}
+	case fileOpDelete:
+		if sess, ok := db.sessions[record.SID]; ok {
+			delete(sess.values, record.Key)
+		}
+	case fileOpClear:
+		if sess, ok := db.sessions[record.SID]; ok {
+			sess.values = make(map[string][]byte)
+		}
+	case fileOpRelease:
+		delete(db.sessions, record.SID)
+	}
+}
+
+func unixNanoTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+func timeUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// commit appends a record to the log and, once it is written, applies it.
+// Must be called locked.
+func (db *FileDB) commit(record fileRecord) error {
+	if db.file == nil {
+		db.err = errFileDBClosed
+		return db.err
+	}
+	if db.failed {
+		return errFileDBFailed
+	}
+
+	size, err := writeFileRecord(db.file, record)
+	if err == nil && db.options.SyncWrites {
+		err = db.file.Sync()
+	}
+	if err != nil {
+		db.err = err
+		db.rollback()
+		return err
+	}
+
+	db.apply(record)
+	db.offset += size
+	db.records++
+	return nil
+}
+
+// rollback truncates the log back to the last record written in full.
+func (db *FileDB) rollback() {
+	if err := db.file.Truncate(db.offset); err != nil {
+		db.failed = true
+		return
+	}
+	if _, err := db.file.Seek(db.offset, io.SeekStart); err != nil {
+		db.failed = true
+	}
+}
+
+// Err returns the last error writing to the log, if any. Since the session
+// database methods cannot report errors, they are kept here.
+func (db *FileDB) Err() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.err
+}
+
+// Acquire receives a session's lifetime from the database. Stored sessions
+// keep their expiration time, so the session manager revives their timers.
+func (db *FileDB) Acquire(sid string, expires time.Duration) sessions.LifeTime {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if sess, ok := db.sessions[sid]; ok {
+		if sess.expires.IsZero() {
+			return sessions.LifeTime{}
+		}
+		if sess.expires.After(time.Now()) {
+			return sessions.LifeTime{Time: sess.expires}
+		}
+		// expired while nobody was looking: start over.
+	}
+
+	var expiresAt time.Time
+	if expires > 0 {
+		expiresAt = time.Now().Add(expires)
+	}
+	db.commit(fileRecord{Op: fileOpAcquire, SID: sid, Expires: timeUnixNano(expiresAt)})
+	return sessions.LifeTime{}
+}
+
+// OnUpdateExpiration stores the new expiration time of the session.
+func (db *FileDB) OnUpdateExpiration(sid string, newExpires time.Duration) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.sessions[sid]; !ok {
+		return ErrNotFound
+	}
+	return db.commit(fileRecord{Op: fileOpExpire, SID: sid, Expires: time.Now().Add(newExpires).UnixNano()})
+}
+
+// Set stores a value. The "immutable" flag is not supported.
+func (db *FileDB) Set(sid string, lifetime sessions.LifeTime, key string, value interface{}, immutable bool) {
+	encoded, err := encodeStoredValue(value)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err != nil {
+		db.err = err
+		return
+	}
+	if _, ok := db.sessions[sid]; ok {
+		db.commit(fileRecord{Op: fileOpSet, SID: sid, Key: key, Value: encoded})
+	}
+}
+
+// Get retrieves a value, or nil if it is not found.
+func (db *FileDB) Get(sid string, key string) interface{} {
+	db.mu.Lock()
+	var encoded []byte
+	if sess, ok := db.sessions[sid]; ok {
+		encoded = sess.values[key]
+	}
+	db.mu.Unlock()
+
+	return decodeStoredValue(encoded)
+}
+
+// Visit loops through all the session's keys and values.
+func (db *FileDB) Visit(sid string, cb func(key string, value interface{})) {
+	db.mu.Lock()
+	var values map[string][]byte
+	if sess, ok := db.sessions[sid]; ok {
+		values = make(map[string][]byte, len(sess.values))
+		for key, encoded := range sess.values {
+			values[key] = encoded
+		}
+	}
+	db.mu.Unlock()
+
+	for key, encoded := range values {
+		cb(key, decodeStoredValue(encoded))
+	}
+}
+
+// Len returns the number of the session's keys.
+func (db *FileDB) Len(sid string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if sess, ok := db.sessions[sid]; ok {
+		return len(sess.values)
+	}
+	return 0
+}
+
+// Delete removes a key of the session.
+func (db *FileDB) Delete(sid string, key string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	sess, ok := db.sessions[sid]
+	if !ok {
+		return false
+	}
+	if _, found := sess.values[key]; !found {
+		return false
+	}
+	return db.commit(fileRecord{Op: fileOpDelete, SID: sid, Key: key}) == nil
+}
+
+// Clear removes all the keys of the session.
+func (db *FileDB) Clear(sid string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.sessions[sid]; ok {
+		db.commit(fileRecord{Op: fileOpClear, SID: sid})
+	}
+}
+
+// Release removes the session.
+func (db *FileDB) Release(sid string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.sessions[sid]; ok {
+		db.commit(fileRecord{Op: fileOpRelease, SID: sid})
+	}
+}
+
+func (db *FileDB) compactLoop() {
+	ticker := time.NewTicker(db.options.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			db.mu.Lock()
+			if db.records > 2*db.liveRecords() {
+				db.compact()
+			}
+			db.mu.Unlock()
+		case <-db.closed:
+			return
+		}
+	}
+}
+
+// liveRecords is the number of records a compacted log would have.
+func (db *FileDB) liveRecords() int {
+	n := 0
+	for _, sess := range db.sessions {
+		n += 1 + len(sess.values)
+	}
+	return n
+}
+
+// Compact rewrites the log with only the live sessions.
+func (db *FileDB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.compact()
+}
+
+func (db *FileDB) compact() error {
+	if db.file == nil {
+		return errFileDBClosed
+	}
+
+	tmpPath := db.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, db.options.FileMode)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	writer := bufio.NewWriter(tmp)
+	records := 0
+	var offset, size int64
+	for sid, sess := range db.sessions {
+		if !sess.expires.IsZero() && sess.expires.Before(now) {
+			delete(db.sessions, sid)
+			continue
+		}
+		if size, err = writeFileRecord(writer, fileRecord{Op: fileOpAcquire, SID: sid, Expires: timeUnixNano(sess.expires)}); err != nil {
+			break
+		}
+		records++
+		offset += size
+		for key, encoded := range sess.values {
+			if size, err = writeFileRecord(writer, fileRecord{Op: fileOpSet, SID: sid, Key: key, Value: encoded}); err != nil {
+				break
+			}
+			records++
+			offset += size
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, db.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// the renamed file is the new log: keep appending there.
+	// It holds the whole state, so a failed log is recovered too.
+	db.file.Close()
+	db.file = tmp
+	db.offset = offset
+	db.records = records
+	db.failed = false
+	syncDir(filepath.Dir(db.path))
+	return nil
+}
+
+// syncDir makes a rename durable, where supported.
+func syncDir(path string) {
+	if dir, err := os.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
+
+// Close stops the compaction and closes the log file.
+func (db *FileDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.file == nil {
+		return nil
+	}
+
+	close(db.closed)
+	err := db.file.Close()
+	db.file = nil
+	return err
+}
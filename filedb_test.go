@@ -0,0 +1,242 @@
+package jwt_sessions
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/sessions"
+)
+
+
+// tempFileDBPath returns the path of a database in a new temporary directory,
+// and a function removing it.
+func tempFileDBPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "filedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "sessions.db"), func() { os.RemoveAll(dir) }
+}
+
+func openFileDB(t *testing.T, path string) *FileDB {
+	db, err := NewFileDB(path, FileDBOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// failingLog writes only half of each record to the log file, then fails,
+// like a full disk would. Optionally, truncating the file fails as well.
+type failingLog struct {
+	*os.File
+	failTruncate bool
+}
+
+func (log *failingLog) Write(p []byte) (int, error) {
+	n, _ := log.File.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (log *failingLog) Truncate(size int64) error {
+	if log.failTruncate {
+		return errors.New("read-only file system")
+	}
+	return log.File.Truncate(size)
+}
+
+
+func TestFileDBSurvivesAReopen(t *testing.T) {
+	path, cleanup := tempFileDBPath(t)
+	defer cleanup()
+
+	db := openFileDB(t, path)
+	db.Acquire("a", time.Hour)
+	db.Set("a", db.Acquire("a", time.Hour), "count", 2.0, false)
+	db.Set("a", db.Acquire("a", time.Hour), "name", "alice", false)
+	db.Set("a", db.Acquire("a", time.Hour), "gone", true, false)
+	db.Delete("a", "gone")
+	db.Acquire("b", time.Hour)
+	db.Release("b")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openFileDB(t, path)
+	defer db.Close()
+	// the values are encoded in JSON: numbers are float64.
+	if got := db.Get("a", "count"); got != 2.0 {
+		t.Fatalf("count: got %#v, want 2", got)
+	}
+	if got := db.Get("a", "name"); got != "alice" {
+		t.Fatalf("name: got %#v, want alice", got)
+	}
+	if db.Len("a") != 2 {
+		t.Fatalf("got %d values, want 2", db.Len("a"))
+	}
+	if db.Len("b") != 0 {
+		t.Fatal("the released session was revived")
+	}
+	lifetime := db.Acquire("a", time.Minute)
+	if remaining := time.Until(lifetime.Time); remaining < 50*time.Minute || remaining > time.Hour {
+		t.Fatalf("the lifetime was not kept: %v remaining", remaining)
+	}
+}
+
+func TestFileDBRevivesSessionsAfterARestart(t *testing.T) {
+	path, cleanup := tempFileDBPath(t)
+	defer cleanup()
+
+	db := openFileDB(t, path)
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	sessions.UseDatabase(db)
+	ctx := newTestContext("")
+	sessions.Start(ctx).Set("user_id", 7.0)
+	token := issuedToken(ctx)
+	db.Close()
+
+	db = openFileDB(t, path)
+	defer db.Close()
+	restarted := newTestSessions(Config{Expires: time.Hour})
+	restarted.UseDatabase(db)
+	sess := restarted.Start(newTestContext(token))
+	if got := sess.Get("user_id"); got != 7.0 {
+		t.Fatalf("user_id: got %#v, want 7", got)
+	}
+	if remaining := time.Until(sess.Lifetime.Time); remaining < 50*time.Minute {
+		t.Fatalf("the lifetime was not revived: %v remaining", remaining)
+	}
+}
+
+func TestFileDBDiscardsATornTail(t *testing.T) {
+	path, cleanup := tempFileDBPath(t)
+	defer cleanup()
+
+	db := openFileDB(t, path)
+	db.Set("a", db.Acquire("a", time.Hour), "count", 2.0, false)
+	db.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a header claiming a 4GB record, followed by a few bytes.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], 0xFFFFFFFF)
+	file.Write(append(header[:], "torn"...))
+	file.Close()
+
+	db = openFileDB(t, path)
+	defer db.Close()
+	if got := db.Get("a", "count"); got != 2.0 {
+		t.Fatalf("count: got %#v, want 2", got)
+	}
+	if truncated, _ := os.Stat(path); truncated.Size() != info.Size() {
+		t.Fatalf("got %d bytes, want the torn tail truncated to %d", truncated.Size(), info.Size())
+	}
+}
+
+func TestFileDBCompactKeepsTheLiveSessions(t *testing.T) {
+	path, cleanup := tempFileDBPath(t)
+	defer cleanup()
+
+	db := openFileDB(t, path)
+	for i := 0; i < 10; i++ {
+		db.Set("a", db.Acquire("a", time.Hour), "count", float64(i), false)
+	}
+	db.Set("b", db.Acquire("b", time.Hour), "count", 1.0, false)
+	db.Release("b")
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openFileDB(t, path)
+	defer db.Close()
+	if got := db.Get("a", "count"); got != 9.0 {
+		t.Fatalf("count: got %#v, want 9", got)
+	}
+	if db.liveRecords() != 2 || db.records != 2 {
+		t.Fatalf("got %d records, want 2", db.records)
+	}
+}
+
+func TestFileDBTruncatesAFailedWrite(t *testing.T) {
+	path, cleanup := tempFileDBPath(t)
+	defer cleanup()
+
+	db := openFileDB(t, path)
+	db.Set("a", db.Acquire("a", time.Hour), "count", 1.0, false)
+	file := db.file.(*os.File)
+	db.file = &failingLog{File: file}
+	db.Set("a", sessions.LifeTime{}, "count", 2.0, false)
+	if db.Err() == nil {
+		t.Fatal("the failed write was not reported")
+	}
+	if got := db.Get("a", "count"); got != 1.0 {
+		t.Fatalf("count: got %#v, want the failed write not applied", got)
+	}
+
+	// the disk has room again: the log goes on after the last good record.
+	db.file = file
+	db.Set("a", sessions.LifeTime{}, "name", "alice", false)
+	db.Close()
+
+	db = openFileDB(t, path)
+	defer db.Close()
+	if got := db.Get("a", "count"); got != 1.0 {
+		t.Fatalf("count: got %#v, want 1", got)
+	}
+	if got := db.Get("a", "name"); got != "alice" {
+		t.Fatalf("name: got %#v, want the write after the failure kept", got)
+	}
+}
+
+func TestFileDBRefusesChangesWhenAFailedWriteStays(t *testing.T) {
+	path, cleanup := tempFileDBPath(t)
+	defer cleanup()
+
+	db := openFileDB(t, path)
+	db.Set("a", db.Acquire("a", time.Hour), "count", 1.0, false)
+	file := db.file.(*os.File)
+	db.file = &failingLog{File: file, failTruncate: true}
+	db.Set("a", sessions.LifeTime{}, "count", 2.0, false)
+
+	// the torn record is still in the log: nothing may be appended after it.
+	db.file = file
+	db.Set("a", sessions.LifeTime{}, "count", 3.0, false)
+	if db.Delete("a", "count") {
+		t.Fatal("a delete was accepted")
+	}
+	if got := db.Get("a", "count"); got != 1.0 {
+		t.Fatalf("count: got %#v, want 1", got)
+	}
+	if err := db.OnUpdateExpiration("a", time.Hour); err == nil {
+		t.Fatal("an expiration update was accepted")
+	}
+
+	// a compaction rewrites the log from the last good state.
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("a", sessions.LifeTime{}, "name", "alice", false)
+	db.Close()
+
+	db = openFileDB(t, path)
+	defer db.Close()
+	if got := db.Get("a", "count"); got != 1.0 {
+		t.Fatalf("count: got %#v, want 1", got)
+	}
+	if got := db.Get("a", "name"); got != "alice" {
+		t.Fatalf("name: got %#v, want alice", got)
+	}
+}
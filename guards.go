@@ -0,0 +1,127 @@
+package jwt_sessions
+
+import (
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/context"
+)
+
+
+// Guards are middlewares which let the request go on only when the session
+// (or the token) satisfies a condition. Each one receives the handler to run
+// when the condition is not satisfied: when nil, the request ends with the
+// status code documented in the guard. They can be freely composed (e.g. in
+// a party's `Use`) and they reuse the session started by `Handler`, if any.
+
+
+// ValuePredicate tells whether a session value is acceptable to a guard.
+// The value is nil when the key is not present in the session.
+type ValuePredicate func(value interface{}) bool
+
+
+func failWith(statusCode int, onFailure context.Handler) context.Handler {
+	if onFailure != nil {
+		return onFailure
+	}
+	return func(ctx context.Context) {
+		ctx.StatusCode(statusCode)
+		ctx.StopExecution()
+	}
+}
+
+// existingSession returns the request's session only if the request had a valid
+// token, and the session is not a new one (i.e. it has something stored).
+func (sessions *JWTSessions) existingSession(ctx context.Context) *JWTSession {
+	if sessions.sessionIDFromContext(ctx) == "" {
+		return nil
+	}
+	sess := sessions.Start(ctx)
+	if sess.IsNew() || !sess.IsSaved() {
+		return nil
+	}
+	return sess
+}
+
+// RequireSession returns a middleware which only lets the request go on if it
+// belongs to an existing, non-new, session. Otherwise, it responds with 401.
+func (sessions *JWTSessions) RequireSession(onFailure context.Handler) context.Handler {
+	fail := failWith(iris.StatusUnauthorized, onFailure)
+	return func(ctx context.Context) {
+		if sessions.existingSession(ctx) == nil {
+			fail(ctx)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RequireClaim returns a middleware which only lets the request go on if its
+// token has the given claim with the given value. Numbers are compared by
+// value, regardless their type. Otherwise, it responds with 403.
+func (sessions *JWTSessions) RequireClaim(name string, value interface{}, onFailure context.Handler) context.Handler {
+	fail := failWith(iris.StatusForbidden, onFailure)
+	return func(ctx context.Context) {
+		claim, found := sessions.claimsFromContext(ctx)[name]
+		if !found || !sameClaim(claim, value) {
+			fail(ctx)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RequireValue returns a middleware which only lets the request go on if it
+// belongs to an existing session having the given key. Otherwise, it
+// responds with 403.
+func (sessions *JWTSessions) RequireValue(key string, onFailure context.Handler) context.Handler {
+	return sessions.RequireValueFunc(key, func(value interface{}) bool {
+		return value != nil
+	}, onFailure)
+}
+
+// RequireValueFunc returns a middleware which only lets the request go on if it
+// belongs to an existing session whose value for the given key satisfies the
+// predicate. Otherwise, it responds with 403.
+func (sessions *JWTSessions) RequireValueFunc(key string, predicate ValuePredicate, onFailure context.Handler) context.Handler {
+	fail := failWith(iris.StatusForbidden, onFailure)
+	return func(ctx context.Context) {
+		sess := sessions.existingSession(ctx)
+		if sess == nil || !predicate(sess.Get(key)) {
+			fail(ctx)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// sameClaim compares a claim (which, being parsed from JSON, holds float64
+// numbers) against an expected value.
+func sameClaim(claim interface{}, expected interface{}) bool {
+	if a, ok := toFloat64(claim); ok {
+		if b, ok := toFloat64(expected); ok {
+			return a == b
+		}
+	}
+	return claim == expected
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,169 @@
+package jwt_sessions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/context"
+)
+
+
+// serveGuarded serves a request through the middleware and the guard, and
+// returns the response's status code and whether the route was reached.
+func serveGuarded(t *testing.T, sessions *JWTSessions, authorization string, guard context.Handler) (int, bool) {
+	t.Helper()
+	reached := false
+	response := serveWithHandler(t, sessions, authorization, guard, func(ctx context.Context) {
+		reached = true
+	})
+	return response.Code, reached
+}
+
+// sessionToken returns the token of a new session holding the given values.
+func sessionToken(sessions *JWTSessions, values map[string]interface{}) string {
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	for key, value := range values {
+		sess.Set(key, value)
+	}
+	return issuedToken(ctx)
+}
+
+// signedToken returns a token with the given claims.
+func signedToken(t *testing.T, sessions *JWTSessions, claims jwt.MapClaims) string {
+	t.Helper()
+	serialized, err := sessions.config.Parser.Serialize(jwt.NewWithClaims(sessions.config.Parser.SigningMethod, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + serialized
+}
+
+
+func TestRequireSession(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	guard := sessions.RequireSession(nil)
+
+	if code, reached := serveGuarded(t, sessions, "", guard); reached || code != iris.StatusUnauthorized {
+		t.Errorf("without a token: got %d (reached: %v), want 401", code, reached)
+	}
+	empty := sessionToken(sessions, nil)
+	if code, reached := serveGuarded(t, sessions, empty, guard); reached || code != iris.StatusUnauthorized {
+		t.Errorf("with a new session: got %d (reached: %v), want 401", code, reached)
+	}
+	token := sessionToken(sessions, map[string]interface{}{"user_id": 7})
+	if _, reached := serveGuarded(t, sessions, token, guard); !reached {
+		t.Error("with an existing session: the route was not reached")
+	}
+}
+
+func TestRequireSessionCallsTheFailureHandler(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	guard := sessions.RequireSession(func(ctx context.Context) {
+		ctx.StatusCode(iris.StatusTeapot)
+	})
+	if code, reached := serveGuarded(t, sessions, "", guard); reached || code != iris.StatusTeapot {
+		t.Fatalf("got %d (reached: %v), want 418", code, reached)
+	}
+}
+
+func TestRequireClaim(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	token := signedToken(t, sessions, jwt.MapClaims{"session_id": "sid", "role": "admin", "level": 3})
+
+	if _, reached := serveGuarded(t, sessions, token, sessions.RequireClaim("role", "admin", nil)); !reached {
+		t.Error("a matching claim was refused")
+	}
+	if code, reached := serveGuarded(t, sessions, token, sessions.RequireClaim("role", "user", nil)); reached || code != iris.StatusForbidden {
+		t.Errorf("another value: got %d (reached: %v), want 403", code, reached)
+	}
+	if code, reached := serveGuarded(t, sessions, token, sessions.RequireClaim("team", "admin", nil)); reached || code != iris.StatusForbidden {
+		t.Errorf("a missing claim: got %d (reached: %v), want 403", code, reached)
+	}
+	if code, reached := serveGuarded(t, sessions, "", sessions.RequireClaim("role", "admin", nil)); reached || code != iris.StatusForbidden {
+		t.Errorf("without a token: got %d (reached: %v), want 403", code, reached)
+	}
+}
+
+func TestRequireClaimComparesNumbersByValue(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	// the parsed claim is a float64.
+	token := signedToken(t, sessions, jwt.MapClaims{"session_id": "sid", "level": 3})
+
+	for _, expected := range []interface{}{3, int64(3), uint(3), float32(3), 3.0} {
+		if _, reached := serveGuarded(t, sessions, token, sessions.RequireClaim("level", expected, nil)); !reached {
+			t.Errorf("%T(3) was refused", expected)
+		}
+	}
+	if _, reached := serveGuarded(t, sessions, token, sessions.RequireClaim("level", 4, nil)); reached {
+		t.Error("4 was accepted")
+	}
+	if _, reached := serveGuarded(t, sessions, token, sessions.RequireClaim("level", "3", nil)); reached {
+		t.Error("a string was accepted")
+	}
+}
+
+func TestSameClaim(t *testing.T) {
+	cases := []struct {
+		claim    interface{}
+		expected interface{}
+		same     bool
+	}{
+		{float64(1), 1, true},
+		{float64(1), int32(1), true},
+		{float64(1), uint64(1), true},
+		{float64(1.5), 1, false},
+		{"a", "a", true},
+		{"a", "b", false},
+		{true, true, true},
+		{float64(1), true, false},
+		{nil, nil, true},
+	}
+	for _, c := range cases {
+		if got := sameClaim(c.claim, c.expected); got != c.same {
+			t.Errorf("sameClaim(%#v, %#v) = %v, want %v", c.claim, c.expected, got, c.same)
+		}
+	}
+
+	if _, ok := toFloat64("1"); ok {
+		t.Error("a string was converted")
+	}
+	if n, ok := toFloat64(uint32(7)); !ok || n != 7 {
+		t.Errorf("toFloat64(uint32(7)) = %v, %v", n, ok)
+	}
+}
+
+func TestRequireValue(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	guard := sessions.RequireValue("user_id", nil)
+
+	with := sessionToken(sessions, map[string]interface{}{"user_id": 7})
+	if _, reached := serveGuarded(t, sessions, with, guard); !reached {
+		t.Error("a session with the value was refused")
+	}
+	without := sessionToken(sessions, map[string]interface{}{"cart": 1})
+	if code, reached := serveGuarded(t, sessions, without, guard); reached || code != iris.StatusForbidden {
+		t.Errorf("a session without the value: got %d (reached: %v), want 403", code, reached)
+	}
+	if code, reached := serveGuarded(t, sessions, "", guard); reached || code != iris.StatusForbidden {
+		t.Errorf("without a session: got %d (reached: %v), want 403", code, reached)
+	}
+}
+
+func TestRequireValueFunc(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	guard := sessions.RequireValueFunc("role", func(value interface{}) bool {
+		return value == "admin"
+	}, nil)
+
+	admin := sessionToken(sessions, map[string]interface{}{"role": "admin"})
+	if _, reached := serveGuarded(t, sessions, admin, guard); !reached {
+		t.Error("a satisfying value was refused")
+	}
+	user := sessionToken(sessions, map[string]interface{}{"role": "user"})
+	if code, reached := serveGuarded(t, sessions, user, guard); reached || code != iris.StatusForbidden {
+		t.Errorf("another value: got %d (reached: %v), want 403", code, reached)
+	}
+}
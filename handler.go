@@ -0,0 +1,45 @@
+package jwt_sessions
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/kataras/iris/context"
+)
+
+
+// Per-request state is kept in the context's values, so the token is
+// read and verified only once per request, and the session is started
+// only once per request as well.
+const (
+	sessionContextKey = "iris.jwt_sessions.session"
+	claimsContextKey  = "iris.jwt_sessions.claims"
+)
+
+
+// Handler returns a middleware which starts the session once for the request
+// and keeps it (and the verified claims) in the context, so the next handlers
+// can retrieve them with `Get` and `Claims` (or `Start`, which returns the same
+// session). The response is not recorded: tokens issued while handling the
+// request are set in the header right away, so they must be issued before the
+// body is written (or the handler must record the response itself).
+func (sessions *JWTSessions) Handler() context.Handler {
+	return func(ctx context.Context) {
+		sessions.Start(ctx)
+		// before the handlers, which may write the body.
+		sessions.refreshAssurance(ctx)
+		ctx.Next()
+	}
+}
+
+// Get returns the session started for this request, or nil
+// if no session was started (see `JWTSessions.Handler`).
+func Get(ctx context.Context) *JWTSession {
+	sess, _ := ctx.Values().Get(sessionContextKey).(*JWTSession)
+	return sess
+}
+
+// Claims returns the verified claims of this request's token, or nil
+// if the request has no valid token (or it was not read yet).
+func Claims(ctx context.Context) jwt.MapClaims {
+	claims, _ := ctx.Values().Get(claimsContextKey).(jwt.MapClaims)
+	return claims
+}
@@ -0,0 +1,102 @@
+package jwt_sessions
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/context"
+)
+
+
+// serveWithHandler serves a request through the middleware and the given
+// handlers, and returns the recorded response.
+func serveWithHandler(t *testing.T, sessions *JWTSessions, authorization string, handlers ...context.Handler) *httptest.ResponseRecorder {
+	t.Helper()
+	app := iris.New()
+	app.Use(sessions.Handler())
+	app.Get("/", handlers...)
+	if err := app.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("GET", "/", nil)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	response := httptest.NewRecorder()
+	app.ServeHTTP(response, request)
+	return response
+}
+
+
+func TestHandlerStartsTheSessionOnce(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	var sess *JWTSession
+	response := serveWithHandler(t, sessions, "", func(ctx context.Context) {
+		sess = Get(ctx)
+		if sess == nil {
+			t.Fatal("no session in the context")
+		}
+		if sessions.Start(ctx) != sess {
+			t.Error("Start returned another session")
+		}
+		if id, _ := Claims(ctx)["session_id"].(string); id != sess.ID() {
+			t.Errorf("got the claims of session %q, want %q", id, sess.ID())
+		}
+	})
+
+	tokens := response.Header()["Authorization"]
+	if len(tokens) != 1 {
+		t.Fatalf("got %d tokens, want 1", len(tokens))
+	}
+	again := serveWithHandler(t, sessions, tokens[0], func(ctx context.Context) {
+		if Get(ctx) != sess {
+			t.Error("the token did not resume the session")
+		}
+	})
+	if again.Header().Get("Authorization") != "" {
+		t.Error("a token was issued for a resumed session")
+	}
+}
+
+func TestHandlerDoesNotRecordTheResponse(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	var sess *JWTSession
+	response := serveWithHandler(t, sessions, "", func(ctx context.Context) {
+		if _, recording := ctx.IsRecording(); recording {
+			t.Error("the response is recorded")
+		}
+		var err error
+		if sess, err = sessions.Regenerate(ctx); err != nil {
+			t.Fatal(err)
+		}
+		ctx.WriteString("body")
+	})
+
+	if response.Body.String() != "body" {
+		t.Fatalf("got the body %q", response.Body.String())
+	}
+	// only the last token issued is sent.
+	tokens := response.Header()["Authorization"]
+	if len(tokens) != 1 {
+		t.Fatalf("got %d tokens, want 1", len(tokens))
+	}
+	if got := sessions.Start(newTestContext(tokens[0])); got != sess {
+		t.Fatalf("the token got session %q, want %q", got.ID(), sess.ID())
+	}
+}
+
+func TestHandlerDestroyDropsTheIssuedToken(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	response := serveWithHandler(t, sessions, "", func(ctx context.Context) {
+		sessions.Destroy(ctx)
+		if Get(ctx) != nil || Claims(ctx) != nil {
+			t.Error("the destroyed session is still in the context")
+		}
+	})
+	if token := response.Header().Get("Authorization"); token != "" {
+		t.Fatalf("the token of the destroyed session was sent: %q", token)
+	}
+}
@@ -0,0 +1,202 @@
+package jwt_sessions
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/context"
+	"github.com/kataras/iris/core/errors"
+)
+
+
+// Impersonation lets a staff member act as another user: a nested session is
+// created for the target user, whose token carries an "act" (actor) claim with
+// the staff member's subject. The nested session keeps a link to the staff's
+// session, so `EndImpersonation` can return to it. While impersonating, the
+// accessible session keys and the granted permissions may be restricted.
+
+
+const (
+	// keys with this prefix are written only by this package.
+	internalKeyPrefix = "jwt_sessions."
+	impersonationKey  = internalKeyPrefix + "impersonation"
+	actClaim          = "act"
+)
+
+var (
+	errNoSubject            = errors.New("the session has no subject to act as")
+	errAlreadyImpersonating = errors.New("the session is already impersonating")
+	errNotImpersonating     = errors.New("the session is not impersonating")
+)
+
+
+type (
+	// ImpersonationOptions restricts what is available while impersonating.
+	ImpersonationOptions struct {
+		// The session keys which can be read or written. Nil means all of them.
+		// The subject key (see Config.SubjectKey) can always be read, and the
+		// keys used internally by this package can never be written.
+		AllowedKeys []string
+		// The permissions which can be granted. Nil means all of them.
+		Permissions []string
+	}
+
+	// Impersonation is stored in a nested session, telling who is acting in it.
+	Impersonation struct {
+		// The subject (see Config.SubjectKey) of the staff member.
+		Actor interface{}
+		// The subject of the impersonated user.
+		Target interface{}
+		// The session ID of the staff member.
+		OriginalSessionID string
+		// The restrictions applying to the nested session.
+		Options ImpersonationOptions
+	}
+
+	// ImpersonationEvent tells an impersonation started or ended.
+	ImpersonationEvent struct {
+		// True when the impersonation started, false when it ended.
+		Started bool
+		// The impersonation details.
+		Impersonation Impersonation
+		// The ID of the nested session.
+		SessionID string
+		// When did it happen.
+		Time time.Time
+	}
+
+	// ImpersonationListener is fired when an impersonation starts or ends.
+	ImpersonationListener func(event ImpersonationEvent)
+)
+
+
+// isInternalKey tells whether the key is used internally by this package.
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, internalKeyPrefix)
+}
+
+// allowsKey tells whether the key can be read or written while impersonating.
+func (impersonation *Impersonation) allowsKey(key string) bool {
+	if impersonation == nil || impersonation.Options.AllowedKeys == nil {
+		return true
+	}
+	for _, allowed := range impersonation.Options.AllowedKeys {
+		if allowed == key {
+			return true
+		}
+	}
+	return false
+}
+
+// restrict removes the permissions not allowed while impersonating.
+func (impersonation *Impersonation) restrict(grants *Grants) {
+	if impersonation == nil || impersonation.Options.Permissions == nil {
+		return
+	}
+	allowed := make(map[string]bool, len(impersonation.Options.Permissions))
+	for _, permission := range impersonation.Options.Permissions {
+		allowed[permission] = true
+	}
+	for permission := range grants.permissions {
+		if !allowed[permission] {
+			delete(grants.permissions, permission)
+		}
+	}
+}
+
+// Impersonation returns who is acting in this session, or nil
+// if this session is not an impersonation one.
+func (s *JWTSession) Impersonation() *Impersonation {
+	s.mu.RLock()
+	impersonation := s.impersonation
+	s.mu.RUnlock()
+	if impersonation == nil {
+		return nil
+	}
+	copied := *impersonation
+	return &copied
+}
+
+// Impersonate creates a nested session acting as the target user on behalf of the
+// request's session, whose subject becomes the actor. The new token is issued
+// with an "act" claim, and the nested session is returned.
+func (sessions *JWTSessions) Impersonate(ctx context.Context, targetUser interface{}, options ImpersonationOptions) (*JWTSession, error) {
+	staff := sessions.existingSession(ctx)
+	if staff == nil {
+		return nil, ErrNotFound
+	}
+	if staff.Impersonation() != nil {
+		return nil, errAlreadyImpersonating
+	}
+	actor := staff.Get(sessions.config.SubjectKey)
+	if actor == nil {
+		return nil, errNoSubject
+	}
+
+	impersonation := Impersonation{
+		Actor:             actor,
+		Target:            targetUser,
+		OriginalSessionID: staff.ID(),
+		Options:           options,
+	}
+
+	sess := sessions.provider.Init(sessions.config.SessionIDGenerator(), sessions.config.Expires)
+	sess.set(impersonationKey, impersonation, false)
+	sess.set(sessions.config.SubjectKey, targetUser, false)
+	sess.mu.Lock()
+	sess.impersonation = &impersonation
+	sess.mu.Unlock()
+	ctx.Values().Set(sessionContextKey, sess)
+
+	// the staff's assurance level does not apply to the nested session.
+	claims := sessions.tokenClaims(ctx, sess.ID())
+	sessions.assuranceClaims(sess, claims)
+	claims[actClaim] = map[string]interface{}{"sub": actor}
+	sessions.issueJWT(ctx, claims)
+
+	sessions.provider.fireImpersonation(ImpersonationEvent{
+		Started: true, Impersonation: impersonation, SessionID: sess.ID(), Time: time.Now(),
+	})
+	return sess, nil
+}
+
+// EndImpersonation destroys the request's nested session and issues the token
+// of the original (staff) session again, which is returned.
+func (sessions *JWTSessions) EndImpersonation(ctx context.Context) (*JWTSession, error) {
+	sess := sessions.existingSession(ctx)
+	if sess == nil {
+		return nil, ErrNotFound
+	}
+	impersonation := sess.Impersonation()
+	if impersonation == nil {
+		return nil, errNotImpersonating
+	}
+
+	sessions.provider.Destroy(sess.ID(), DestroyLogout)
+	sessions.provider.fireImpersonation(ImpersonationEvent{
+		Started: false, Impersonation: *impersonation, SessionID: sess.ID(), Time: time.Now(),
+	})
+
+	// the original session may be no longer live, but still stored.
+	original := sessions.provider.Read(impersonation.OriginalSessionID, sessions.config.Expires)
+	if original.IsNew() {
+		sessions.provider.Destroy(original.ID(), DestroyLogout)
+		sessions.Destroy(ctx)
+		return nil, ErrNotFound
+	}
+	ctx.Values().Set(sessionContextKey, original)
+
+	claims := sessions.tokenClaims(ctx, original.ID())
+	delete(claims, actClaim)
+	sessions.assuranceClaims(original, claims)
+	sessions.issueJWT(ctx, claims)
+	return original, nil
+}
+
+// OnImpersonation registers one or more impersonation listeners, fired
+// when an impersonation starts and when it ends (e.g. for auditing).
+func (sessions *JWTSessions) OnImpersonation(listeners ...ImpersonationListener) {
+	for _, ln := range listeners {
+		sessions.provider.registerImpersonationListener(ln)
+	}
+}
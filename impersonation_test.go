@@ -0,0 +1,155 @@
+package jwt_sessions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/core/memstore"
+	"github.com/kataras/iris/sessions"
+)
+
+
+// persistentTestDB keeps the values of the sessions which are no longer
+// live, like a database outliving the process memory would.
+type persistentTestDB struct {
+	*MemDB
+}
+
+func (db persistentTestDB) Acquire(sid string, expires time.Duration) sessions.LifeTime {
+	sh := db.shard(sid)
+	sh.mu.Lock()
+	if sh.values[sid] == nil {
+		sh.values[sid] = new(memstore.Store)
+	}
+	sh.mu.Unlock()
+	return sessions.LifeTime{}
+}
+
+
+func TestImpersonationRestrictsKeysButNotTheSubject(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext("")
+	staff := sessions.Start(ctx)
+	staff.Set("user_id", "staff")
+
+	nested, err := sessions.Impersonate(ctx, "customer", ImpersonationOptions{AllowedKeys: []string{"cart"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested.Set("cart", 1)
+	nested.Set("secret", 1)
+	nested.Set("user_id", "someone else")
+
+	if got := nested.Get("user_id"); got != "customer" {
+		t.Fatalf("subject: got %v, want customer", got)
+	}
+	if got := nested.GetAll()["user_id"]; got != "customer" {
+		t.Fatalf("subject in GetAll: got %v, want customer", got)
+	}
+	if nested.Get("cart") != 1 {
+		t.Fatal("the allowed key was not written")
+	}
+	if _, found := nested.GetAll()["secret"]; found {
+		t.Fatal("the forbidden key was written")
+	}
+	if got := nested.Impersonation(); got == nil || got.Actor != "staff" {
+		t.Fatalf("impersonation: got %+v", got)
+	}
+}
+
+func TestImpersonatorCannotWriteInternalKeys(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext("")
+	staff := sessions.Start(ctx)
+	staff.Set("user_id", "staff")
+
+	options := ImpersonationOptions{AllowedKeys: []string{"cart", impersonationKey}}
+	nested, err := sessions.Impersonate(ctx, "customer", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested.Set(impersonationKey, Impersonation{Actor: "staff", Target: "customer"})
+	nested.SetImmutable(impersonationKey, Impersonation{Actor: "staff", Target: "customer"})
+	if nested.Delete(impersonationKey) {
+		t.Fatal("the impersonation was deleted")
+	}
+	nested.Set("cart", 1)
+	nested.Clear()
+
+	if nested.Get("cart") != nil {
+		t.Fatal("the allowed key was not cleared")
+	}
+	if got := nested.Get("user_id"); got != "customer" {
+		t.Fatalf("subject: got %v, want customer", got)
+	}
+	stored, ok := sessions.provider.db.Get(nested.ID(), impersonationKey).(Impersonation)
+	if !ok || len(stored.Options.AllowedKeys) != 2 || stored.OriginalSessionID != staff.ID() {
+		t.Fatalf("the stored impersonation was changed: %+v", stored)
+	}
+}
+
+func TestInternalKeysAreWrittenOnlyByThePackage(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	sess.Set(authEventsKey, []AuthEvent{{Method: "otp", Level: 3, Time: time.Now()}})
+	if len(sess.AuthEvents()) != 0 {
+		t.Fatal("an authentication event was forged")
+	}
+
+	sessions.Authenticate(ctx, "pwd", 1)
+	if sess.Delete(authEventsKey) || len(sess.AuthEvents()) != 1 {
+		t.Fatal("an authentication event was deleted")
+	}
+}
+
+func TestEndImpersonationRevivesTheOriginalSession(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	sessions.UseDatabase(persistentTestDB{NewMemDB().(*MemDB)})
+	ctx := newTestContext("")
+	staff := sessions.Start(ctx)
+	staff.Set("user_id", "staff")
+	if _, err := sessions.Impersonate(ctx, "customer", ImpersonationOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// the staff's session is no longer live, but it is still stored.
+	sh := sessions.provider.shard(staff.ID())
+	sh.mu.Lock()
+	delete(sh.sessions, staff.ID())
+	sh.mu.Unlock()
+
+	next := newTestContext(issuedToken(ctx))
+	original, err := sessions.EndImpersonation(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original.ID() != staff.ID() || original.Get("user_id") != "staff" {
+		t.Fatalf("got session %q with %v", original.ID(), original.GetAll())
+	}
+	if got := sessions.Start(newTestContext(issuedToken(next))); got != original {
+		t.Fatalf("the token got session %q, want %q", got.ID(), original.ID())
+	}
+}
+
+func TestEndImpersonationWithoutTheOriginalSession(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext("")
+	staff := sessions.Start(ctx)
+	staff.Set("user_id", "staff")
+	nested, err := sessions.Impersonate(ctx, "customer", ImpersonationOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions.DestroyByID(staff.ID())
+
+	next := newTestContext(issuedToken(ctx))
+	if _, err := sessions.EndImpersonation(next); err == nil || !ErrNotFound.Equal(err) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	if Get(next) != nil || issuedToken(next) != "" {
+		t.Fatal("the request still has a session")
+	}
+	if got := sessions.Start(newTestContext(issuedToken(ctx))); got == nested {
+		t.Fatal("the nested session was not destroyed")
+	}
+}
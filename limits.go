@@ -0,0 +1,489 @@
+package jwt_sessions
+
+import (
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/kataras/iris/sessions"
+)
+
+
+// The provider keeps the live sessions in memory, in LRU order (within each
+// shard). When there are more than Config.MaxSessions of them, or their values
+// take more than (approximately) Config.MaxBytes, the least recently used ones
+// of the session's shard (then of the next shards) are evicted:
+//
+//   - with a Config.Spill database, their values are moved into it, and
+//     moved back when the session is read again.
+//   - with the default MemDB, which is memory itself, they are lost.
+//   - with any other database, only the in-memory copy is dropped, and
+//     the session is revived from the database when it is read again.
+//
+// The session being used is never evicted.
+
+
+// EvictionReason tells why a session was evicted from memory.
+type EvictionReason uint8
+
+const (
+	// EvictedMaxSessions tells that there were too many sessions.
+	EvictedMaxSessions EvictionReason = iota + 1
+	// EvictedMaxBytes tells that the sessions' values took too much memory.
+	EvictedMaxBytes
+)
+
+// spillSweepInterval is how often the expired spilled sessions are forgotten.
+const spillSweepInterval = time.Minute
+
+
+func (reason EvictionReason) String() string {
+	switch reason {
+	case EvictedMaxSessions:
+		return "max_sessions"
+	case EvictedMaxBytes:
+		return "max_bytes"
+	default:
+		return "unknown"
+	}
+}
+
+type (
+	// EvictionListener is fired when a session has been evicted from memory.
+	EvictionListener func(sid string, reason EvictionReason)
+
+	// MemoryStats are the counters of the in-memory sessions.
+	MemoryStats struct {
+		// The sessions in memory, the approximate size of their values
+		// (only measured when Config.MaxBytes is set), and the sessions
+		// spilled into Config.Spill.
+		Sessions int
+		Bytes    int64
+		Spilled  int
+		// Reads finding the session in memory, or not.
+		Hits   uint64
+		Misses uint64
+		// Sessions evicted from memory, and restored from Config.Spill.
+		Evictions uint64
+		Restores  uint64
+	}
+)
+
+// Stats returns the counters of the in-memory sessions.
+func (sessions *JWTSessions) Stats() MemoryStats {
+	return sessions.provider.Stats()
+}
+
+// OnEvict registers one or more eviction listeners.
+// An eviction listener is fired when a session has been evicted from memory
+// because of Config.MaxSessions or Config.MaxBytes.
+func (sessions *JWTSessions) OnEvict(listeners ...EvictionListener) {
+	for _, ln := range listeners {
+		sessions.provider.registerEvictionListener(ln)
+	}
+}
+
+func (p *provider) registerEvictionListener(ln EvictionListener) {
+	if ln == nil {
+		return
+	}
+	p.evictionListeners = append(p.evictionListeners, ln)
+}
+
+func (p *provider) fireEviction(sid string, reason EvictionReason) {
+	for _, ln := range p.evictionListeners {
+		ln(sid, reason)
+	}
+}
+
+// Stats returns the counters of the in-memory sessions.
+func (p *provider) Stats() MemoryStats {
+	var stats MemoryStats
+	for _, sh := range p.shards {
+		sh.mu.Lock()
+		stats.Sessions += len(sh.sessions)
+		stats.Spilled += len(sh.spilled)
+		stats.Hits += sh.stats.Hits
+		stats.Misses += sh.stats.Misses
+		stats.Evictions += sh.stats.Evictions
+		stats.Restores += sh.stats.Restores
+		sh.mu.Unlock()
+	}
+	stats.Bytes = atomic.LoadInt64(&p.bytes)
+	return stats
+}
+
+// track registers a session in memory, as the most recently used one of its
+// shard. The shard's lock must be held: call enforceLimits once released.
+func (p *provider) track(sess *JWTSession) {
+	sh := p.shard(sess.sid)
+	if previous, found := sh.sessions[sess.sid]; found && previous != sess {
+		p.untrack(previous)
+	}
+	sh.sessions[sess.sid] = sess
+	if sess.element == nil {
+		sess.element = sh.lru.PushFront(sess)
+		atomic.AddInt64(&p.count, 1)
+	} else {
+		sh.lru.MoveToFront(sess.element)
+	}
+}
+
+// untrack removes a session from memory. The shard's lock must be held.
+func (p *provider) untrack(sess *JWTSession) {
+	sh := p.shard(sess.sid)
+	if current, found := sh.sessions[sess.sid]; found && current == sess {
+		delete(sh.sessions, sess.sid)
+	}
+	if sess.element != nil {
+		sh.lru.Remove(sess.element)
+		sess.element = nil
+		atomic.AddInt64(&p.count, -1)
+	}
+	atomic.AddInt64(&p.bytes, -sess.size)
+	sess.size, sess.sizes = 0, nil
+}
+
+// touch marks a session as the most recently used one of its shard.
+// The shard's lock must be held.
+func (p *provider) touch(sess *JWTSession) {
+	if sess.element != nil {
+		p.shard(sess.sid).lru.MoveToFront(sess.element)
+	}
+}
+
+// overLimit tells why the sessions in memory are over the limits, if they are.
+func (p *provider) overLimit() (EvictionReason, bool) {
+	if p.config.MaxSessions > 0 && atomic.LoadInt64(&p.count) > int64(p.config.MaxSessions) {
+		return EvictedMaxSessions, true
+	}
+	if p.config.MaxBytes > 0 && atomic.LoadInt64(&p.bytes) > p.config.MaxBytes {
+		return EvictedMaxBytes, true
+	}
+	return 0, false
+}
+
+// enforceLimits evicts sessions while over the limits, one per shard in turn,
+// starting from the shard of the session being used, which is kept. No shard
+// lock must be held.
+func (p *provider) enforceLimits(keep *JWTSession) {
+	if p.config.MaxSessions <= 0 && p.config.MaxBytes <= 0 {
+		return
+	}
+
+	n := len(p.shards)
+	start := shardIndex(keep.sid, n)
+	// stops after a whole round of shards without evictable sessions.
+	for i, idle := 0, 0; idle < n; i++ {
+		reason, over := p.overLimit()
+		if !over {
+			break
+		}
+
+		var pending notifications
+		sh := p.shards[(start+i)%n]
+		sh.mu.Lock()
+		if p.evictOldest(sh, keep, reason, &pending) {
+			idle = 0
+		} else {
+			idle++
+		}
+		if p.config.Spill != nil && time.Since(sh.lastSweep) > spillSweepInterval {
+			p.sweepSpilled(sh, &pending)
+		}
+		sh.mu.Unlock()
+		pending.fire()
+	}
+}
+
+// evictOldest evicts the least recently used session of a shard, except
+// "keep", telling whether there was one. The shard's lock must be held: what
+// is left to do (the listeners, and moving the values into the spill
+// database) is added to "pending", to be done once it is released.
+func (p *provider) evictOldest(sh *providerShard, keep *JWTSession, reason EvictionReason, pending *notifications) bool {
+	element := sh.lru.Back()
+	if element != nil && element.Value.(*JWTSession) == keep {
+		element = element.Prev()
+	}
+	if element == nil {
+		return false
+	}
+
+	sess := element.Value.(*JWTSession)
+	sess.mu.RLock()
+	lifetime, claims := sess.Lifetime, sess.claims
+	sess.mu.RUnlock()
+	p.untrack(sess)
+	p.unschedule(sess)
+	sh.stats.Evictions++
+
+	sid := sess.sid
+	_, inMemory := unwrapDatabase(p.db).(*MemDB)
+	switch {
+	case p.config.Spill != nil:
+		p.spillSession(sh, sid, lifetime, pending)
+	case inMemory:
+		*pending = append(*pending, p.releaseDestroyed(p.db, sid, claims, lifetime.Time, DestroyEvicted))
+	}
+	*pending = append(*pending, func() { p.fireEviction(sid, reason) })
+	return true
+}
+
+// spillSession moves the values of an evicted session into the spill database.
+// The shard's lock must be held: the values are moved once it is released
+// (see evictOldest), and the session is read meanwhile waits for them.
+func (p *provider) spillSession(sh *providerShard, sid string, lifetime sessions.LifeTime, pending *notifications) {
+	var remaining time.Duration
+	if !lifetime.IsZero() {
+		if remaining = lifetime.DurationUntilExpiration(); remaining <= 0 {
+			*pending = append(*pending, p.releaseDestroyed(p.db, sid, nil, lifetime.Time, DestroyExpired))
+			return
+		}
+	}
+
+	sh.moving[sid] = make(chan struct{})
+	*pending = append(*pending, func() {
+		values := make(map[string]interface{})
+		p.db.Visit(sid, func(key string, value interface{}) {
+			values[key] = value
+		})
+		spillLifetime := p.config.Spill.Acquire(sid, remaining)
+		for key, value := range values {
+			p.config.Spill.Set(sid, spillLifetime, key, value, false)
+		}
+		p.db.Release(sid)
+
+		sh.mu.Lock()
+		sh.spilled[sid] = lifetime.Time
+		p.moved(sh, sid)
+		sh.mu.Unlock()
+	})
+}
+
+// waitMoved waits until the values of a session are not being moved into,
+// or out of, the spill database. The shard's lock must be held: it is
+// released while waiting.
+func (p *provider) waitMoved(sh *providerShard, sid string) {
+	for moving, ok := sh.moving[sid]; ok; moving, ok = sh.moving[sid] {
+		sh.mu.Unlock()
+		<-moving
+		sh.mu.Lock()
+	}
+}
+
+// waitAllMoved waits until no values of a shard are being moved. The shard's
+// lock must be held: it is released while waiting.
+func (p *provider) waitAllMoved(sh *providerShard) {
+	for len(sh.moving) > 0 {
+		for sid := range sh.moving {
+			p.waitMoved(sh, sid)
+			break
+		}
+	}
+}
+
+// moved tells that the values of a session are moved, waking up the ones
+// waiting for them. The shard's lock must be held.
+func (p *provider) moved(sh *providerShard, sid string) {
+	close(sh.moving[sid])
+	delete(sh.moving, sid)
+}
+
+// restore moves the values of a spilled session back into the database,
+// returning whether the session was spilled (and not expired). It returns
+// the session instead, if it was restored meanwhile.
+func (p *provider) restore(sid string, expires time.Duration) (*JWTSession, bool) {
+	sh := p.shard(sid)
+	sh.mu.Lock()
+	p.waitMoved(sh, sid)
+	if sess, found := sh.sessions[sid]; found {
+		sh.mu.Unlock()
+		return sess, true
+	}
+	expiresAt, spilled := sh.spilled[sid]
+	if !spilled {
+		sh.mu.Unlock()
+		return nil, false
+	}
+	// it is still spilled while its values are moved: the session is read
+	// meanwhile waits for them, instead of finding it nowhere.
+	sh.moving[sid] = make(chan struct{})
+	sh.mu.Unlock()
+
+	if !expiresAt.IsZero() {
+		if expires = time.Until(expiresAt); expires <= 0 {
+			notify := p.releaseDestroyed(p.config.Spill, sid, nil, expiresAt, DestroyExpired)
+			sh.mu.Lock()
+			delete(sh.spilled, sid)
+			p.moved(sh, sid)
+			sh.mu.Unlock()
+			notify()
+			return nil, false
+		}
+	}
+
+	values := make(map[string]interface{})
+	p.config.Spill.Visit(sid, func(key string, value interface{}) {
+		values[key] = value
+	})
+	p.config.Spill.Release(sid)
+
+	sess := p.newSession(sid, expires)
+	for key, value := range values {
+		p.db.Set(sid, sess.Lifetime, key, value, false)
+	}
+	sess.isNew = len(values) == 0
+
+	sh.mu.Lock()
+	delete(sh.spilled, sid)
+	sh.stats.Restores++
+	p.track(sess)
+	p.measure(sess, values)
+	p.moved(sh, sid)
+	sh.mu.Unlock()
+	p.enforceLimits(sess)
+	return sess, true
+}
+
+// forgetSpilled forgets a destroyed spilled session, returning its expiration
+// time and whether it was spilled: its values are to be released from the
+// spill database (see releaseSpilled) once the shard's lock is released.
+// The shard's lock must be held.
+func (p *provider) forgetSpilled(sh *providerShard, sid string) (time.Time, bool) {
+	expiresAt, spilled := sh.spilled[sid]
+	delete(sh.spilled, sid)
+	return expiresAt, spilled
+}
+
+// sweepSpilled destroys the expired spilled sessions of a shard. The shard's
+// lock must be held: they are released from the spill database once it is
+// released.
+func (p *provider) sweepSpilled(sh *providerShard, pending *notifications) {
+	now := time.Now()
+	sh.lastSweep = now
+	for sid, expiresAt := range sh.spilled {
+		if !expiresAt.IsZero() && expiresAt.Before(now) {
+			delete(sh.spilled, sid)
+			*pending = append(*pending, p.releaseSpilled(sid, expiresAt, DestroyExpired))
+		}
+	}
+}
+
+// releaseSpilled returns the release of a destroyed session from the spill
+// database, which also fires its destroy listeners.
+func (p *provider) releaseSpilled(sid string, expiresAt time.Time, reason DestroyReason) func() {
+	return func() { p.releaseDestroyed(p.config.Spill, sid, nil, expiresAt, reason)() }
+}
+
+// measure sets the approximate size of a tracked session's values, if the
+// memory is limited by size. The shard's lock must be held: call
+// enforceLimits once released.
+func (p *provider) measure(sess *JWTSession, values map[string]interface{}) {
+	if p.config.MaxBytes <= 0 || sess.element == nil {
+		return
+	}
+
+	size, sizes := int64(0), make(map[string]int64, len(values))
+	for key, value := range values {
+		sizes[key] = approximateSize(key) + approximateSize(value)
+		size += sizes[key]
+	}
+	atomic.AddInt64(&p.bytes, size-sess.size)
+	sess.size, sess.sizes = size, sizes
+}
+
+// remeasure measures a session's values, evicting other sessions if needed.
+func (p *provider) remeasure(sess *JWTSession, values map[string]interface{}) {
+	if p.config.MaxBytes <= 0 {
+		return
+	}
+
+	sh := p.shard(sess.sid)
+	sh.mu.Lock()
+	p.measure(sess, values)
+	sh.mu.Unlock()
+	p.enforceLimits(sess)
+}
+
+// resize updates the approximate size of a session after a value is set, or
+// deleted (nil value), evicting other sessions if needed.
+func (p *provider) resize(sess *JWTSession, key string, value interface{}) {
+	if p.config.MaxBytes <= 0 {
+		return
+	}
+
+	var size int64
+	if value != nil {
+		size = approximateSize(key) + approximateSize(value)
+	}
+
+	sh := p.shard(sess.sid)
+	sh.mu.Lock()
+	if sess.element == nil {
+		sh.mu.Unlock()
+		return
+	}
+	if sess.sizes == nil {
+		sess.sizes = make(map[string]int64)
+	}
+	delta := size - sess.sizes[key]
+	if size == 0 {
+		delete(sess.sizes, key)
+	} else {
+		sess.sizes[key] = size
+	}
+	sess.size += delta
+	atomic.AddInt64(&p.bytes, delta)
+	p.touch(sess)
+	sh.mu.Unlock()
+
+	p.enforceLimits(sess)
+}
+
+// approximateSize estimates the memory taken by a value.
+func approximateSize(value interface{}) int64 {
+	return approximateValueSize(reflect.ValueOf(value), 0)
+}
+
+func approximateValueSize(v reflect.Value, depth int) int64 {
+	const word = 8
+	if !v.IsValid() {
+		return word
+	}
+	if depth > 8 {
+		return 4 * word
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return 2*word + int64(v.Len())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return word
+		}
+		return word + approximateValueSize(v.Elem(), depth+1)
+	case reflect.Slice, reflect.Array:
+		size := int64(3 * word)
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return size + int64(v.Len())
+		}
+		for i := 0; i < v.Len(); i++ {
+			size += approximateValueSize(v.Index(i), depth+1)
+		}
+		return size
+	case reflect.Map:
+		size := int64(6 * word)
+		for _, key := range v.MapKeys() {
+			size += approximateValueSize(key, depth+1) + approximateValueSize(v.MapIndex(key), depth+1)
+		}
+		return size
+	case reflect.Struct:
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			size += approximateValueSize(v.Field(i), depth+1)
+		}
+		return size
+	default:
+		return int64(v.Type().Size())
+	}
+}
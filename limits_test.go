@@ -0,0 +1,196 @@
+package jwt_sessions
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/sessions"
+)
+
+
+// startSession starts a new session, with a value so it is stored.
+func startSession(sessions *JWTSessions) *JWTSession {
+	sess := sessions.Start(newTestContext(""))
+	sess.Set("user_id", 7)
+	return sess
+}
+
+// recordEvictions returns the evictions of a manager, as they happen.
+func recordEvictions(sessions *JWTSessions) *[]string {
+	evicted := new([]string)
+	sessions.OnEvict(func(sid string, reason EvictionReason) {
+		*evicted = append(*evicted, sid+" "+reason.String())
+	})
+	return evicted
+}
+
+// stored tells whether a MemDB holds a session.
+func stored(db sessions.Database, sid string) bool {
+	sh := db.(*MemDB).shard(sid)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	_, ok := sh.values[sid]
+	return ok
+}
+
+// inMemory tells whether the sessions are in memory.
+func inMemory(sessions *JWTSessions, sids ...string) bool {
+	for _, sid := range sids {
+		if _, found := sessions.provider.find(sid); !found {
+			return false
+		}
+	}
+	return true
+}
+
+
+func TestEvictsTheLeastRecentlyUsedSessions(t *testing.T) {
+	// a single shard, for an exact eviction order.
+	sessions := newTestSessions(Config{Expires: time.Hour, MaxSessions: 2, Shards: 1})
+	evicted := recordEvictions(sessions)
+	destroyed := make(map[string]bool)
+	sessions.OnDestroy(func(sid string) { destroyed[sid] = true })
+
+	a, b := startSession(sessions), startSession(sessions)
+	sessions.provider.Read(a.ID(), time.Hour)
+	c := startSession(sessions)
+
+	if len(*evicted) != 1 || (*evicted)[0] != b.ID()+" max_sessions" {
+		t.Fatalf("evicted %v, want only %s", *evicted, b.ID())
+	}
+	if !inMemory(sessions, a.ID(), c.ID()) || inMemory(sessions, b.ID()) {
+		t.Fatal("the wrong sessions are in memory")
+	}
+	// without a spill database, the values of the MemDB are lost.
+	if !destroyed[b.ID()] || stored(sessions.provider.db, b.ID()) {
+		t.Fatal("the evicted session was not destroyed")
+	}
+	if stats := sessions.Stats(); stats.Sessions != 2 || stats.Evictions != 1 || stats.Hits != 1 {
+		t.Fatalf("got %+v", stats)
+	}
+}
+
+func TestEvictsOverTheMaxBytes(t *testing.T) {
+	blob := strings.Repeat("x", 1000)
+	size := approximateSize("blob") + approximateSize(blob)
+	sessions := newTestSessions(Config{Expires: time.Hour, MaxBytes: 2*size + size/2, Shards: 1})
+	evicted := recordEvictions(sessions)
+
+	var started []*JWTSession
+	for i := 0; i < 3; i++ {
+		sess := sessions.Start(newTestContext(""))
+		sess.Set("blob", blob)
+		started = append(started, sess)
+	}
+	if len(*evicted) != 1 || (*evicted)[0] != started[0].ID()+" max_bytes" {
+		t.Fatalf("evicted %v, want only %s", *evicted, started[0].ID())
+	}
+	if stats := sessions.Stats(); stats.Bytes != 2*size || stats.Sessions != 2 {
+		t.Fatalf("got %+v, want two sessions of %d bytes", stats, size)
+	}
+
+	// the session being written is never evicted, even alone over the budget.
+	last := started[2]
+	last.Set("blob", strings.Repeat(blob, 3))
+	if !inMemory(sessions, last.ID()) || inMemory(sessions, started[1].ID()) {
+		t.Fatal("the wrong sessions are in memory")
+	}
+	last.Delete("blob")
+	if stats := sessions.Stats(); stats.Bytes != 0 || stats.Sessions != 1 {
+		t.Fatalf("got %+v, want a single empty session", stats)
+	}
+}
+
+func TestSpillsAndRestoresTheEvictedSessions(t *testing.T) {
+	spill := NewMemDB()
+	sessions := newTestSessions(Config{Expires: time.Hour, MaxSessions: 1, Spill: spill})
+	a := startSession(sessions)
+	b := startSession(sessions)
+
+	if stats := sessions.Stats(); stats.Spilled != 1 || stats.Evictions != 1 || spill.Len(a.ID()) != 1 {
+		t.Fatalf("got %+v, want the first session spilled", stats)
+	}
+	if stored(sessions.provider.db, a.ID()) {
+		t.Fatal("the spilled values were kept in the database")
+	}
+
+	restored := sessions.provider.Read(a.ID(), time.Hour)
+	if restored.IsNew() || restored.Get("user_id") != 7 {
+		t.Fatalf("got %#v, want the spilled values", restored.Get("user_id"))
+	}
+	if stored(spill, a.ID()) || spill.Len(b.ID()) != 1 {
+		t.Fatal("the restored session was kept in the spill database")
+	}
+	if stats := sessions.Stats(); stats.Restores != 1 || stats.Spilled != 1 || stats.Misses != 1 {
+		t.Fatalf("got %+v", stats)
+	}
+}
+
+func TestDoesNotRestoreAnExpiredSpilledSession(t *testing.T) {
+	spill := NewMemDB()
+	sessions := newTestSessions(Config{Expires: 50 * time.Millisecond, MaxSessions: 1, Spill: spill})
+	a := startSession(sessions)
+	startSession(sessions)
+
+	time.Sleep(100 * time.Millisecond)
+	sess := sessions.provider.Read(a.ID(), time.Hour)
+	if !sess.IsNew() || sess.Get("user_id") != nil {
+		t.Fatal("an expired spilled session was restored")
+	}
+	if stats := sessions.Stats(); stats.Restores != 0 || stats.Spilled != 0 || stored(spill, a.ID()) {
+		t.Fatalf("got %+v, want the expired session released", stats)
+	}
+}
+
+func TestReadsWhileRestoringWaitForTheValues(t *testing.T) {
+	spill := &duringVisitDB{Database: NewMemDB()}
+	sessions := newTestSessions(Config{Expires: time.Hour, MaxSessions: 1, Spill: spill})
+	a := startSession(sessions)
+	startSession(sessions)
+
+	concurrent := make(chan *JWTSession, 1)
+	spill.duringVisit = func() {
+		go func() { concurrent <- sessions.provider.Read(a.ID(), time.Hour) }()
+		time.Sleep(20 * time.Millisecond)
+	}
+	restored := sessions.provider.Read(a.ID(), time.Hour)
+	if sess := <-concurrent; sess != restored || sess.Get("user_id") != 7 {
+		t.Fatalf("got %#v while restoring, want the spilled values", sess.Get("user_id"))
+	}
+}
+
+func TestDestroyListenersCanCallTheManager(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	sess := startSession(sessions)
+
+	done := make(chan struct{})
+	sessions.OnDestroy(func(sid string) {
+		sessions.Stats()
+		sessions.DestroyByID(sid)
+		startSession(sessions)
+		close(done)
+	})
+	go sessions.DestroyByID(sess.ID())
+	waitFor(t, done, 5*time.Second, "the destroy listener (deadlocked?)")
+}
+
+func TestEvictionListenersCanCallTheManager(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour, MaxSessions: 1})
+	first := startSession(sessions)
+
+	done := make(chan struct{})
+	sessions.OnEvict(func(sid string, reason EvictionReason) {
+		if sid != first.ID() || reason != EvictedMaxSessions {
+			t.Errorf("evicted %s (%s), want %s", sid, reason, first.ID())
+		}
+		sessions.Stats()
+		sessions.DestroyByID(sid)
+		close(done)
+	})
+	go startSession(sessions)
+	waitFor(t, done, 5*time.Second, "the eviction listener (deadlocked?)")
+	if stats := sessions.Stats(); stats.Sessions != 1 || stats.Evictions != 1 {
+		t.Fatalf("got %+v, want a single session after an eviction", stats)
+	}
+}
@@ -10,21 +10,41 @@ import (
 
 // This is an exact port of Iris sessions' MemDB, but this one is public.
 // (hopefully I can reuse the other 3 database types).
+// Unlike the original, the stores are split in shards, each with its own lock,
+// and a released session (e.g. destroyed or evicted while in use) reads as
+// empty and ignores writes, instead of panicking.
 
 
 type MemDB struct {
+	shards []*memDBShard
+}
+
+type memDBShard struct {
 	values map[string]*memstore.Store
 	mu     sync.RWMutex
 }
 
 var _ sessions.Database = (*MemDB)(nil)
 
-func NewMemDB() sessions.Database { return &MemDB{values: make(map[string]*memstore.Store)} }
+func NewMemDB() sessions.Database { return newShardedMemDB(DefaultShards) }
+
+func newShardedMemDB(n int) *MemDB {
+	shards := make([]*memDBShard, n)
+	for i := range shards {
+		shards[i] = &memDBShard{values: make(map[string]*memstore.Store)}
+	}
+	return &MemDB{shards: shards}
+}
+
+func (s *MemDB) shard(sid string) *memDBShard {
+	return s.shards[shardIndex(sid, len(s.shards))]
+}
 
 func (s *MemDB) Acquire(sid string, expires time.Duration) sessions.LifeTime {
-	s.mu.Lock()
-	s.values[sid] = new(memstore.Store)
-	s.mu.Unlock()
+	sh := s.shard(sid)
+	sh.mu.Lock()
+	sh.values[sid] = new(memstore.Store)
+	sh.mu.Unlock()
 	return sessions.LifeTime{}
 }
 
@@ -32,48 +52,76 @@ func (s *MemDB) Acquire(sid string, expires time.Duration) sessions.LifeTime {
 func (s *MemDB) OnUpdateExpiration(string, time.Duration) error { return nil }
 
 // immutable depends on the store, it may not implement it at all.
+// The stores are not safe for concurrent use, so writes take the write lock.
 func (s *MemDB) Set(sid string, lifetime sessions.LifeTime, key string, value interface{}, immutable bool) {
-	s.mu.RLock()
-	s.values[sid].Save(key, value, immutable)
-	s.mu.RUnlock()
+	sh := s.shard(sid)
+	sh.mu.Lock()
+	if store, ok := sh.values[sid]; ok {
+		store.Save(key, value, immutable)
+	}
+	sh.mu.Unlock()
 }
 
 func (s *MemDB) Get(sid string, key string) interface{} {
-	s.mu.RLock()
-	v := s.values[sid].Get(key)
-	s.mu.RUnlock()
+	sh := s.shard(sid)
+	sh.mu.RLock()
+	var v interface{}
+	if store, ok := sh.values[sid]; ok {
+		v = store.Get(key)
+	}
+	sh.mu.RUnlock()
 
 	return v
 }
 
+// The entries are copied under the lock, and visited once it is released:
+// the callback may write into the session.
 func (s *MemDB) Visit(sid string, cb func(key string, value interface{})) {
-	s.values[sid].Visit(cb)
+	sh := s.shard(sid)
+	sh.mu.RLock()
+	var entries memstore.Store
+	if store, ok := sh.values[sid]; ok {
+		entries = append(entries, *store...)
+	}
+	sh.mu.RUnlock()
+
+	entries.Visit(cb)
 }
 
 func (s *MemDB) Len(sid string) int {
-	s.mu.RLock()
-	n := s.values[sid].Len()
-	s.mu.RUnlock()
+	sh := s.shard(sid)
+	sh.mu.RLock()
+	var n int
+	if store, ok := sh.values[sid]; ok {
+		n = store.Len()
+	}
+	sh.mu.RUnlock()
 
 	return n
 }
 
 func (s *MemDB) Delete(sid string, key string) (deleted bool) {
-	s.mu.RLock()
-	deleted = s.values[sid].Remove(key)
-	s.mu.RUnlock()
+	sh := s.shard(sid)
+	sh.mu.Lock()
+	if store, ok := sh.values[sid]; ok {
+		deleted = store.Remove(key)
+	}
+	sh.mu.Unlock()
 	return
 }
 
 func (s *MemDB) Clear(sid string) {
-	s.mu.Lock()
-	s.values[sid].Reset()
-	s.mu.Unlock()
+	sh := s.shard(sid)
+	sh.mu.Lock()
+	if store, ok := sh.values[sid]; ok {
+		store.Reset()
+	}
+	sh.mu.Unlock()
 }
 
 func (s *MemDB) Release(sid string) {
-	s.mu.Lock()
-	delete(s.values, sid)
-	s.mu.Unlock()
+	sh := s.shard(sid)
+	sh.mu.Lock()
+	delete(sh.values, sid)
+	sh.mu.Unlock()
 }
-
@@ -0,0 +1,206 @@
+package jwt_sessions
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/sessions"
+)
+
+
+// The concurrency tests are meant to be run with -race.
+
+
+// newTestMemDB returns a database with n acquired sessions, spread
+// across its shards, and their IDs.
+func newTestMemDB(n int) (*MemDB, []string) {
+	db := NewMemDB().(*MemDB)
+	sids := make([]string, n)
+	for i := range sids {
+		sids[i] = fmt.Sprintf("session-%d", i)
+		db.Acquire(sids[i], time.Hour)
+	}
+	return db, sids
+}
+
+// concurrently runs f from n goroutines, with the index of each one.
+func concurrently(n int, f func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+
+func TestMemDBStoresValues(t *testing.T) {
+	db, _ := newTestMemDB(0)
+	db.Set("a", sessions.LifeTime{}, "name", "alice", false)
+	if db.Len("a") != 0 {
+		t.Fatal("a value was stored in a session not acquired")
+	}
+
+	db.Acquire("a", time.Hour)
+	db.Set("a", sessions.LifeTime{}, "name", "alice", false)
+	db.Set("a", sessions.LifeTime{}, "count", 1, false)
+	if db.Get("a", "name") != "alice" || db.Len("a") != 2 {
+		t.Fatalf("got %#v, with %d values", db.Get("a", "name"), db.Len("a"))
+	}
+	if !db.Delete("a", "count") || db.Delete("a", "count") {
+		t.Fatal("the value was not deleted once")
+	}
+	db.Clear("a")
+	if db.Len("a") != 0 {
+		t.Fatal("the values were not cleared")
+	}
+	db.Set("a", sessions.LifeTime{}, "name", "bob", false)
+	db.Release("a")
+	if db.Get("a", "name") != nil || db.Len("a") != 0 {
+		t.Fatal("the session was not released")
+	}
+}
+
+func TestMemDBVisitCanWriteIntoTheSession(t *testing.T) {
+	db, _ := newTestMemDB(0)
+	db.Acquire("a", time.Hour)
+	db.Set("a", sessions.LifeTime{}, "count", 1, false)
+
+	db.Visit("a", func(key string, value interface{}) {
+		db.Set("a", sessions.LifeTime{}, key, value.(int)+1, false)
+		db.Set("a", sessions.LifeTime{}, "visited", true, false)
+	})
+	if db.Get("a", "count") != 2 || db.Get("a", "visited") != true {
+		t.Fatalf("got %#v and %#v", db.Get("a", "count"), db.Get("a", "visited"))
+	}
+}
+
+func TestMemDBConcurrentAccess(t *testing.T) {
+	db, sids := newTestMemDB(64)
+	concurrently(8, func(i int) {
+		for j := 0; j < 200; j++ {
+			sid := sids[(i+j)%len(sids)]
+			key := fmt.Sprintf("key-%d", j%5)
+			switch j % 4 {
+			case 0:
+				db.Set(sid, sessions.LifeTime{}, key, j, false)
+			case 1:
+				db.Get(sid, key)
+			case 2:
+				db.Visit(sid, func(string, interface{}) {})
+				db.Len(sid)
+			case 3:
+				db.Delete(sid, key)
+			}
+		}
+	})
+}
+
+func TestMemDBConcurrentVisitAndSetOfASession(t *testing.T) {
+	db, _ := newTestMemDB(0)
+	db.Acquire("a", time.Hour)
+	concurrently(4, func(i int) {
+		for j := 0; j < 500; j++ {
+			if i%2 == 0 {
+				db.Set("a", sessions.LifeTime{}, fmt.Sprintf("key-%d", j%20), j, false)
+			} else {
+				db.Visit("a", func(string, interface{}) {})
+			}
+		}
+	})
+	if db.Len("a") != 20 {
+		t.Fatalf("got %d values, want 20", db.Len("a"))
+	}
+}
+
+func TestMemDBConcurrentAcquireAndRelease(t *testing.T) {
+	db, sids := newTestMemDB(16)
+	concurrently(8, func(i int) {
+		for j := 0; j < 200; j++ {
+			sid := sids[(i*j)%len(sids)]
+			switch j % 3 {
+			case 0:
+				db.Release(sid)
+			case 1:
+				db.Acquire(sid, time.Hour)
+			case 2:
+				db.Set(sid, sessions.LifeTime{}, "name", "alice", false)
+				db.Visit(sid, func(string, interface{}) {})
+				db.Clear(sid)
+			}
+		}
+	})
+}
+
+
+func BenchmarkMemDBSetParallel(b *testing.B) {
+	db, sids := newTestMemDB(1024)
+	var next uint64
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&next, 1))
+		for pb.Next() {
+			db.Set(sids[i%len(sids)], sessions.LifeTime{}, "count", i, false)
+			i++
+		}
+	})
+}
+
+func BenchmarkMemDBGetParallel(b *testing.B) {
+	db, sids := newTestMemDB(1024)
+	for _, sid := range sids {
+		db.Set(sid, sessions.LifeTime{}, "name", sid, false)
+	}
+	var next uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&next, 1))
+		for pb.Next() {
+			db.Get(sids[i%len(sids)], "name")
+			i++
+		}
+	})
+}
+
+func BenchmarkMemDBVisitParallel(b *testing.B) {
+	db, sids := newTestMemDB(1024)
+	for _, sid := range sids {
+		for j := 0; j < 8; j++ {
+			db.Set(sid, sessions.LifeTime{}, fmt.Sprintf("key-%d", j), j, false)
+		}
+	}
+	var next uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&next, 1))
+		for pb.Next() {
+			db.Visit(sids[i%len(sids)], func(string, interface{}) {})
+			i++
+		}
+	})
+}
+
+func BenchmarkMemDBMixedParallel(b *testing.B) {
+	db, sids := newTestMemDB(1024)
+	var next uint64
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&next, 1))
+		for pb.Next() {
+			sid := sids[i%len(sids)]
+			switch i % 4 {
+			case 0:
+				db.Set(sid, sessions.LifeTime{}, "count", i, false)
+			case 1, 2:
+				db.Get(sid, "count")
+			case 3:
+				db.Delete(sid, "count")
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package jwt_sessions
+
+import (
+	"github.com/kataras/iris/context"
+	"github.com/kataras/iris/core/errors"
+)
+
+
+// Merging is intended for the anonymous-to-authenticated upgrade: a guest
+// fills some values (e.g. a cart) in a session and then signs in, when the
+// user may already have a session of their own. Both sessions are combined
+// into the user's one, and the guest session is destroyed.
+
+
+type (
+	// MergeFunc resolves the value to keep for a key which exists in both
+	// the source and the destination sessions. Returning nil removes the
+	// key from the destination session.
+	MergeFunc func(key string, source interface{}, destination interface{}) interface{}
+
+	// MergeStrategy tells how to merge each key when it exists in both
+	// sessions. Keys existing in only one of the sessions are always kept.
+	MergeStrategy struct {
+		// Per-key merge functions.
+		Keys map[string]MergeFunc
+		// The merge function for keys not listed in Keys.
+		// Default value: KeepDestination.
+		Default MergeFunc
+	}
+)
+
+
+// KeepSource is a MergeFunc keeping the value of the source session.
+func KeepSource(key string, source interface{}, destination interface{}) interface{} {
+	return source
+}
+
+// KeepDestination is a MergeFunc keeping the value of the destination session.
+func KeepDestination(key string, source interface{}, destination interface{}) interface{} {
+	return destination
+}
+
+func (strategy MergeStrategy) funcFor(key string) MergeFunc {
+	if fn, ok := strategy.Keys[key]; ok && fn != nil {
+		return fn
+	}
+	if strategy.Default != nil {
+		return strategy.Default
+	}
+	return KeepDestination
+}
+
+var errMergeSameSession = errors.New("cannot merge a session into itself")
+
+// Merge combines the values and flashes of the "from" session into the "into"
+// session according to the given strategy, destroys the "from" session and
+// issues the token for the "into" session (which is the surviving one).
+// Flashes of the "from" session are only copied when the key is not present
+// in the "into" session.
+func (sessions *JWTSessions) Merge(ctx context.Context, from *JWTSession, into *JWTSession, strategy MergeStrategy) error {
+	if from.sid == into.sid {
+		return errMergeSameSession
+	}
+
+	// collect first: not every database supports writing while visiting.
+	values := make(map[string]interface{})
+	from.Visit(func(key string, value interface{}) {
+		values[key] = value
+	})
+
+	for key, source := range values {
+		destination := into.Get(key)
+		if destination == nil {
+			into.Set(key, source)
+			continue
+		}
+
+		if merged := strategy.funcFor(key)(key, source, destination); merged == nil {
+			into.Delete(key)
+		} else {
+			into.Set(key, merged)
+		}
+	}
+
+	if from.HasFlash() {
+		into.ensureSaved()
+	}
+
+	// copy first: holding both locks at once would deadlock against
+	// a concurrent merge in the opposite direction.
+	from.mu.RLock()
+	flashes := make(map[string]flashMessage, len(from.flashes))
+	for key, fv := range from.flashes {
+		flashes[key] = *fv
+	}
+	from.mu.RUnlock()
+
+	into.mu.Lock()
+	for key, fv := range flashes {
+		if _, found := into.flashes[key]; !found {
+			into.flashes[key] = &flashMessage{shouldRemove: fv.shouldRemove, value: fv.value}
+		}
+	}
+	into.mu.Unlock()
+
+	sessions.provider.Destroy(from.sid, DestroyMerged)
+	ctx.Values().Set(sessionContextKey, into)
+	sessions.updateJWT(ctx, into.sid, sessions.config.Expires)
+	return nil
+}
@@ -0,0 +1,93 @@
+package jwt_sessions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeKeepsValuesByStrategy(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	guestContext := newTestContext("")
+	guest := sessions.Start(guestContext)
+	user := sessions.Start(newTestContext(""))
+	guest.Set("cart", 2)
+	guest.Set("theme", "dark")
+	guest.Set("coupon", "guest")
+	guest.SetFlash("notice", "welcome")
+	user.Set("cart", 1)
+	user.Set("coupon", "user")
+	user.Set("locale", "en")
+
+	ctx := newTestContext("")
+	err := sessions.Merge(ctx, guest, user, MergeStrategy{Keys: map[string]MergeFunc{"cart": KeepSource}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := user.Get("cart"); got != 2 {
+		t.Fatalf("cart: got %v, want 2", got)
+	}
+	if got := user.GetString("coupon"); got != "user" {
+		t.Fatalf("coupon: got %q, want the destination's", got)
+	}
+	if got := user.GetString("theme"); got != "dark" || user.GetString("locale") != "en" {
+		t.Fatalf("theme: got %q, want dark", got)
+	}
+	if got := user.GetFlash("notice"); got != "welcome" {
+		t.Fatalf("flash: got %v", got)
+	}
+	if sessions.Start(newTestContext(issuedToken(guestContext))).Get("cart") != nil {
+		t.Fatal("the merged session was not destroyed")
+	}
+	if got := sessions.Start(newTestContext(issuedToken(ctx))); got != user {
+		t.Fatal("the token issued is not the surviving session's")
+	}
+}
+
+func TestMergeFuncRemovingAKey(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	guest := sessions.Start(newTestContext(""))
+	user := sessions.Start(newTestContext(""))
+	guest.Set("cart", 2)
+	user.Set("cart", 1)
+
+	drop := func(string, interface{}, interface{}) interface{} { return nil }
+	if err := sessions.Merge(newTestContext(""), guest, user, MergeStrategy{Default: drop}); err != nil {
+		t.Fatal(err)
+	}
+	if user.Get("cart") != nil {
+		t.Fatal("the key was not removed")
+	}
+	if sessions.Merge(newTestContext(""), user, user, MergeStrategy{}) == nil {
+		t.Fatal("a session was merged into itself")
+	}
+}
+
+func TestMergeDoesNotHoldTheSourceWhileWaitingForTheDestination(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	a := sessions.Start(newTestContext(""))
+	b := sessions.Start(newTestContext(""))
+	a.SetFlash("a", 1)
+
+	// as a merge in the opposite direction does, while reading b.
+	b.mu.RLock()
+	merged := make(chan struct{})
+	go func() {
+		sessions.Merge(newTestContext(""), a, b, MergeStrategy{})
+		close(merged)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	locked := make(chan struct{})
+	go func() {
+		a.mu.Lock()
+		a.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("the merge holds the source while waiting for the destination")
+	}
+	b.mu.RUnlock()
+	waitFor(t, merged, 5*time.Second, "the merge")
+}
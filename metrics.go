@@ -0,0 +1,258 @@
+package jwt_sessions
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/kataras/iris/context"
+	"github.com/kataras/iris/sessions"
+)
+
+
+// The metrics (see `UseMetrics`) count the sessions created and destroyed
+// (by reason), the tokens issued and verified (by result), and time every
+// call to the session database, in histograms. They are exposed in the
+// Prometheus text exposition format (see `Metrics.Handler`), written here
+// without depending on a Prometheus client.
+
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the buckets
+// of the database latency histograms.
+var DefaultLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// the database operations, as labeled in the metrics.
+const (
+	opAcquire = iota
+	opUpdateExpiration
+	opSet
+	opGet
+	opVisit
+	opLen
+	opDelete
+	opClear
+	opRelease
+	databaseOps
+)
+
+var databaseOpNames = [databaseOps]string{
+	"acquire", "update_expiration", "set", "get", "visit", "len", "delete", "clear", "release",
+}
+
+// the destroy reasons have consecutive values from DestroyLogout.
+const destroyReasons = int(DestroyMerged) + 1
+
+
+type (
+	// Metrics are the counters, gauges and histograms of a sessions manager.
+	Metrics struct {
+		// the counters are accessed atomically, and kept first for
+		// their 64-bit alignment.
+		created        uint64
+		destroyed      [destroyReasons]uint64
+		tokensIssued   uint64
+		tokensValid    uint64
+		tokensRejected uint64
+
+		sessions  *JWTSessions
+		buckets   []float64
+		latencies [databaseOps]*histogram
+	}
+
+	// histogram counts observations (durations) in cumulative buckets.
+	histogram struct {
+		sum    int64 // in nanoseconds.
+		count  uint64
+		bounds []float64
+		counts []uint64 // one per bound, plus +Inf.
+	}
+
+	// metricsDB times the calls to a session database.
+	metricsDB struct {
+		inner   sessions.Database
+		metrics *Metrics
+	}
+)
+
+var _ sessions.Database = (*metricsDB)(nil)
+
+
+// UseMetrics starts collecting the metrics of this manager, and returns
+// them. The current database (and any later one) is timed.
+func (sessions *JWTSessions) UseMetrics() *Metrics {
+	metrics := &Metrics{sessions: sessions, buckets: DefaultLatencyBuckets}
+	for op := range metrics.latencies {
+		metrics.latencies[op] = newHistogram(metrics.buckets)
+	}
+
+	sessions.OnCreate(func(Event) { atomic.AddUint64(&metrics.created, 1) })
+	sessions.On(EventDestroy, func(event Event) {
+		if int(event.Reason) < destroyReasons {
+			atomic.AddUint64(&metrics.destroyed[event.Reason], 1)
+		}
+	})
+	sessions.OnTokenIssued(func(Event) { atomic.AddUint64(&metrics.tokensIssued, 1) })
+	sessions.provider.decorateDatabase(metrics.timed)
+	sessions.metrics = metrics
+	return metrics
+}
+
+// timed wraps a database, so its calls are timed.
+func (metrics *Metrics) timed(db sessions.Database) sessions.Database {
+	return &metricsDB{inner: db, metrics: metrics}
+}
+
+// verified counts a token verification.
+func (metrics *Metrics) verified(valid bool) {
+	if valid {
+		atomic.AddUint64(&metrics.tokensValid, 1)
+	} else {
+		atomic.AddUint64(&metrics.tokensRejected, 1)
+	}
+}
+
+// Handler returns an iris handler serving the metrics in the Prometheus
+// text exposition format.
+func (metrics *Metrics) Handler() context.Handler {
+	return func(ctx context.Context) {
+		ctx.ContentType("text/plain; version=0.0.4; charset=utf-8")
+		metrics.WriteTo(ctx)
+	}
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (metrics *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buffer bytes.Buffer
+	stats := metrics.sessions.Stats()
+
+	writeMetric(&buffer, "jwt_sessions_active", "gauge", "The sessions in memory.", "", float64(stats.Sessions))
+	writeMetric(&buffer, "jwt_sessions_spilled", "gauge", "The sessions spilled into the spill database.", "", float64(stats.Spilled))
+	writeMetric(&buffer, "jwt_sessions_memory_bytes", "gauge", "The approximate size of the values in memory.", "", float64(stats.Bytes))
+	writeMetric(&buffer, "jwt_sessions_evicted_total", "counter", "The sessions evicted from memory.", "", float64(stats.Evictions))
+	writeMetric(&buffer, "jwt_sessions_created_total", "counter", "The sessions created.", "", float64(atomic.LoadUint64(&metrics.created)))
+
+	writeHeader(&buffer, "jwt_sessions_destroyed_total", "counter", "The sessions destroyed, by reason.")
+	for reason := DestroyLogout; int(reason) < destroyReasons; reason++ {
+		labels := fmt.Sprintf(`{reason="%s"}`, reason)
+		writeSample(&buffer, "jwt_sessions_destroyed_total", labels, float64(atomic.LoadUint64(&metrics.destroyed[reason])))
+	}
+
+	writeMetric(&buffer, "jwt_sessions_tokens_issued_total", "counter", "The tokens issued.", "", float64(atomic.LoadUint64(&metrics.tokensIssued)))
+	writeHeader(&buffer, "jwt_sessions_token_verifications_total", "counter", "The tokens verified, by result.")
+	writeSample(&buffer, "jwt_sessions_token_verifications_total", `{result="valid"}`, float64(atomic.LoadUint64(&metrics.tokensValid)))
+	writeSample(&buffer, "jwt_sessions_token_verifications_total", `{result="rejected"}`, float64(atomic.LoadUint64(&metrics.tokensRejected)))
+
+	name := "jwt_sessions_db_operation_duration_seconds"
+	writeHeader(&buffer, name, "histogram", "The latency of the session database operations.")
+	for op, h := range metrics.latencies {
+		h.write(&buffer, name, databaseOpNames[op])
+	}
+
+	n, err := buffer.WriteTo(w)
+	return n, err
+}
+
+// observe times a database operation started at "start".
+func (metrics *Metrics) observe(op int, start time.Time) {
+	metrics.latencies[op].observe(time.Since(start))
+}
+
+
+func writeHeader(buffer *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(buffer *bytes.Buffer, name, labels string, value float64) {
+	fmt.Fprintf(buffer, "%s%s %s\n", name, labels, formatFloat(value))
+}
+
+func writeMetric(buffer *bytes.Buffer, name, kind, help, labels string, value float64) {
+	writeHeader(buffer, name, kind, help)
+	writeSample(buffer, name, labels, value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+	for i < len(h.bounds) && seconds > h.bounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddUint64(&h.count, 1)
+}
+
+// write writes the (cumulative) buckets, the sum and the count.
+func (h *histogram) write(buffer *bytes.Buffer, name, op string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		writeSample(buffer, name+"_bucket", fmt.Sprintf(`{op="%s",le="%s"}`, op, formatFloat(bound)), float64(cumulative))
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	writeSample(buffer, name+"_bucket", fmt.Sprintf(`{op="%s",le="+Inf"}`, op), float64(cumulative))
+	writeSample(buffer, name+"_sum", fmt.Sprintf(`{op="%s"}`, op), time.Duration(atomic.LoadInt64(&h.sum)).Seconds())
+	writeSample(buffer, name+"_count", fmt.Sprintf(`{op="%s"}`, op), float64(atomic.LoadUint64(&h.count)))
+}
+
+
+func (db *metricsDB) unwrap() sessions.Database {
+	return db.inner
+}
+
+func (db *metricsDB) Acquire(sid string, expires time.Duration) sessions.LifeTime {
+	defer db.metrics.observe(opAcquire, time.Now())
+	return db.inner.Acquire(sid, expires)
+}
+
+func (db *metricsDB) OnUpdateExpiration(sid string, newExpires time.Duration) error {
+	defer db.metrics.observe(opUpdateExpiration, time.Now())
+	return db.inner.OnUpdateExpiration(sid, newExpires)
+}
+
+func (db *metricsDB) Set(sid string, lifetime sessions.LifeTime, key string, value interface{}, immutable bool) {
+	defer db.metrics.observe(opSet, time.Now())
+	db.inner.Set(sid, lifetime, key, value, immutable)
+}
+
+func (db *metricsDB) Get(sid string, key string) interface{} {
+	defer db.metrics.observe(opGet, time.Now())
+	return db.inner.Get(sid, key)
+}
+
+func (db *metricsDB) Visit(sid string, cb func(key string, value interface{})) {
+	defer db.metrics.observe(opVisit, time.Now())
+	db.inner.Visit(sid, cb)
+}
+
+func (db *metricsDB) Len(sid string) int {
+	defer db.metrics.observe(opLen, time.Now())
+	return db.inner.Len(sid)
+}
+
+func (db *metricsDB) Delete(sid string, key string) bool {
+	defer db.metrics.observe(opDelete, time.Now())
+	return db.inner.Delete(sid, key)
+}
+
+func (db *metricsDB) Clear(sid string) {
+	defer db.metrics.observe(opClear, time.Now())
+	db.inner.Clear(sid)
+}
+
+func (db *metricsDB) Release(sid string) {
+	defer db.metrics.observe(opRelease, time.Now())
+	db.inner.Release(sid)
+}
@@ -0,0 +1,111 @@
+package jwt_sessions
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+// scrape reads the samples of the metrics' exposition, by name and labels.
+func scrape(t *testing.T, metrics *Metrics) map[string]float64 {
+	t.Helper()
+	var buffer bytes.Buffer
+	if _, err := metrics.WriteTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(&buffer)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		space := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[space+1:], 64)
+		if space < 0 || err != nil {
+			t.Fatalf("malformed sample: %q", line)
+		}
+		samples[line[:space]] = value
+	}
+	return samples
+}
+
+
+func TestMetricsCountTheSessionsTokensAndDatabaseCalls(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	metrics := sessions.UseMetrics()
+	before := scrape(t, metrics)
+
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	sess.Set("cart", 2)
+	sessions.Start(newTestContext(issuedToken(ctx)))
+	sessions.Start(newTestContext("Bearer not.a.token"))
+	sessions.DestroyByID(sess.ID())
+
+	after := scrape(t, metrics)
+	moved := map[string]float64{
+		"jwt_sessions_created_total":                                     2,
+		"jwt_sessions_tokens_issued_total":                               2,
+		`jwt_sessions_token_verifications_total{result="valid"}`:         1,
+		`jwt_sessions_token_verifications_total{result="rejected"}`:      1,
+		`jwt_sessions_destroyed_total{reason="revoked"}`:                 1,
+		`jwt_sessions_destroyed_total{reason="logout"}`:                  0,
+		`jwt_sessions_db_operation_duration_seconds_count{op="release"}`: 1,
+	}
+	for sample, want := range moved {
+		if got := after[sample] - before[sample]; got != want {
+			t.Errorf("%s moved by %v, want %v", sample, got, want)
+		}
+	}
+	if after["jwt_sessions_active"] != 1 {
+		t.Errorf("got %v active sessions, want 1", after["jwt_sessions_active"])
+	}
+
+	for _, op := range []string{"acquire", "set", "len"} {
+		count := after[`jwt_sessions_db_operation_duration_seconds_count{op="`+op+`"}`]
+		inf := after[`jwt_sessions_db_operation_duration_seconds_bucket{op="`+op+`",le="+Inf"}`]
+		if count == 0 || inf != count {
+			t.Errorf("%s: got %v calls, and %v in the +Inf bucket", op, count, inf)
+		}
+	}
+}
+
+func TestMetricsTimeTheDatabasesRegisteredLater(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	metrics := sessions.UseMetrics()
+	sessions.UseDatabase(NewMemDB())
+
+	sessions.Start(newTestContext("")).Set("cart", 2)
+	if got := scrape(t, metrics)[`jwt_sessions_db_operation_duration_seconds_count{op="set"}`]; got != 1 {
+		t.Fatalf("got %v timed sets, want 1", got)
+	}
+	if _, ok := unwrapDatabase(sessions.provider.db).(*MemDB); !ok {
+		t.Fatal("the timed database does not unwrap")
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogram([]float64{0.001, 0.01})
+	h.observe(500 * time.Microsecond)
+	h.observe(5 * time.Millisecond)
+	h.observe(time.Second)
+
+	var buffer bytes.Buffer
+	h.write(&buffer, "latency", "get")
+	want := strings.Join([]string{
+		`latency_bucket{op="get",le="0.001"} 1`,
+		`latency_bucket{op="get",le="0.01"} 2`,
+		`latency_bucket{op="get",le="+Inf"} 3`,
+		`latency_sum{op="get"} 1.0055`,
+		`latency_count{op="get"} 3`,
+	}, "\n") + "\n"
+	if got := buffer.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
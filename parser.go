@@ -22,16 +22,49 @@ type JWTParser struct {
 	// Important to avoid security issues described here: https://auth0.com/blog/2015/03/31/critical-vulnerabilities-in-json-web-token-libraries/
 	// Default: nil
 	SigningMethod jwt.SigningMethod
+	// When set, the verified tokens are cached, so a token sent again skips
+	// the signature check (see TokenCache).
+	// Default: nil
+	Cache *TokenCache
+	// The tracer of the tokens parsed and serialized (see Tracer).
+	// Default: NoopTracer
+	Tracer Tracer
 }
 
 
 // Parses a JWT token from a context.
 func (jwtParser *JWTParser) Parse(token string) (*jwt.Token, error) {
+	span := jwtParser.tracer().StartSpan("token.parse")
+	defer span.End()
+	parsedToken, err := jwtParser.parse(token)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+	}
+	return parsedToken, err
+}
+
+// parse parses and verifies a token, unless cached.
+func (jwtParser *JWTParser) parse(token string) (*jwt.Token, error) {
 	// Extracts the token, and catch any error.
 	if token == "" {
 		return nil, nil
 	} else {
-		if parsedToken, err := jwt.ParseWithClaims(token, jwt.MapClaims{}, jwtParser.ValidationKeyGetter); err != nil {
+		// Reuse the cached verification, if any.
+		if jwtParser.Cache != nil {
+			if cachedToken, found := jwtParser.Cache.get(token, jwtParser.ValidationKeyGetter); found {
+				return cachedToken, nil
+			}
+		}
+
+		// Remember the verification key, for the cache.
+		var key interface{}
+		keyGetter := func(token *jwt.Token) (interface{}, error) {
+			var err error
+			key, err = jwtParser.ValidationKeyGetter(token)
+			return key, err
+		}
+
+		if parsedToken, err := jwt.ParseWithClaims(token, jwt.MapClaims{}, keyGetter); err != nil {
 			return nil, fmt.Errorf("error parsing token: %v", err)
 		} else {
 			// Check if the signing algorithm is the one we use.
@@ -49,7 +82,10 @@ func (jwtParser *JWTParser) Parse(token string) (*jwt.Token, error) {
 				return nil, fmt.Errorf("token is invalid")
 			}
 
-			// Finally return the token.
+			// Finally cache and return the token.
+			if jwtParser.Cache != nil {
+				jwtParser.Cache.put(parsedToken, key)
+			}
 			return parsedToken, nil
 		}
 	}
@@ -58,6 +94,16 @@ func (jwtParser *JWTParser) Parse(token string) (*jwt.Token, error) {
 
 // Serializes a key
 func (jwtParser *JWTParser) Serialize(token *jwt.Token) (string, error) {
+	span := jwtParser.tracer().StartSpan("token.serialize")
+	defer span.End()
+	serialized, err := jwtParser.serialize(token)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+	}
+	return serialized, err
+}
+
+func (jwtParser *JWTParser) serialize(token *jwt.Token) (string, error) {
 	if key, err := jwtParser.SigningKeyGetter(token); err != nil || key == nil {
 		return "", err
 	} else {
@@ -79,4 +125,12 @@ func (jwtParser JWTParser) Validate() JWTParser {
 		}
 	}
 	return jwtParser
-}
\ No newline at end of file
+}
+
+// tracer returns the parser's tracer, if any, or the no-op one.
+func (jwtParser *JWTParser) tracer() Tracer {
+	if jwtParser.Tracer == nil {
+		return NoopTracer
+	}
+	return jwtParser.Tracer
+}
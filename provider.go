@@ -4,6 +4,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/iris-contrib/go.uuid"
 	"github.com/kataras/iris/core/errors"
 	"github.com/kataras/iris/sessions"
 )
@@ -19,70 +21,213 @@ type (
 	// provider contains the sessions and external databases (load and update).
 	// It's the session memory manager
 	provider struct {
-		// we don't use RWMutex because all actions have read and write at the same action function.
-		// (or write to a *JWTSession's value which is race if we don't lock)
-		// narrow locks are fasters but are useless here.
-		mu               sync.Mutex
-		sessions         map[string]*JWTSession
-		db               sessions.Database
-		destroyListeners []sessions.DestroyListener
+		// the number of sessions in memory, and the approximate size of their
+		// values, over all the shards (see limits.go). They are accessed
+		// atomically, and kept first for their 64-bit alignment.
+		count int64
+		bytes int64
+
+		// mu guards the database and the bus: the sessions are guarded by
+		// the lock of their shard (see shard.go).
+		mu                     sync.Mutex
+		shards                 []*providerShard
+		db                     sessions.Database
+		// the decorators wrapping every database (see UseMetrics).
+		decorators             []func(sessions.Database) sessions.Database
+		config                 *Config
+		authorization          *Authorization
+		destroyListeners       []sessions.DestroyListener
+		regenerateListeners    []RegenerateListener
+		impersonationListeners []ImpersonationListener
+		evictionListeners      []EvictionListener
+		eventListeners         [eventKinds][]EventListener
+		// the expiration of the sessions (see expiry.go).
+		expiry *expiryScheduler
+		// the invalidation bus, if any, and this instance's ID on it.
+		bus    InvalidationBus
+		origin string
 	}
+
+	// RegenerateListener is fired when a session has been moved to a new ID
+	// (see `JWTSessions.Regenerate`). It receives both the old and the new ID.
+	RegenerateListener func(oldID string, newID string)
 )
 
 // newProvider returns a new sessions provider
-func newProvider() *provider {
-	return &provider{
-		sessions: make(map[string]*JWTSession, 0),
-		db:       NewMemDB(),
+func newProvider(config *Config) *provider {
+	origin, _ := uuid.NewV4()
+	p := &provider{
+		shards:        newProviderShards(config.Shards),
+		db:            newShardedMemDB(config.Shards),
+		config:        config,
+		authorization: &config.Authorization,
+		origin:        origin.String(),
 	}
+	p.expiry = newExpiryScheduler(p.expire)
+	return p
 }
 
 // RegisterDatabase sets a session database.
 func (p *provider) RegisterDatabase(db sessions.Database) {
 	p.mu.Lock() // for any case
+	for _, decorator := range p.decorators {
+		db = decorator(db)
+	}
 	p.db = db
 	p.mu.Unlock()
 }
 
+// decorateDatabase wraps the current database, and the ones registered later.
+func (p *provider) decorateDatabase(decorator func(sessions.Database) sessions.Database) {
+	p.mu.Lock()
+	p.decorators = append(p.decorators, decorator)
+	p.db = decorator(p.db)
+	p.mu.Unlock()
+}
+
+// unwrapDatabase returns the database wrapped by the decorators, if any.
+func unwrapDatabase(db sessions.Database) sessions.Database {
+	for {
+		wrapper, ok := db.(interface{ unwrap() sessions.Database })
+		if !ok {
+			return db
+		}
+		db = wrapper.unwrap()
+	}
+}
+
+// RegisterInvalidationBus sets the bus the changes to the sessions are
+// published to, and subscribes to the changes made by other instances.
+func (p *provider) RegisterInvalidationBus(bus InvalidationBus) {
+	p.mu.Lock()
+	p.bus = bus
+	p.mu.Unlock()
+	bus.Subscribe(p.handleInvalidation)
+}
+
+// publish broadcasts a change made by this instance, if there is a bus.
+func (p *provider) publish(event InvalidationEvent) {
+	p.mu.Lock()
+	bus := p.bus
+	p.mu.Unlock()
+
+	if bus != nil {
+		event.Origin = p.origin
+		bus.Publish(event)
+	}
+}
+
+// handleInvalidation applies a change made by another instance to the local
+// copy of the session(s). Only the listeners of the sessions this instance
+// had loaded are fired, so they are not fired once per instance.
+func (p *provider) handleInvalidation(event InvalidationEvent) {
+	if event.Origin == p.origin {
+		return
+	}
+
+	switch event.Kind {
+	case InvalidateDestroy:
+		p.destroy(event.SessionID, event.Reason)
+	case InvalidateDestroyAll:
+		p.destroyAll(DestroyAdmin)
+	case InvalidateRegenerate:
+		// the values were already moved: only the local copy is evicted.
+		sh := p.shard(event.SessionID)
+		sh.mu.Lock()
+		sess, found := sh.sessions[event.SessionID]
+		if found {
+			p.unschedule(sess)
+			p.untrack(sess)
+		}
+		sh.mu.Unlock()
+		if found {
+			sess.mu.RLock()
+			claims := sess.claims
+			sess.mu.RUnlock()
+			p.fireDestroy(event.SessionID)
+			p.fireDestroyEvents(event.SessionID, claims, DestroyRegenerated, nil)
+			p.fireRegenerate(event.SessionID, event.NewSessionID)
+			p.fireSessionEvent(sess, Event{Kind: EventRegenerate, NewSessionID: event.NewSessionID})
+		}
+	case InvalidateExpiration:
+		if sess, found := p.find(event.SessionID); found {
+			p.shift(sess, event.Expires)
+		}
+	}
+}
+
 // newSession returns a new session from sessionid
 func (p *provider) newSession(sid string, expires time.Duration) *JWTSession {
-	onExpire := func() {
-		p.Destroy(sid)
+	return &JWTSession{
+		sid:      sid,
+		provider: p,
+		flashes:  make(map[string]*flashMessage),
+		Lifetime: p.acquire(sid, expires),
+	}
+}
+
+// newUnsavedSession returns a new session from sessionid which has no storage yet.
+// The "save" callback will be invoked, once, when something is written into it.
+func (p *provider) newUnsavedSession(sid string, save func()) *JWTSession {
+	return &JWTSession{
+		sid:      sid,
+		isNew:    true,
+		unsaved:  true,
+		save:     save,
+		provider: p,
+		flashes:  make(map[string]*flashMessage),
 	}
+}
+
+// Save acquires the storage of an unsaved session and registers it.
+func (p *provider) Save(sess *JWTSession, expires time.Duration) {
+	lifetime := p.acquire(sess.sid, expires)
+
+	sess.mu.Lock()
+	sess.Lifetime = lifetime
+	sess.unsaved = false
+	sess.mu.Unlock()
 
+	sh := p.shard(sess.sid)
+	sh.mu.Lock()
+	p.track(sess)
+	sh.mu.Unlock()
+	p.enforceLimits(sess)
+}
+
+// acquire reserves the storage of a session and schedules its expiration.
+func (p *provider) acquire(sid string, expires time.Duration) sessions.LifeTime {
 	lifetime := p.db.Acquire(sid, expires)
 
 	// simple and straight:
 	if !lifetime.IsZero() {
 		// if stored time is not zero
-		// start a timer based on the stored time, if not expired.
-		lifetime.Revive(onExpire)
-	} else {
+		// schedule the expiration at the stored time, if not expired.
+		if lifetime.After(time.Now()) {
+			p.expiry.Schedule(sid, lifetime.Time)
+		}
+	} else if expires > 0 {
 		// Remember:  if db not exist or it has been expired
 		// then the stored time will be zero(see loadSessionFromDB) and the values will be empty.
 		//
 		// Even if the database has an unlimited session (possible by a previous app run)
 		// priority to the "expires" is given,
 		// again if <=0 then it does nothing.
-		lifetime.Begin(expires, onExpire)
+		lifetime.Time = time.Now().Add(expires)
+		p.expiry.Schedule(sid, lifetime.Time)
 	}
 
-	sess := &JWTSession{
-		sid:      sid,
-		provider: p,
-		flashes:  make(map[string]*flashMessage),
-		Lifetime: lifetime,
-	}
-
-	return sess
+	return lifetime
 }
 
 // Init creates the session  and returns it
 func (p *provider) Init(sid string, expires time.Duration) *JWTSession {
 	newSession := p.newSession(sid, expires)
-	p.mu.Lock()
-	p.sessions[sid] = newSession
-	p.mu.Unlock()
+	sh := p.shard(sid)
+	sh.mu.Lock()
+	p.track(newSession)
+	sh.mu.Unlock()
+	p.enforceLimits(newSession)
 	return newSession
 }
 
@@ -90,6 +235,66 @@ func (p *provider) Init(sid string, expires time.Duration) *JWTSession {
 // It can be matched directly, i.e: `isErrNotFound := sessions.ErrNotFound.Equal(err)`.
 var ErrNotFound = errors.New("not found")
 
+// ErrSessionIDInUse is returned when regenerating a session and the generated ID
+// already belongs to a different, live, session.
+var ErrSessionIDInUse = errors.New("session id already in use")
+
+// Regenerate moves the values, flashes and lifetime of the "old" session into a
+// brand new session with the "sid" identifier, and destroys the old one.
+// If the old session had an expiration time, the new one keeps what remains of it.
+func (p *provider) Regenerate(old *JWTSession, sid string, expires time.Duration) (*JWTSession, error) {
+	if _, found := p.find(sid); found || sid == old.sid {
+		return nil, ErrSessionIDInUse
+	}
+
+	if lifetime := old.lifetime(); !lifetime.IsZero() {
+		if remaining := lifetime.DurationUntilExpiration(); remaining > 0 {
+			expires = remaining
+		}
+	}
+
+	// collect first: not every database supports writing while visiting.
+	values := make(map[string]interface{})
+	old.Visit(func(key string, value interface{}) {
+		values[key] = value
+	})
+
+	sess := p.newSession(sid, expires)
+	for key, value := range values {
+		p.db.Set(sid, sess.Lifetime, key, value, false)
+	}
+
+	old.mu.RLock()
+	for key, fv := range old.flashes {
+		sess.flashes[key] = &flashMessage{shouldRemove: fv.shouldRemove, value: fv.value}
+	}
+	sess.isNew = old.isNew
+	old.mu.RUnlock()
+
+	sh := p.shard(sid)
+	sh.mu.Lock()
+	p.track(sess)
+	p.measure(sess, values)
+	sh.mu.Unlock()
+
+	var notify func()
+	sh = p.shard(old.sid)
+	sh.mu.Lock()
+	if current, found := sh.sessions[old.sid]; found && current == old {
+		notify = p.deleteSession(old, DestroyRegenerated)
+	}
+	sh.mu.Unlock()
+	if notify != nil {
+		notify()
+	}
+	p.enforceLimits(sess)
+
+	p.fireRegenerate(old.sid, sid)
+	p.fireSessionEvent(old, Event{Kind: EventRegenerate, NewSessionID: sid})
+	p.publish(InvalidationEvent{Kind: InvalidateRegenerate, SessionID: old.sid, NewSessionID: sid})
+	return sess, nil
+}
+
 // UpdateExpiration resets the expiration of a session.
 // if expires > 0 then it will try to update the expiration and destroy task is delayed.
 // if expires <= 0 then it does nothing it returns nil, to destroy a session call the `Destroy` func instead.
@@ -103,29 +308,59 @@ func (p *provider) UpdateExpiration(sid string, expires time.Duration) error {
 		return nil
 	}
 
-	p.mu.Lock()
-	sess, found := p.sessions[sid]
-	p.mu.Unlock()
+	sess, found := p.find(sid)
 	if !found {
 		return ErrNotFound
 	}
 
-	sess.Lifetime.Shift(expires)
+	p.shift(sess, expires)
+	p.publish(InvalidationEvent{Kind: InvalidateExpiration, SessionID: sid, Expires: expires})
 	return p.db.OnUpdateExpiration(sid, expires)
 }
 
 // Read returns the store which sid parameter belongs
 func (p *provider) Read(sid string, expires time.Duration) *JWTSession {
-	p.mu.Lock()
-	if sess, found := p.sessions[sid]; found {
+	sh := p.shard(sid)
+	sh.mu.Lock()
+	if sess, found := sh.sessions[sid]; found {
 		sess.runFlashGC() // run the flash messages GC, new request here of existing session
-		p.mu.Unlock()
+		sh.stats.Hits++
+		p.touch(sess)
+		sh.mu.Unlock()
 
 		return sess
 	}
-	p.mu.Unlock()
+	sh.stats.Misses++
+	sh.mu.Unlock()
 
-	return p.Init(sid, expires) // if not found create new
+	sess, restored := p.restore(sid, expires)
+	if !restored {
+		sess = p.Init(sid, expires) // if not found create new
+		sess.isNew = p.db.Len(sid) == 0
+		if p.config.MaxBytes > 0 && !sess.isNew {
+			values := make(map[string]interface{})
+			p.db.Visit(sid, func(key string, value interface{}) {
+				values[key] = value
+			})
+			p.remeasure(sess, values)
+		}
+		if sess.isNew {
+			p.fireSessionEvent(sess, Event{Kind: EventCreate})
+		}
+	}
+	if impersonation, ok := p.db.Get(sid, impersonationKey).(Impersonation); ok {
+		sess.impersonation = &impersonation
+	}
+	return sess
+}
+
+// find returns a live session by its ID.
+func (p *provider) find(sid string) (*JWTSession, bool) {
+	sh := p.shard(sid)
+	sh.mu.Lock()
+	sess, found := sh.sessions[sid]
+	sh.mu.Unlock()
+	return sess, found
 }
 
 func (p *provider) registerDestroyListener(ln sessions.DestroyListener) {
@@ -141,32 +376,122 @@ func (p *provider) fireDestroy(sid string) {
 	}
 }
 
+func (p *provider) registerRegenerateListener(ln RegenerateListener) {
+	if ln == nil {
+		return
+	}
+	p.regenerateListeners = append(p.regenerateListeners, ln)
+}
+
+func (p *provider) fireRegenerate(oldID string, newID string) {
+	for _, ln := range p.regenerateListeners {
+		ln(oldID, newID)
+	}
+}
+
+func (p *provider) registerImpersonationListener(ln ImpersonationListener) {
+	if ln == nil {
+		return
+	}
+	p.impersonationListeners = append(p.impersonationListeners, ln)
+}
+
+func (p *provider) fireImpersonation(event ImpersonationEvent) {
+	for _, ln := range p.impersonationListeners {
+		ln(event)
+	}
+}
+
 // Destroy destroys the session, removes all sessions and flash values,
 // the session itself and updates the registered session databases,
 // this called from sessionManager which removes the client's cookie also.
-func (p *provider) Destroy(sid string) {
-	p.mu.Lock()
-	if sess, found := p.sessions[sid]; found {
-		p.deleteSession(sess)
+// The reason is told to the destroy event listeners.
+func (p *provider) Destroy(sid string, reason DestroyReason) {
+	p.destroy(sid, reason)
+	p.publish(InvalidationEvent{Kind: InvalidateDestroy, SessionID: sid, Reason: reason})
+}
+
+// destroy destroys a session of this instance, in memory or spilled.
+func (p *provider) destroy(sid string, reason DestroyReason) {
+	var notify func()
+	sh := p.shard(sid)
+	sh.mu.Lock()
+	p.waitMoved(sh, sid)
+	if sess, found := sh.sessions[sid]; found {
+		notify = p.deleteSession(sess, reason)
+	}
+	expiresAt, spilled := p.forgetSpilled(sh, sid)
+	sh.mu.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+	if spilled {
+		p.releaseSpilled(sid, expiresAt, reason)()
 	}
-	p.mu.Unlock()
 }
 
 // DestroyAll removes all sessions
 // from the server-side memory (and database if registered).
 // Client's session cookie will still exist but it will be reseted on the next request.
 func (p *provider) DestroyAll() {
-	p.mu.Lock()
-	for _, sess := range p.sessions {
-		p.deleteSession(sess)
+	p.destroyAll(DestroyAdmin)
+	p.publish(InvalidationEvent{Kind: InvalidateDestroyAll})
+}
+
+// destroyAll destroys all the sessions of this instance, one shard at a time.
+func (p *provider) destroyAll(reason DestroyReason) {
+	for _, sh := range p.shards {
+		var pending notifications
+		sh.mu.Lock()
+		p.waitAllMoved(sh)
+		for _, sess := range sh.sessions {
+			pending = append(pending, p.deleteSession(sess, reason))
+		}
+		for sid, expiresAt := range sh.spilled {
+			delete(sh.spilled, sid)
+			pending = append(pending, p.releaseSpilled(sid, expiresAt, reason))
+		}
+		sh.mu.Unlock()
+		pending.fire()
 	}
-	p.mu.Unlock()
 }
 
-func (p *provider) deleteSession(sess *JWTSession) {
-	sid := sess.sid
+// notifications are what is left to do for the sessions destroyed or
+// evicted while a shard's lock was held: the listeners, which may call back
+// into the provider, and moving values into the spill database. They are
+// done once it is released.
+type notifications []func()
 
-	delete(p.sessions, sid)
-	p.db.Release(sid)
-	p.fireDestroy(sid)
+func (pending notifications) fire() {
+	for _, notify := range pending {
+		notify()
+	}
+}
+
+// deleteSession removes a session from memory and from the database,
+// returning the notification of the destroy listeners, the event ones
+// being told the reason. The lock of the session's shard must be held,
+// and released before notifying.
+func (p *provider) deleteSession(sess *JWTSession, reason DestroyReason) func() {
+	sess.mu.RLock()
+	claims, expiresAt := sess.claims, sess.Lifetime.Time
+	sess.mu.RUnlock()
+
+	p.unschedule(sess)
+	p.untrack(sess)
+	return p.releaseDestroyed(p.db, sess.sid, claims, expiresAt, reason)
+}
+
+// releaseDestroyed releases the values of a destroyed session from a
+// database (the session's or the spill one), returning the notification
+// of the destroy listeners. The snapshot for the destroy event listeners,
+// if any, is taken first.
+func (p *provider) releaseDestroyed(db sessions.Database, sid string, claims jwt.MapClaims, expiresAt time.Time, reason DestroyReason) func() {
+	snapshot := p.snapshot(db, sid, expiresAt, reason)
+	db.Release(sid)
+	return func() {
+		p.fireDestroy(sid)
+		p.fireDestroyEvents(sid, claims, reason, snapshot)
+	}
 }
@@ -0,0 +1,372 @@
+package jwt_sessions
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/core/errors"
+	"github.com/kataras/iris/sessions"
+)
+
+
+// RedisDB is a session database speaking the Redis protocol (RESP) directly,
+// so sessions can be shared among several application instances. Each session
+// is a hash, whose native TTL is the session's expiration time. Connections are
+// pooled, and the commands of a single operation are pipelined.
+
+
+// DefaultRedisPoolSize is the default number of idle connections kept in the pool.
+var DefaultRedisPoolSize = 10
+
+var errRedisReply = errors.New("unexpected redis reply: %v")
+
+
+type (
+	// RedisDBOptions configures a RedisDB.
+	RedisDBOptions struct {
+		// The network and address of the server.
+		// Default values: "tcp" and "127.0.0.1:6379".
+		Network string
+		Addr    string
+		// The password to AUTH with, if any.
+		Password string
+		// The database to SELECT.
+		Database int
+		// The prefix of the session keys. Default value: "sessions:".
+		Prefix string
+		// The number of idle connections kept in the pool.
+		// Default value: DefaultRedisPoolSize.
+		PoolSize int
+		// The timeout for dialing, and for each operation.
+		// Default value: 30 seconds.
+		Timeout time.Duration
+		// Dial, if set, replaces the default dialer.
+		Dial func(network string, addr string) (net.Conn, error)
+	}
+
+	// RedisDB is the Redis session database. See NewRedisDB.
+	RedisDB struct {
+		options RedisDBOptions
+		idle    chan *redisConn
+		mu      sync.Mutex
+		err     error
+	}
+
+	redisConn struct {
+		conn   net.Conn
+		reader *bufio.Reader
+		writer *bufio.Writer
+	}
+
+	// redisError is an error reply ("-ERR ...") from the server.
+	redisError string
+)
+
+var _ sessions.Database = (*RedisDB)(nil)
+
+func (err redisError) Error() string { return string(err) }
+
+
+// NewRedisDB returns a session database for the given server. Connections
+// are established on demand.
+func NewRedisDB(options RedisDBOptions) *RedisDB {
+	if options.Network == "" {
+		options.Network = "tcp"
+	}
+	if options.Addr == "" {
+		options.Addr = "127.0.0.1:6379"
+	}
+	if options.Prefix == "" {
+		options.Prefix = "sessions:"
+	}
+	if options.PoolSize <= 0 {
+		options.PoolSize = DefaultRedisPoolSize
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 30 * time.Second
+	}
+	if options.Dial == nil {
+		timeout := options.Timeout
+		options.Dial = func(network string, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, timeout)
+		}
+	}
+
+	return &RedisDB{options: options, idle: make(chan *redisConn, options.PoolSize)}
+}
+
+// writeCommand writes a command as a RESP array of bulk strings.
+func (c *redisConn) writeCommand(args ...interface{}) error {
+	fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var bulk []byte
+		switch v := arg.(type) {
+		case []byte:
+			bulk = v
+		case string:
+			bulk = []byte(v)
+		case int:
+			bulk = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			bulk = strconv.AppendInt(nil, v, 10)
+		default:
+			bulk = []byte(fmt.Sprint(v))
+		}
+		fmt.Fprintf(c.writer, "$%d\r\n", len(bulk))
+		c.writer.Write(bulk)
+		if _, err := c.writer.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readReply reads a RESP reply: a string, an int64, a []byte (nil
+// for the null bulk string), a []interface{} or a redisError.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRedisReply.Format(line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return redisError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return []byte(nil), err
+		}
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, bulk); err != nil {
+			return nil, err
+		}
+		return bulk[:size], nil
+	case '*':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return []interface{}(nil), err
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errRedisReply.Format(line)
+}
+
+// get takes an idle connection, or dials a new one.
+func (db *RedisDB) get() (*redisConn, error) {
+	select {
+	case c := <-db.idle:
+		return c, nil
+	default:
+	}
+
+	conn, err := db.options.Dial(db.options.Network, db.options.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+
+	var setup [][]interface{}
+	if db.options.Password != "" {
+		setup = append(setup, []interface{}{"AUTH", db.options.Password})
+	}
+	if db.options.Database != 0 {
+		setup = append(setup, []interface{}{"SELECT", db.options.Database})
+	}
+	if len(setup) > 0 {
+		if _, err := db.roundTrip(c, setup); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// put returns a connection to the pool, or closes it if the pool is full.
+func (db *RedisDB) put(c *redisConn) {
+	select {
+	case db.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// roundTrip sends all the commands at once, then reads all their replies.
+func (db *RedisDB) roundTrip(c *redisConn, commands [][]interface{}) ([]interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(db.options.Timeout))
+	for _, command := range commands {
+		if err := c.writeCommand(command...); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(commands))
+	var replyErr error
+	for i := range commands {
+		reply, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := reply.(redisError); ok && replyErr == nil {
+			replyErr = e
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+// Pipeline sends the commands in a single round trip and returns their
+// replies. The first error reply, if any, is returned as the error.
+func (db *RedisDB) Pipeline(commands ...[]interface{}) ([]interface{}, error) {
+	c, err := db.get()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := db.roundTrip(c, commands)
+	if _, isReply := err.(redisError); err != nil && !isReply {
+		// the connection state is unknown: do not reuse it.
+		c.conn.Close()
+		return nil, err
+	}
+	db.put(c)
+	return replies, err
+}
+
+// do sends a single command, keeping any error.
+func (db *RedisDB) do(args ...interface{}) interface{} {
+	replies, err := db.Pipeline(args)
+	if err != nil {
+		db.fail(err)
+		return nil
+	}
+	return replies[0]
+}
+
+func (db *RedisDB) fail(err error) {
+	if err != nil {
+		db.mu.Lock()
+		db.err = err
+		db.mu.Unlock()
+	}
+}
+
+// Err returns the last error talking to the server, if any.
+func (db *RedisDB) Err() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.err
+}
+
+func (db *RedisDB) key(sid string) string {
+	return db.options.Prefix + sid
+}
+
+// Acquire receives a session's lifetime from the server's TTL. A new (or
+// empty) session does not exist in the server until a value is set.
+func (db *RedisDB) Acquire(sid string, expires time.Duration) sessions.LifeTime {
+	if ttl, ok := db.do("PTTL", db.key(sid)).(int64); ok && ttl > 0 {
+		return sessions.LifeTime{Time: time.Now().Add(time.Duration(ttl) * time.Millisecond)}
+	}
+	return sessions.LifeTime{}
+}
+
+// OnUpdateExpiration changes the server's TTL of the session.
+func (db *RedisDB) OnUpdateExpiration(sid string, newExpires time.Duration) error {
+	_, err := db.Pipeline([]interface{}{"PEXPIRE", db.key(sid), int64(newExpires / time.Millisecond)})
+	return err
+}
+
+// Set stores a value, setting the session's TTL from the lifetime,
+// in a single round trip. The "immutable" flag is not supported.
+func (db *RedisDB) Set(sid string, lifetime sessions.LifeTime, key string, value interface{}, immutable bool) {
+	encoded, err := encodeStoredValue(value)
+	if err != nil {
+		db.fail(err)
+		return
+	}
+
+	commands := [][]interface{}{{"HSET", db.key(sid), key, encoded}}
+	if !lifetime.IsZero() {
+		commands = append(commands, []interface{}{"PEXPIREAT", db.key(sid), lifetime.UnixNano() / int64(time.Millisecond)})
+	}
+	_, err = db.Pipeline(commands...)
+	db.fail(err)
+}
+
+// Get retrieves a value, or nil if it is not found.
+func (db *RedisDB) Get(sid string, key string) interface{} {
+	encoded, _ := db.do("HGET", db.key(sid), key).([]byte)
+	return decodeStoredValue(encoded)
+}
+
+// Visit loops through all the session's keys and values.
+func (db *RedisDB) Visit(sid string, cb func(key string, value interface{})) {
+	items, _ := db.do("HGETALL", db.key(sid)).([]interface{})
+	for i := 0; i+1 < len(items); i += 2 {
+		key, _ := items[i].([]byte)
+		encoded, _ := items[i+1].([]byte)
+		cb(string(key), decodeStoredValue(encoded))
+	}
+}
+
+// Len returns the number of the session's keys.
+func (db *RedisDB) Len(sid string) int {
+	n, _ := db.do("HLEN", db.key(sid)).(int64)
+	return int(n)
+}
+
+// Delete removes a key of the session, in a single round trip (like `Set`).
+func (db *RedisDB) Delete(sid string, key string) bool {
+	replies, err := db.Pipeline([]interface{}{"HDEL", db.key(sid), key})
+	if err != nil {
+		db.fail(err)
+		return false
+	}
+	n, _ := replies[0].(int64)
+	return n > 0
+}
+
+// Clear removes all the keys of the session.
+func (db *RedisDB) Clear(sid string) {
+	db.do("DEL", db.key(sid))
+}
+
+// Release removes the session.
+func (db *RedisDB) Release(sid string) {
+	db.do("DEL", db.key(sid))
+}
+
+// Close closes the idle connections.
+func (db *RedisDB) Close() error {
+	for {
+		select {
+		case c := <-db.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
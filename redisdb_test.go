@@ -0,0 +1,174 @@
+package jwt_sessions
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/sessions"
+	"github.com/universe-10th/iris-jwt-sessions/redistest"
+)
+
+
+// countingConn counts the writes to a connection: one per round trip,
+// since the commands of a round trip are flushed at once.
+type countingConn struct {
+	net.Conn
+	writes *int64
+}
+
+func (conn countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(conn.writes, 1)
+	return conn.Conn.Write(p)
+}
+
+// newTestRedisDB returns a database over a new fake server, and the
+// counter of its round trips.
+func newTestRedisDB(t *testing.T) (*RedisDB, *redistest.Server, *int64) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrips := new(int64)
+	db := NewRedisDB(RedisDBOptions{
+		Addr:     server.Addr(),
+		Password: "secret",
+		Database: 1,
+		Dial: func(network string, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return countingConn{Conn: conn, writes: roundTrips}, err
+		},
+	})
+	return db, server, roundTrips
+}
+
+// sessionsLifeTime returns a lifetime ending in d.
+func sessionsLifeTime(d time.Duration) sessions.LifeTime {
+	return sessions.LifeTime{Time: time.Now().Add(d)}
+}
+
+
+func TestRedisDBStoresValues(t *testing.T) {
+	db, server, _ := newTestRedisDB(t)
+	defer server.Close()
+	defer db.Close()
+
+	lifetime := sessionsLifeTime(time.Hour)
+	db.Set("a", lifetime, "count", 2.0, false)
+	db.Set("a", lifetime, "name", "alice", false)
+	if got := db.Get("a", "count"); got != 2.0 {
+		t.Fatalf("count: got %#v, want 2", got)
+	}
+	if got := db.Get("a", "name"); got != "alice" {
+		t.Fatalf("name: got %#v, want alice", got)
+	}
+	visited := make(map[string]interface{})
+	db.Visit("a", func(key string, value interface{}) { visited[key] = value })
+	if db.Len("a") != 2 || len(visited) != 2 || visited["count"] != 2.0 {
+		t.Fatalf("got %d values, visited %v", db.Len("a"), visited)
+	}
+
+	if !db.Delete("a", "count") || db.Delete("a", "count") {
+		t.Fatal("the value was not deleted once")
+	}
+	if db.Get("a", "count") != nil {
+		t.Fatal("the deleted value is still there")
+	}
+	db.Clear("a")
+	if db.Len("a") != 0 {
+		t.Fatal("the values were not cleared")
+	}
+	db.Set("a", lifetime, "name", "bob", false)
+	db.Release("a")
+	if db.Len("a") != 0 || !db.Acquire("a", time.Hour).IsZero() {
+		t.Fatal("the session was not released")
+	}
+	if err := db.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisDBExpiresSessions(t *testing.T) {
+	db, server, _ := newTestRedisDB(t)
+	defer server.Close()
+	defer db.Close()
+
+	db.Set("a", sessionsLifeTime(time.Hour), "name", "alice", false)
+	lifetime := db.Acquire("a", time.Minute)
+	if remaining := time.Until(lifetime.Time); remaining < 50*time.Minute || remaining > time.Hour {
+		t.Fatalf("got %v remaining, want about an hour", remaining)
+	}
+	if err := db.OnUpdateExpiration("a", 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	server.FastForward(time.Hour)
+	if db.Get("a", "name") != "alice" {
+		t.Fatal("the session expired before its new expiration time")
+	}
+	server.FastForward(time.Hour)
+	if db.Get("a", "name") != nil || !db.Acquire("a", time.Hour).IsZero() {
+		t.Fatal("the session did not expire")
+	}
+}
+
+func TestRedisDBWritesInASingleRoundTrip(t *testing.T) {
+	db, server, roundTrips := newTestRedisDB(t)
+	defer server.Close()
+	defer db.Close()
+
+	// the first command also dials, authenticating and selecting the database.
+	db.Len("a")
+	writes := []struct {
+		name  string
+		write func()
+	}{
+		{"set", func() { db.Set("a", sessionsLifeTime(time.Hour), "name", "alice", false) }},
+		{"set without a lifetime", func() { db.Set("a", sessions.LifeTime{}, "city", "paris", false) }},
+		{"delete", func() {
+			if !db.Delete("a", "name") {
+				t.Error("the value was not deleted")
+			}
+		}},
+		{"delete a missing key", func() {
+			if db.Delete("a", "name") {
+				t.Error("a missing value was deleted")
+			}
+		}},
+		{"update the expiration", func() { db.OnUpdateExpiration("a", time.Hour) }},
+		{"clear", func() { db.Clear("a") }},
+		{"release", func() { db.Release("a") }},
+	}
+	for _, w := range writes {
+		before := atomic.LoadInt64(roundTrips)
+		w.write()
+		if n := atomic.LoadInt64(roundTrips) - before; n != 1 {
+			t.Fatalf("%s: got %d round trips, want 1", w.name, n)
+		}
+	}
+	if err := db.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisDBRevivesSessionsInAnotherInstance(t *testing.T) {
+	db, server, _ := newTestRedisDB(t)
+	defer server.Close()
+	defer db.Close()
+
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	sessions.UseDatabase(db)
+	ctx := newTestContext("")
+	sessions.Start(ctx).Set("user_id", 7.0)
+
+	other := newTestSessions(Config{Expires: time.Hour})
+	other.UseDatabase(db)
+	sess := other.Start(newTestContext(issuedToken(ctx)))
+	if got := sess.Get("user_id"); got != 7.0 {
+		t.Fatalf("user_id: got %#v, want 7", got)
+	}
+	if remaining := time.Until(sess.Lifetime.Time); remaining < 50*time.Minute {
+		t.Fatalf("the lifetime was not revived: %v remaining", remaining)
+	}
+}
@@ -0,0 +1,262 @@
+// Package redistest provides a tiny, in-memory, server speaking the Redis
+// protocol (RESP), so the Redis session database can be exercised without
+// a real Redis server. Only the commands used by the session database
+// are supported, in their simplest forms.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// Server is the fake Redis server. See NewServer.
+type Server struct {
+	listener net.Listener
+	mu       sync.Mutex
+	hashes   map[string]map[string][]byte
+	expires  map[string]time.Time
+	wg       sync.WaitGroup
+}
+
+
+// NewServer starts a server listening on a random local port.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		listener: listener,
+		hashes:   make(map[string]map[string][]byte),
+		expires:  make(map[string]time.Time),
+	}
+	server.wg.Add(1)
+	go server.serve()
+	return server, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server. Open connections are closed by their clients.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// FastForward moves the server's clock, so keys expire without waiting.
+func (s *Server) FastForward(d time.Duration) {
+	s.mu.Lock()
+	for key, when := range s.expires {
+		s.expires[key] = when.Add(-d)
+	}
+	s.mu.Unlock()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		s.execute(writer, args)
+		// flush only when the pipelined commands are all answered.
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected an array, got %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([][]byte, n)
+	for i := range args {
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected a bulk string, got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return nil, err
+		}
+		args[i] = bulk[:size]
+	}
+	return args, nil
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// expire removes the key if its TTL is due. Must be called locked.
+func (s *Server) expire(key string) {
+	if when, ok := s.expires[key]; ok && !when.After(time.Now()) {
+		delete(s.hashes, key)
+		delete(s.expires, key)
+	}
+}
+
+func (s *Server) execute(w *bufio.Writer, args [][]byte) {
+	if len(args) == 0 {
+		fmt.Fprint(w, "-ERR empty command\r\n")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := strings.ToUpper(string(args[0]))
+	if len(args) > 1 {
+		s.expire(string(args[1]))
+	}
+
+	switch {
+	case name == "PING":
+		fmt.Fprint(w, "+PONG\r\n")
+	case name == "AUTH" || name == "SELECT":
+		fmt.Fprint(w, "+OK\r\n")
+	case name == "HSET" && len(args) >= 4 && len(args)%2 == 0:
+		key := string(args[1])
+		hash, ok := s.hashes[key]
+		if !ok {
+			hash = make(map[string][]byte)
+			s.hashes[key] = hash
+		}
+		added := 0
+		for i := 2; i < len(args); i += 2 {
+			if _, found := hash[string(args[i])]; !found {
+				added++
+			}
+			hash[string(args[i])] = args[i+1]
+		}
+		fmt.Fprintf(w, ":%d\r\n", added)
+	case name == "HGET" && len(args) == 3:
+		value, found := s.hashes[string(args[1])][string(args[2])]
+		if !found {
+			fmt.Fprint(w, "$-1\r\n")
+			return
+		}
+		writeBulk(w, value)
+	case name == "HGETALL" && len(args) == 2:
+		hash := s.hashes[string(args[1])]
+		fmt.Fprintf(w, "*%d\r\n", 2*len(hash))
+		for field, value := range hash {
+			writeBulk(w, []byte(field))
+			writeBulk(w, value)
+		}
+	case name == "HLEN" && len(args) == 2:
+		fmt.Fprintf(w, ":%d\r\n", len(s.hashes[string(args[1])]))
+	case name == "HDEL" && len(args) >= 3:
+		key := string(args[1])
+		removed := 0
+		for _, field := range args[2:] {
+			if _, found := s.hashes[key][string(field)]; found {
+				delete(s.hashes[key], string(field))
+				removed++
+			}
+		}
+		if len(s.hashes[key]) == 0 {
+			delete(s.hashes, key)
+			delete(s.expires, key)
+		}
+		fmt.Fprintf(w, ":%d\r\n", removed)
+	case name == "DEL" && len(args) >= 2:
+		removed := 0
+		for _, key := range args[1:] {
+			s.expire(string(key))
+			if _, found := s.hashes[string(key)]; found {
+				removed++
+			}
+			delete(s.hashes, string(key))
+			delete(s.expires, string(key))
+		}
+		fmt.Fprintf(w, ":%d\r\n", removed)
+	case name == "EXISTS" && len(args) == 2:
+		if _, found := s.hashes[string(args[1])]; found {
+			fmt.Fprint(w, ":1\r\n")
+		} else {
+			fmt.Fprint(w, ":0\r\n")
+		}
+	case name == "PTTL" && len(args) == 2:
+		key := string(args[1])
+		if _, found := s.hashes[key]; !found {
+			fmt.Fprint(w, ":-2\r\n")
+		} else if when, ok := s.expires[key]; !ok {
+			fmt.Fprint(w, ":-1\r\n")
+		} else {
+			fmt.Fprintf(w, ":%d\r\n", time.Until(when)/time.Millisecond)
+		}
+	case (name == "PEXPIRE" || name == "PEXPIREAT") && len(args) == 3:
+		key := string(args[1])
+		n, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			fmt.Fprint(w, "-ERR value is not an integer or out of range\r\n")
+			return
+		}
+		if _, found := s.hashes[key]; !found {
+			fmt.Fprint(w, ":0\r\n")
+			return
+		}
+		if name == "PEXPIRE" {
+			s.expires[key] = time.Now().Add(time.Duration(n) * time.Millisecond)
+		} else {
+			s.expires[key] = time.Unix(0, n*int64(time.Millisecond))
+		}
+		fmt.Fprint(w, ":1\r\n")
+	default:
+		fmt.Fprintf(w, "-ERR unknown command or wrong number of arguments for '%s'\r\n", name)
+	}
+}
+
+func writeBulk(w *bufio.Writer, value []byte) {
+	fmt.Fprintf(w, "$%d\r\n", len(value))
+	w.Write(value)
+	w.WriteString("\r\n")
+}
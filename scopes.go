@@ -0,0 +1,111 @@
+package jwt_sessions
+
+import (
+	"strings"
+
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/context"
+	"github.com/kataras/iris/core/errors"
+)
+
+
+// Scopes are OAuth2-like: they live in the token's "scope" claim as a
+// space-separated list. A scope ending in ":*" covers every scope under
+// that prefix (e.g. "orders:*" covers "orders:read"), and "*" covers all.
+
+
+const scopeClaim = "scope"
+
+// ErrScopeNotGranted is returned when down-scoping a token into
+// scopes which are not covered by the current token.
+var ErrScopeNotGranted = errors.New("scope not granted: %s")
+
+
+// Scopes returns the scopes of the request's token.
+func (sessions *JWTSessions) Scopes(ctx context.Context) []string {
+	return stringList(sessions.claimsFromContext(ctx)[scopeClaim])
+}
+
+// SetScopes issues a new token for the request's session (started if needed)
+// carrying the given scopes. Unlike `DownScope`, there is no check against
+// the current scopes: this is meant to be used when granting them.
+func (sessions *JWTSessions) SetScopes(ctx context.Context, scopes ...string) {
+	sess := sessions.Start(ctx)
+	claims := sessions.tokenClaims(ctx, sess.ID())
+	claims[scopeClaim] = strings.Join(scopes, " ")
+	sessions.issueJWT(ctx, claims)
+}
+
+// DownScope returns a new token for the same session as the request's token
+// but carrying only the given scopes, which must be covered by the current
+// ones. The request's token is not changed: the new one is meant to be handed
+// to a downstream call.
+func (sessions *JWTSessions) DownScope(ctx context.Context, scopes ...string) (string, error) {
+	sessionID := sessions.sessionIDFromContext(ctx)
+	if sessionID == "" {
+		return "", ErrNotFound
+	}
+
+	granted := sessions.Scopes(ctx)
+	for _, scope := range scopes {
+		if !scopesCover(granted, scope) {
+			return "", ErrScopeNotGranted.Format(scope)
+		}
+	}
+
+	claims := sessions.tokenClaims(ctx, sessionID)
+	claims[scopeClaim] = strings.Join(scopes, " ")
+	return sessions.signJWT(claims)
+}
+
+// RequireScopes returns a middleware which only lets the request go on if its
+// token has all the given scopes. Otherwise, it responds with 403.
+func (sessions *JWTSessions) RequireScopes(scopes []string, onFailure context.Handler) context.Handler {
+	fail := failWith(iris.StatusForbidden, onFailure)
+	return func(ctx context.Context) {
+		granted := sessions.Scopes(ctx)
+		for _, scope := range scopes {
+			if !scopesCover(granted, scope) {
+				fail(ctx)
+				return
+			}
+		}
+		ctx.Next()
+	}
+}
+
+// RequireAnyScope returns a middleware which only lets the request go on if its
+// token has at least one of the given scopes. Otherwise, it responds with 403.
+func (sessions *JWTSessions) RequireAnyScope(scopes []string, onFailure context.Handler) context.Handler {
+	fail := failWith(iris.StatusForbidden, onFailure)
+	return func(ctx context.Context) {
+		granted := sessions.Scopes(ctx)
+		for _, scope := range scopes {
+			if scopesCover(granted, scope) {
+				ctx.Next()
+				return
+			}
+		}
+		fail(ctx)
+	}
+}
+
+// scopesCover tells whether any of the granted scopes covers the required one.
+func scopesCover(granted []string, required string) bool {
+	for _, scope := range granted {
+		if scopeCovers(scope, required) {
+			return true
+		}
+	}
+	return false
+}
+
+func scopeCovers(granted string, required string) bool {
+	if granted == "*" || granted == required {
+		return true
+	}
+	if strings.HasSuffix(granted, ":*") {
+		return strings.HasPrefix(required, granted[:len(granted)-1])
+	}
+	return false
+}
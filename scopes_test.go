@@ -0,0 +1,114 @@
+package jwt_sessions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/kataras/iris"
+)
+
+
+func TestScopeCovers(t *testing.T) {
+	cases := []struct {
+		granted  string
+		required string
+		covers   bool
+	}{
+		{"orders:read", "orders:read", true},
+		{"orders:read", "orders:write", false},
+		{"orders:*", "orders:read", true},
+		{"orders:*", "orders:items:read", true},
+		{"orders:*", "orders", false},
+		{"orders:*", "ordersx:read", false},
+		{"orders:read", "orders:*", false},
+		{"*", "orders:read", true},
+		{"*", "*", true},
+		{"orders:*", "*", false},
+	}
+	for _, c := range cases {
+		if got := scopeCovers(c.granted, c.required); got != c.covers {
+			t.Errorf("scopeCovers(%q, %q) = %v, want %v", c.granted, c.required, got, c.covers)
+		}
+	}
+}
+
+func TestDownScope(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext(signedToken(t, sessions, jwt.MapClaims{"session_id": "sid", "scope": "orders:* profile"}))
+
+	serialized, err := sessions.DownScope(ctx, "orders:read", "profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := sessions.config.Parser.Parse(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["session_id"] != "sid" || claims["scope"] != "orders:read profile" {
+		t.Fatalf("got the claims %v", claims)
+	}
+	if got := sessions.Scopes(ctx); len(got) != 2 || got[0] != "orders:*" {
+		t.Fatalf("the request's scopes changed: %v", got)
+	}
+	if issuedToken(ctx) != "" {
+		t.Fatal("the request's token was replaced")
+	}
+}
+
+func TestDownScopeRefusesToWiden(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext(signedToken(t, sessions, jwt.MapClaims{"session_id": "sid", "scope": "orders:read"}))
+
+	for _, scopes := range [][]string{{"orders:write"}, {"orders:*"}, {"*"}, {"orders:read", "profile"}} {
+		if _, err := sessions.DownScope(ctx, scopes...); err == nil || !ErrScopeNotGranted.Equal(err) {
+			t.Errorf("down-scoping into %v: got %v, want ErrScopeNotGranted", scopes, err)
+		}
+	}
+	if _, err := sessions.DownScope(newTestContext(""), "orders:read"); err == nil || !ErrNotFound.Equal(err) {
+		t.Errorf("without a token: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestSetScopesIssuesAToken(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	sessions.SetScopes(ctx, "orders:read", "profile")
+
+	next := newTestContext(issuedToken(ctx))
+	if sessions.Start(next) != sess {
+		t.Fatal("the token does not belong to the session")
+	}
+	if got := sessions.Scopes(next); len(got) != 2 || got[0] != "orders:read" || got[1] != "profile" {
+		t.Fatalf("got the scopes %v", got)
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	token := signedToken(t, sessions, jwt.MapClaims{"session_id": "sid", "scope": "orders:* profile"})
+
+	if _, reached := serveGuarded(t, sessions, token, sessions.RequireScopes([]string{"orders:read", "profile"}, nil)); !reached {
+		t.Error("covered scopes were refused")
+	}
+	if code, reached := serveGuarded(t, sessions, token, sessions.RequireScopes([]string{"orders:read", "admin"}, nil)); reached || code != iris.StatusForbidden {
+		t.Errorf("a missing scope: got %d (reached: %v), want 403", code, reached)
+	}
+	if code, reached := serveGuarded(t, sessions, "", sessions.RequireScopes([]string{"profile"}, nil)); reached || code != iris.StatusForbidden {
+		t.Errorf("without a token: got %d (reached: %v), want 403", code, reached)
+	}
+}
+
+func TestRequireAnyScope(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	token := signedToken(t, sessions, jwt.MapClaims{"session_id": "sid", "scope": "orders:read"})
+
+	if _, reached := serveGuarded(t, sessions, token, sessions.RequireAnyScope([]string{"admin", "orders:read"}, nil)); !reached {
+		t.Error("a covered scope was refused")
+	}
+	if code, reached := serveGuarded(t, sessions, token, sessions.RequireAnyScope([]string{"admin", "orders:write"}, nil)); reached || code != iris.StatusForbidden {
+		t.Errorf("no covered scope: got %d (reached: %v), want 403", code, reached)
+	}
+}
@@ -1,8 +1,11 @@
 package jwt_sessions
 
 import (
+	"container/list"
 	"strconv"
 	"sync"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/kataras/iris/context"
 	"github.com/kataras/iris/core/errors"
 	"github.com/kataras/iris/sessions"
 )
@@ -27,6 +30,26 @@ type (
 		mu       sync.RWMutex // for flashes.
 		Lifetime sessions.LifeTime
 		provider *provider
+
+		// the verified claims of the last request starting this session
+		// (see Claims), and a counter of the changes of its roles, so the
+		// grants resolved for a request are resolved again (see Can).
+		claims jwt.MapClaims
+		roles  uint64
+
+		// who is acting in this session (see `JWTSessions.Impersonate`).
+		impersonation *Impersonation
+
+		// lazy sessions (see Config.Lazy) have no storage until the first write.
+		unsaved  bool
+		save     func()
+		saveOnce sync.Once
+
+		// the position in the provider's LRU list, and the approximate size
+		// of the values (see Config.MaxBytes), guarded by the provider's lock.
+		element *list.Element
+		size    int64
+		sizes   map[string]int64
 	}
 
 	flashMessage struct {
@@ -45,7 +68,10 @@ type (
 //
 // Use the session's manager `Destroy(ctx)` in order to remove the cookie as well.
 func (s *JWTSession) Destroy() {
-	s.provider.deleteSession(s)
+	if s.isUnsaved() {
+		return
+	}
+	s.provider.Destroy(s.sid, DestroyLogout)
 }
 
 // ID returns the session's ID.
@@ -59,11 +85,76 @@ func (s *JWTSession) IsNew() bool {
 	return s.isNew
 }
 
+// IsSaved returns false if this session was lazily started
+// and nothing has been written into it yet (see Config.Lazy).
+func (s *JWTSession) IsSaved() bool {
+	return !s.isUnsaved()
+}
+
+// lifetime returns a copy of the session's lifetime, which the provider
+// shifts under the session's lock.
+func (s *JWTSession) lifetime() sessions.LifeTime {
+	s.mu.RLock()
+	lifetime := s.Lifetime
+	s.mu.RUnlock()
+	return lifetime
+}
+
+func (s *JWTSession) isUnsaved() bool {
+	s.mu.RLock()
+	unsaved := s.unsaved
+	s.mu.RUnlock()
+	return unsaved
+}
+
+// ensureSaved acquires the storage of a lazily started session (and issues
+// its token), once, right before the first write.
+func (s *JWTSession) ensureSaved() {
+	s.saveOnce.Do(func() {
+		if s.save != nil && s.isUnsaved() {
+			s.save()
+		}
+	})
+}
+
 // Get returns a value based on its "key".
 func (s *JWTSession) Get(key string) interface{} {
+	if s.isUnsaved() || !s.readsKey(key) {
+		return nil
+	}
 	return s.provider.db.Get(s.sid, key)
 }
 
+// Claims returns the verified claims of the token used
+// by the last request which started this session.
+func (s *JWTSession) Claims() jwt.MapClaims {
+	s.mu.RLock()
+	claims := s.claims
+	s.mu.RUnlock()
+	return claims
+}
+
+func (s *JWTSession) setClaims(claims jwt.MapClaims) {
+	s.mu.Lock()
+	s.claims = claims
+	s.mu.Unlock()
+}
+
+// Can tells whether the permission is granted to this session in the request,
+// according to the roles in the request's claims and in the session's values.
+// The grants are kept in the request (never in the session, which is shared by
+// concurrent requests), resolved once, and again when the roles key is changed.
+func (s *JWTSession) Can(ctx context.Context, permission string) bool {
+	return s.provider.authorization.grants(ctx, Claims(ctx), s).Can(permission)
+}
+
+// rolesVersion counts the changes of the session's roles.
+func (s *JWTSession) rolesVersion() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.roles
+}
+
 // when running on the session manager removes any 'old' flash messages.
 func (s *JWTSession) runFlashGC() {
 	s.mu.Lock()
@@ -391,10 +482,17 @@ func (s *JWTSession) GetBooleanDefault(key string, defaultValue bool) bool {
 
 // GetAll returns a copy of all session's values.
 func (s *JWTSession) GetAll() map[string]interface{} {
+	if s.isUnsaved() {
+		return map[string]interface{}{}
+	}
+
 	items := make(map[string]interface{}, s.provider.db.Len(s.sid))
 	s.mu.RLock()
+	impersonation, subjectKey := s.impersonation, s.provider.config.SubjectKey
 	s.provider.db.Visit(s.sid, func(key string, value interface{}) {
-		items[key] = value
+		if key == subjectKey || impersonation.allowsKey(key) {
+			items[key] = value
+		}
 	})
 	s.mu.RUnlock()
 	return items
@@ -415,19 +513,67 @@ func (s *JWTSession) GetFlashes() map[string]interface{} {
 
 // Visit loops each of the entries and calls the callback function func(key, value).
 func (s *JWTSession) Visit(cb func(k string, v interface{})) {
-	s.provider.db.Visit(s.sid, cb)
+	if s.isUnsaved() {
+		return
+	}
+	s.provider.db.Visit(s.sid, func(k string, v interface{}) {
+		if s.readsKey(k) {
+			cb(k, v)
+		}
+	})
 }
 
 func (s *JWTSession) set(key string, value interface{}, immutable bool) {
-	s.provider.db.Set(s.sid, s.Lifetime, key, value, immutable)
+	s.ensureSaved()
+	s.provider.db.Set(s.sid, s.lifetime(), key, value, immutable)
+	s.provider.resize(s, key, value)
 
 	s.mu.Lock()
 	s.isNew = false
+	if key == s.provider.authorization.RolesKey {
+		s.roles++
+	}
 	s.mu.Unlock()
+
+	s.provider.fireSessionEvent(s, Event{Kind: EventSet, Key: key, Value: value})
+}
+
+// allowsKey tells whether the key is accessible, which is always the case
+// unless the session is impersonating with restricted keys.
+func (s *JWTSession) allowsKey(key string) bool {
+	s.mu.RLock()
+	allowed := s.impersonation.allowsKey(key)
+	s.mu.RUnlock()
+	return allowed
+}
+
+// readsKey tells whether the key can be read: the subject key (see
+// Config.SubjectKey) always can, so who is impersonated is always known.
+func (s *JWTSession) readsKey(key string) bool {
+	return key == s.provider.config.SubjectKey || s.allowsKey(key)
+}
+
+// writesKey tells whether the key can be written by the session's users:
+// the internal keys are written only by this package (see `set`).
+func (s *JWTSession) writesKey(key string) bool {
+	return !isInternalKey(key) && s.allowsKey(key)
+}
+
+// get returns a value based on its "key", regardless the restrictions.
+func (s *JWTSession) get(key string) interface{} {
+	if s.isUnsaved() {
+		return nil
+	}
+	return s.provider.db.Get(s.sid, key)
 }
 
 // Set fills the session with an entry "value", based on its "key".
+// While impersonating with restricted keys, a forbidden key is ignored,
+// and so is an internal key (i.e. prefixed with "jwt_sessions.").
 func (s *JWTSession) Set(key string, value interface{}) {
+	if !s.writesKey(key) {
+		return
+	}
 	s.set(key, value, false)
 }
 
@@ -438,6 +584,9 @@ func (s *JWTSession) Set(key string, value interface{}) {
 // Use it consistently, it's far slower than `Set`.
 // Read more about muttable and immutable go types: https://stackoverflow.com/a/8021081
 func (s *JWTSession) SetImmutable(key string, value interface{}) {
+	if !s.writesKey(key) {
+		return
+	}
 	s.set(key, value, true)
 }
 
@@ -462,6 +611,7 @@ func (s *JWTSession) SetImmutable(key string, value interface{}) {
 // In this example we used the key 'success'.
 // If you want to define more than one flash messages, you will have to use different keys.
 func (s *JWTSession) SetFlash(key string, value interface{}) {
+	s.ensureSaved()
 	s.mu.Lock()
 	s.flashes[key] = &flashMessage{value: value}
 	s.mu.Unlock()
@@ -470,11 +620,20 @@ func (s *JWTSession) SetFlash(key string, value interface{}) {
 // Delete removes an entry by its key,
 // returns true if actually something was removed.
 func (s *JWTSession) Delete(key string) bool {
+	if s.isUnsaved() || !s.writesKey(key) {
+		return false
+	}
+
 	removed := s.provider.db.Delete(s.sid, key)
 	if removed {
+		s.provider.resize(s, key, nil)
 		s.mu.Lock()
 		s.isNew = false
+		if key == s.provider.authorization.RolesKey {
+			s.roles++
+		}
 		s.mu.Unlock()
+		s.provider.fireSessionEvent(s, Event{Kind: EventDelete, Key: key})
 	}
 
 	return removed
@@ -487,12 +646,33 @@ func (s *JWTSession) DeleteFlash(key string) {
 	s.mu.Unlock()
 }
 
-// Clear removes all entries.
+// Clear removes all entries. While impersonating, only the
+// entries which can be written (see `Set`) are removed.
 func (s *JWTSession) Clear() {
+	if s.isUnsaved() {
+		return
+	}
+
+	if s.Impersonation() != nil {
+		var keys []string
+		s.provider.db.Visit(s.sid, func(key string, value interface{}) {
+			if s.writesKey(key) {
+				keys = append(keys, key)
+			}
+		})
+		for _, key := range keys {
+			s.provider.db.Delete(s.sid, key)
+		}
+	} else {
+		s.provider.db.Clear(s.sid)
+	}
+
 	s.mu.Lock()
-	s.provider.db.Clear(s.sid)
 	s.isNew = false
+	s.roles++
 	s.mu.Unlock()
+
+	s.provider.remeasure(s, nil)
 }
 
 // ClearFlashes removes all flash messages.
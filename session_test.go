@@ -0,0 +1,89 @@
+package jwt_sessions
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+
+func TestLazySessionsAreSavedOnTheFirstWrite(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour, Lazy: true})
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	if sess.IsSaved() || issuedToken(ctx) != "" {
+		t.Fatal("the lazy session was saved before being written")
+	}
+	if sess.Get("cart") != nil || len(sess.GetAll()) != 0 || sess.Delete("cart") {
+		t.Fatal("the unsaved session has values")
+	}
+
+	sess.Set("cart", 1)
+	if !sess.IsSaved() || issuedToken(ctx) == "" {
+		t.Fatal("the lazy session was not saved by the first write")
+	}
+	if got := sessions.Start(newTestContext(issuedToken(ctx))); got != sess || got.Get("cart") != 1 {
+		t.Fatalf("the token got session %q", got.ID())
+	}
+}
+
+func TestLazySessionsAreSavedByAFlash(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour, Lazy: true})
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	sess.SetFlash("notice", "welcome")
+	if !sess.IsSaved() || issuedToken(ctx) == "" {
+		t.Fatal("the lazy session was not saved by a flash")
+	}
+}
+
+func TestSetWhileUpdatingTheExpiration(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := 0; i < 2000; i++ {
+			sess.Set("key"+strconv.Itoa(i%10), i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := 0; i < 2000; i++ {
+			sessions.provider.UpdateExpiration(sess.ID(), time.Hour)
+		}
+	}()
+	close(start)
+	wg.Wait()
+
+	if got := len(sess.GetAll()); got != 10 {
+		t.Fatalf("got %d values, want 10", got)
+	}
+}
+
+func TestRegenerateKeepsTheRemainingLifetime(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext("")
+	old := sessions.Start(ctx)
+	old.Set("cart", 1)
+	sessions.provider.UpdateExpiration(old.ID(), time.Minute)
+
+	sess, err := sessions.Regenerate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.ID() == old.ID() || sess.Get("cart") != 1 {
+		t.Fatalf("got session %q with cart %v", sess.ID(), sess.Get("cart"))
+	}
+	lifetime := sess.lifetime()
+	if remaining := lifetime.DurationUntilExpiration(); remaining > time.Minute || remaining < 50*time.Second {
+		t.Fatalf("remaining lifetime: %v", remaining)
+	}
+}
@@ -18,16 +18,27 @@ import (
 type JWTSessions struct {
 	config   Config
 	provider *provider
+	// the metrics, if collected (see UseMetrics), and the tracer
+	// (see UseTracer).
+	metrics *Metrics
+	tracer  Tracer
 }
 
 
 // New returns a new fast, feature-rich sessions manager
 // it can be adapted to an iris station
 func New(cfg Config) *JWTSessions {
-	return &JWTSessions{
-		config:   cfg.Validate(),
-		provider: newProvider(),
+	sessions := &JWTSessions{config: cfg.Validate(), tracer: NoopTracer}
+	sessions.provider = newProvider(&sessions.config)
+	if cache := sessions.config.Parser.Cache; cache != nil {
+		// the tokens of a destroyed session must not be verified from the cache.
+		sessions.provider.registerDestroyListener(func(sid string) {
+			cache.RevokeWhere(func(claims jwt.MapClaims) bool {
+				return claims["session_id"] == sid
+			})
+		})
 	}
+	return sessions
 }
 
 // UseDatabase adds a session database to the manager's provider,
@@ -36,20 +47,64 @@ func (sessions *JWTSessions) UseDatabase(db sessions.Database) {
 	sessions.provider.RegisterDatabase(db)
 }
 
+// UseInvalidationBus connects the manager to the other instances of a
+// multi-instance deployment: the sessions destroyed, regenerated or shifted
+// by one instance are evicted (or updated) from the memory of the others.
+// The instances should share the same session database.
+func (sessions *JWTSessions) UseInvalidationBus(bus InvalidationBus) {
+	sessions.provider.RegisterInvalidationBus(bus)
+}
+
+// carriedClaims are copied from the request's token into the new tokens
+// issued for the request, so re-issuing a token does not drop them.
+var carriedClaims = []string{scopeClaim, acrClaim, amrClaim, authTimeClaim, actClaim}
+
+// tokenClaims returns the claims of a new token for the session: the session
+// ID and the claims carried from the request's token.
+func (sessions *JWTSessions) tokenClaims(ctx context.Context, sessionID string) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"session_id": sessionID,
+	}
+	current := sessions.claimsFromContext(ctx)
+	for _, name := range carriedClaims {
+		if value, found := current[name]; found {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
 // updateJWT gains the ability of updating the session browser cookie to any method which wants to update it
 func (sessions *JWTSessions) updateJWT(ctx context.Context, sessionID string, expires time.Duration) {
-	token := jwt.NewWithClaims(sessions.config.Parser.SigningMethod, jwt.MapClaims{
-		"session_id": sessionID,
-	})
+	sessions.issueJWT(ctx, sessions.tokenClaims(ctx, sessionID))
+}
+
+// issueJWT sets the claims as the new token of the request.
+func (sessions *JWTSessions) issueJWT(ctx context.Context, claims jwt.MapClaims) {
+	// the rest of this request will see the new claims.
+	ctx.Values().Set(claimsContextKey, claims)
+	sessionID, _ := claims["session_id"].(string)
+	sessions.provider.fireEvent(Event{Kind: EventTokenIssued, SessionID: sessionID, Claims: claims, Context: ctx})
 
 	if (sessions.config.AllowReclaim) {
-		serialized, _ := sessions.config.Parser.Serialize(token)
-		if serialized != "" {
-			if sessions.config.AllowReclaim {
-				ctx.Request().Header.Set("Authorization", "Bearer " + serialized)
-			}
-			ctx.Header("Authorization", "Bearer " + serialized)
+		sessions.writeJWT(ctx, claims)
+	}
+}
+
+// signJWT signs the claims and returns the serialized token.
+func (sessions *JWTSessions) signJWT(claims jwt.MapClaims) (string, error) {
+	return sessions.config.Parser.Serialize(jwt.NewWithClaims(sessions.config.Parser.SigningMethod, claims))
+}
+
+// writeJWT signs the claims and writes them in the authorization header.
+func (sessions *JWTSessions) writeJWT(ctx context.Context, claims jwt.MapClaims) {
+	serialized, _ := sessions.signJWT(claims)
+	if serialized != "" {
+		if sessions.config.AllowReclaim {
+			ctx.Request().Header.Set("Authorization", "Bearer " + serialized)
 		}
+		// replaced, not added: a regenerated session issues a second token.
+		ctx.ResponseWriter().Header().Set("Authorization", "Bearer " + serialized)
 	}
 }
 
@@ -69,28 +124,72 @@ func (sessions *JWTSessions) readJWT(ctx iris.Context) (string, error) {
 	return authHeaderParts[1], nil
 }
 
-func (sessions *JWTSessions) sessionIDFromContext(ctx context.Context) string {
-	tokenString, _ := sessions.readJWT(ctx)
-	if tokenString == "" {
-		return ""
+// claimsFromContext returns the verified claims of the request's token, or nil
+// if there is no valid token. The token is verified only once per request.
+func (sessions *JWTSessions) claimsFromContext(ctx context.Context) jwt.MapClaims {
+	if claims, ok := ctx.Values().Get(claimsContextKey).(jwt.MapClaims); ok {
+		return claims
 	}
 
-	token, _ := sessions.config.Parser.Parse(tokenString)
-	sessionID := ""
-	if token != nil {
-		claims, _ := token.Claims.(jwt.MapClaims)
-		sessionID, _ = claims["session_id"].(string)
+	var claims jwt.MapClaims
+	tokenString, err := sessions.readJWT(ctx)
+	if tokenString != "" {
+		var token *jwt.Token
+		if token, err = sessions.config.Parser.Parse(tokenString); token != nil {
+			claims, _ = token.Claims.(jwt.MapClaims)
+		}
+		if sessions.metrics != nil {
+			sessions.metrics.verified(err == nil)
+		}
+	}
+	if err != nil {
+		sessions.provider.fireEvent(Event{Kind: EventTokenRejected, Context: ctx, Err: err})
 	}
+	// a nil map is also stored, so invalid tokens are not verified again.
+	ctx.Values().Set(claimsContextKey, claims)
+	return claims
+}
+
+func (sessions *JWTSessions) sessionIDFromContext(ctx context.Context) string {
+	sessionID, _ := sessions.claimsFromContext(ctx)["session_id"].(string)
 	return sessionID
 }
 
 // Start should start the session for the particular request.
+// The session is started only once per request: further calls
+// return the same session.
 func (sessions *JWTSessions) Start(ctx context.Context) *JWTSession {
+	if sess := Get(ctx); sess != nil {
+		return sess
+	}
+
+	span := sessions.tracer.StartSpan("session.start")
+	defer span.End()
+	sess := sessions.start(ctx)
+	span.SetAttribute("session.id", sess.ID())
+	span.SetAttribute("session.new", sess.IsNew())
+	sess.setClaims(sessions.claimsFromContext(ctx))
+	ctx.Values().Set(sessionContextKey, sess)
+	sessions.provider.fireSessionEvent(sess, Event{Kind: EventStart, Context: ctx})
+	return sess
+}
+
+func (sessions *JWTSessions) start(ctx context.Context) *JWTSession {
 	sessionID := sessions.sessionIDFromContext(ctx)
 	if sessionID == "" {
 		sessionID := sessions.config.SessionIDGenerator()
+		if sessions.config.Lazy {
+			var sess *JWTSession
+			sess = sessions.provider.newUnsavedSession(sessionID, func() {
+				sessions.provider.Save(sess, sessions.config.Expires)
+				sessions.provider.fireSessionEvent(sess, Event{Kind: EventCreate, Context: ctx})
+				sessions.updateJWT(ctx, sessionID, sessions.config.Expires)
+			})
+			return sess
+		}
 		sess := sessions.provider.Init(sessionID, sessions.config.Expires)
 		sess.isNew = sessions.provider.db.Len(sessionID) == 0
+		sessions.provider.fireSessionEvent(sess, Event{Kind: EventCreate, Context: ctx})
 		sessions.updateJWT(ctx, sessionID, sessions.config.Expires)
 		return sess
 	} else {
@@ -98,6 +197,22 @@ func (sessions *JWTSessions) Start(ctx context.Context) *JWTSession {
 	}
 }
 
+// Regenerate moves the current session (started if needed) to a new session ID,
+// keeping its values, flashes and remaining lifetime. The old ID is destroyed
+// and the new token is issued. Use it after a login to prevent session fixation.
+// Regenerate listeners are fired after the move.
+func (sessions *JWTSessions) Regenerate(ctx context.Context) (*JWTSession, error) {
+	old := sessions.Start(ctx)
+	sess, err := sessions.provider.Regenerate(old, sessions.config.SessionIDGenerator(), sessions.config.Expires)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Values().Set(sessionContextKey, sess)
+	sessions.updateJWT(ctx, sess.ID(), sessions.config.Expires)
+	return sess, nil
+}
+
 // ShiftExpiration move the expire date of a session to a new date
 // by using session default timeout configuration.
 // It will return `ErrNotImplemented` if a database is used and it does not support this feature, yet.
@@ -122,26 +237,40 @@ func (sessions *JWTSessions) UpdateExpiration(ctx context.Context, expires time.
 // A destroy listener is fired when a session has been removed entirely from the server (the entry) and client-side (the cookie).
 // Note that if a destroy listener is blocking, then the session manager will delay respectfully,
 // use a goroutine inside the listener to avoid that behavior.
+// To know why the session was destroyed, register for `EventDestroy` instead (see `On`).
 func (sessions *JWTSessions) OnDestroy(listeners ...sessions.DestroyListener) {
 	for _, ln := range listeners {
 		sessions.provider.registerDestroyListener(ln)
 	}
 }
 
+// OnRegenerate registers one or more regenerate listeners.
+// A regenerate listener is fired when a session has been moved to a new ID
+// by `Regenerate`, after the old ID has been destroyed.
+func (sessions *JWTSessions) OnRegenerate(listeners ...RegenerateListener) {
+	for _, ln := range listeners {
+		sessions.provider.registerRegenerateListener(ln)
+	}
+}
+
 // Destroy removes the session data by context.
 func (sessions *JWTSessions) Destroy(ctx context.Context) {
 	sessionID := sessions.sessionIDFromContext(ctx)
 	if sessionID != "" {
-		sessions.DestroyByID(sessionID)
+		sessions.provider.Destroy(sessionID, DestroyLogout)
 	}
+	ctx.Values().Remove(sessionContextKey)
+	ctx.Values().Set(claimsContextKey, jwt.MapClaims(nil))
 	if sessions.config.AllowReclaim {
 		ctx.Request().Header.Del("Authorization")
+		// a token issued earlier in this request must not be sent.
+		ctx.ResponseWriter().Header().Del("Authorization")
 	}
 }
 
-// DestroyByID removes the session data by ID.
+// DestroyByID removes the session data by ID (i.e. revokes it).
 func (sessions *JWTSessions) DestroyByID(sid string) {
-	sessions.provider.Destroy(sid)
+	sessions.provider.Destroy(sid, DestroyRevoked)
 }
 
 // DestroyAll removes all sessions.
@@ -0,0 +1,145 @@
+package jwt_sessions
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/context"
+)
+
+
+// Helpers shared by the tests of the package.
+
+
+var testApp = iris.New()
+
+// newTestSessions returns a manager signing its tokens with HS256, and
+// writing them in the request's authorization header.
+func newTestSessions(config Config) *JWTSessions {
+	config.Parser.Secret = []byte("test secret")
+	config.Parser.SigningMethod = jwt.SigningMethodHS256
+	config.AllowReclaim = true
+	return New(config)
+}
+
+// newTestContext returns the context of a new request, with the given
+// authorization header (if any).
+func newTestContext(authorization string) context.Context {
+	ctx := context.NewContext(testApp)
+	request := httptest.NewRequest("GET", "/", nil)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	ctx.BeginRequest(httptest.NewRecorder(), request)
+	return ctx
+}
+
+// issuedToken returns the authorization header issued for a request.
+func issuedToken(ctx context.Context) string {
+	return ctx.ResponseWriter().Header().Get("Authorization")
+}
+
+// waitFor fails the test if done is not closed within the timeout.
+func waitFor(t *testing.T, done <-chan struct{}, timeout time.Duration, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("timed out: %s", what)
+	}
+}
+
+
+func TestStartReusesTheSessionOfTheToken(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	if sessions.Start(ctx) != sess {
+		t.Fatal("the session is started once per request")
+	}
+
+	token := issuedToken(ctx)
+	if token == "" {
+		t.Fatal("no token issued")
+	}
+	if got := sessions.Start(newTestContext(token)); got != sess {
+		t.Fatalf("got session %q, want %q", got.ID(), sess.ID())
+	}
+}
+
+func TestRegenerateMovesTheValuesAndFlashes(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext("")
+	old := sessions.Start(ctx)
+	old.Set("cart", 3)
+	old.SetImmutable("user_id", 7)
+	old.SetFlash("notice", "welcome")
+	oldID := old.ID()
+
+	sess, err := sessions.Regenerate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.ID() == oldID {
+		t.Fatal("the session ID was not changed")
+	}
+	if sess.Get("cart") != 3 || sess.Get("user_id") != 7 {
+		t.Fatalf("got the values %v", sess.GetAll())
+	}
+	if sess.GetFlash("notice") != "welcome" {
+		t.Fatal("the flash was not moved")
+	}
+}
+
+func TestRegenerateDestroysTheOldID(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	var destroyed []string
+	var regenerated [2]string
+	sessions.OnDestroy(func(sid string) { destroyed = append(destroyed, sid) })
+	sessions.OnRegenerate(func(oldID string, newID string) { regenerated = [2]string{oldID, newID} })
+
+	ctx := newTestContext("")
+	old := sessions.Start(ctx)
+	old.Set("cart", 3)
+	oldToken := issuedToken(ctx)
+
+	sess, err := sessions.Regenerate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(destroyed) != 1 || destroyed[0] != old.ID() {
+		t.Fatalf("destroyed %v, want the old ID only", destroyed)
+	}
+	if regenerated != [2]string{old.ID(), sess.ID()} {
+		t.Fatalf("regenerated %v", regenerated)
+	}
+
+	// the old token no longer reaches the values.
+	stale := sessions.Start(newTestContext(oldToken))
+	if stale == old || stale.Get("cart") != nil {
+		t.Fatalf("the old token got the values %v", stale.GetAll())
+	}
+}
+
+func TestRegenerateIssuesTheNewToken(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext("")
+	old := sessions.Start(ctx)
+	old.Set("cart", 3)
+	oldToken := issuedToken(ctx)
+
+	sess, err := sessions.Regenerate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := issuedToken(ctx)
+	if token == "" || token == oldToken {
+		t.Fatal("no new token was issued")
+	}
+	if got := sessions.Start(newTestContext(token)); got != sess || got.Get("cart") != 3 {
+		t.Fatalf("the new token got session %q", got.ID())
+	}
+}
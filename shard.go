@@ -0,0 +1,61 @@
+package jwt_sessions
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+
+// The in-memory sessions (and the values of the default MemDB) are split in
+// shards by a hash of the session ID, each with its own lock, so requests
+// for different sessions do not serialize on a single lock. Operations on
+// all the sessions (like DestroyAll) walk the shards one at a time.
+
+
+// DefaultShards is the default number of shards (see Config.Shards).
+var DefaultShards = 32
+
+// providerShard holds a part of the provider's in-memory sessions.
+type providerShard struct {
+	// we don't use RWMutex because all actions have read and write at the same action function.
+	// (or write to a *JWTSession's value which is race if we don't lock)
+	mu       sync.Mutex
+	sessions map[string]*JWTSession
+	// the sessions in LRU order, the expiration of the spilled ones, and
+	// the ones whose values are being moved into (or out of) the spill
+	// database (see limits.go).
+	lru       *list.List
+	spilled   map[string]time.Time
+	moving    map[string]chan struct{}
+	lastSweep time.Time
+	stats     MemoryStats
+}
+
+func newProviderShards(n int) []*providerShard {
+	shards := make([]*providerShard, n)
+	for i := range shards {
+		shards[i] = &providerShard{
+			sessions: make(map[string]*JWTSession),
+			lru:      list.New(),
+			spilled:  make(map[string]time.Time),
+			moving:   make(map[string]chan struct{}),
+		}
+	}
+	return shards
+}
+
+// shardIndex hashes a session ID (FNV-1a) into one of n shards.
+func shardIndex(sid string, n int) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(sid); i++ {
+		hash ^= uint32(sid[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(n))
+}
+
+// shard returns the shard of a session ID.
+func (p *provider) shard(sid string) *providerShard {
+	return p.shards[shardIndex(sid, len(p.shards))]
+}
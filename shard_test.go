@@ -0,0 +1,90 @@
+package jwt_sessions
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+
+// newTestProvider returns a provider with the given number of shards.
+func newTestProvider(shards int) *provider {
+	config := Config{Shards: shards}.Validate()
+	return newProvider(&config)
+}
+
+var benchmarkShardCounts = []int{1, DefaultShards}
+
+
+func TestShardIndexSpreadsTheSessions(t *testing.T) {
+	const n, perShard = 32, 100
+	counts := make([]int, n)
+	for i := 0; i < n*perShard; i++ {
+		counts[shardIndex(fmt.Sprintf("session-%d", i), n)]++
+	}
+	for shard, count := range counts {
+		if count < perShard/2 || count > 2*perShard {
+			t.Errorf("shard %d got %d sessions, want about %d", shard, count, perShard)
+		}
+	}
+}
+
+func TestProviderKeepsTheSessionsInTheirShards(t *testing.T) {
+	p := newTestProvider(4)
+	for i := 0; i < 20; i++ {
+		p.Init(fmt.Sprintf("session-%d", i), 0)
+	}
+
+	total := 0
+	for index, sh := range p.shards {
+		for sid := range sh.sessions {
+			if shardIndex(sid, len(p.shards)) != index {
+				t.Errorf("%s is in the shard %d", sid, index)
+			}
+		}
+		total += len(sh.sessions)
+	}
+	if total != 20 || p.Stats().Sessions != 20 {
+		t.Fatalf("got %d sessions, want 20", total)
+	}
+}
+
+
+// The sessions do not expire in the benchmarks: the expiry scheduler
+// is not sharded, and it is benchmarked on its own (see expiry_test.go).
+
+func BenchmarkProviderInitParallel(b *testing.B) {
+	for _, shards := range benchmarkShardCounts {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			p := newTestProvider(shards)
+			var next uint64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					p.Init(fmt.Sprintf("session-%d", atomic.AddUint64(&next, 1)), 0)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkProviderReadParallel(b *testing.B) {
+	for _, shards := range benchmarkShardCounts {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			p := newTestProvider(shards)
+			sids := make([]string, 1024)
+			for i := range sids {
+				sids[i] = fmt.Sprintf("session-%d", i)
+				p.Init(sids[i], 0)
+			}
+			var next uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddUint64(&next, 1))
+				for pb.Next() {
+					p.Read(sids[i%len(sids)], 0)
+					i++
+				}
+			})
+		})
+	}
+}
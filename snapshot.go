@@ -0,0 +1,118 @@
+package jwt_sessions
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kataras/iris/sessions"
+)
+
+
+// A snapshot is a read-only copy of a session's values, taken right before
+// they are released (see Config.DestroySnapshot), so the destroy and expire
+// listeners can still persist them (e.g. an unsaved cart) or audit them.
+// The same snapshot is shared by all the listeners: the values themselves
+// are not copied, so they should not be modified either.
+
+
+// Snapshot is a read-only copy of the values of a destroyed session.
+// A nil snapshot is empty.
+type Snapshot struct {
+	sessionID string
+	taken     time.Time
+	expires   time.Time
+	values    map[string]interface{}
+}
+
+// newSnapshot copies the values of a session from a database.
+func newSnapshot(db sessions.Database, sid string, expires time.Time) *Snapshot {
+	values := make(map[string]interface{})
+	db.Visit(sid, func(key string, value interface{}) {
+		values[key] = value
+	})
+	return &Snapshot{sessionID: sid, taken: time.Now(), expires: expires, values: values}
+}
+
+// SessionID returns the ID of the session the values belonged to.
+func (s *Snapshot) SessionID() string {
+	if s == nil {
+		return ""
+	}
+	return s.sessionID
+}
+
+// Taken returns when the snapshot was taken.
+func (s *Snapshot) Taken() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	return s.taken
+}
+
+// Expires returns the expiration time the session had, zero if none.
+func (s *Snapshot) Expires() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	return s.expires
+}
+
+// Get returns a value by its key, nil if not found.
+func (s *Snapshot) Get(key string) interface{} {
+	if s == nil {
+		return nil
+	}
+	return s.values[key]
+}
+
+// GetDefault returns a value by its key, or the default value if not found.
+func (s *Snapshot) GetDefault(key string, defaultValue interface{}) interface{} {
+	if value := s.Get(key); value != nil {
+		return value
+	}
+	return defaultValue
+}
+
+// GetString returns a string value by its key, or "" if not found
+// or not a string.
+func (s *Snapshot) GetString(key string) string {
+	value, _ := s.Get(key).(string)
+	return value
+}
+
+// Len returns the number of values.
+func (s *Snapshot) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.values)
+}
+
+// Keys returns the keys of the values, sorted.
+func (s *Snapshot) Keys() []string {
+	if s == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Visit calls cb for each value, in key order.
+func (s *Snapshot) Visit(cb func(key string, value interface{})) {
+	for _, key := range s.Keys() {
+		cb(key, s.values[key])
+	}
+}
+
+// GetAll returns a copy of the values.
+func (s *Snapshot) GetAll() map[string]interface{} {
+	values := make(map[string]interface{}, s.Len())
+	s.Visit(func(key string, value interface{}) {
+		values[key] = value
+	})
+	return values
+}
@@ -0,0 +1,86 @@
+package jwt_sessions
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+
+func TestDestroyEventsCarryASnapshotWhenEnabled(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		sessions := newTestSessions(Config{Expires: time.Hour, DestroySnapshot: enabled})
+		recorder := recordEvents(sessions)
+		sess := sessions.Start(newTestContext(""))
+		sess.Set("cart", 2)
+		sess.Set("theme", "dark")
+
+		sessions.DestroyByID(sess.ID())
+		var snapshot *Snapshot
+		for _, event := range recorder.take() {
+			if event.Kind == EventDestroy {
+				snapshot = event.Snapshot
+			}
+		}
+		if !enabled {
+			if snapshot != nil {
+				t.Fatal("got a snapshot, without DestroySnapshot")
+			}
+			continue
+		}
+
+		if snapshot.SessionID() != sess.ID() || snapshot.Taken().IsZero() || !snapshot.Expires().After(snapshot.Taken()) {
+			t.Fatalf("got the snapshot %q taken at %v, expiring at %v", snapshot.SessionID(), snapshot.Taken(), snapshot.Expires())
+		}
+		if snapshot.Get("cart") != 2 || snapshot.GetString("theme") != "dark" || snapshot.Len() != 2 {
+			t.Fatalf("got the values %v", snapshot.GetAll())
+		}
+		if keys := snapshot.Keys(); !reflect.DeepEqual(keys, []string{"cart", "theme"}) {
+			t.Fatalf("got the keys %v", keys)
+		}
+		if got := snapshot.GetDefault("missing", "none"); got != "none" {
+			t.Fatalf("got %#v for a missing key", got)
+		}
+		// the values are copied: the snapshot outlives the released session.
+		snapshot.GetAll()["cart"] = 3
+		if snapshot.Get("cart") != 2 || sessions.provider.db.Len(sess.ID()) != 0 {
+			t.Fatal("the snapshot is not a copy")
+		}
+	}
+}
+
+func TestExpireEventsCarryASnapshot(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: 20 * time.Millisecond, DestroySnapshot: true})
+	recorder := recordEvents(sessions)
+	destroyed := make(chan struct{})
+	sessions.On(EventDestroy, func(Event) { close(destroyed) })
+	sessions.Start(newTestContext("")).Set("cart", 2)
+	recorder.take()
+
+	waitFor(t, destroyed, time.Second, "the session did not expire")
+	events := recorder.take()
+	if len(events) != 2 || events[0].Kind != EventExpire || events[1].Kind != EventDestroy {
+		t.Fatalf("got the events %v", kindsOf(events))
+	}
+	for _, event := range events {
+		if event.Snapshot.Get("cart") != 2 {
+			t.Fatalf("%s: got the values %v", event.Kind, event.Snapshot.GetAll())
+		}
+	}
+}
+
+func TestANilSnapshotIsEmpty(t *testing.T) {
+	var snapshot *Snapshot
+	if snapshot.SessionID() != "" || !snapshot.Taken().IsZero() || !snapshot.Expires().IsZero() {
+		t.Fatal("a nil snapshot has a session")
+	}
+	if snapshot.Get("cart") != nil || snapshot.GetString("cart") != "" || snapshot.GetDefault("cart", 1) != 1 {
+		t.Fatal("a nil snapshot has values")
+	}
+	if snapshot.Len() != 0 || snapshot.Keys() != nil || len(snapshot.GetAll()) != 0 {
+		t.Fatal("a nil snapshot has values")
+	}
+	snapshot.Visit(func(key string, value interface{}) {
+		t.Fatalf("visited %s in a nil snapshot", key)
+	})
+}
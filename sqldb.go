@@ -0,0 +1,488 @@
+package jwt_sessions
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/sessions"
+)
+
+
+// SQLDB is a session database over `database/sql`. Sessions live in the
+// "<table>" table (with their expiration time in a column) and their values
+// either in the "<table>_values" table, one row per key, or serialized
+// altogether in a column of the sessions table (see SQLStorageMode).
+// Expired sessions are periodically purged.
+//
+// The SQL differences among engines are abstracted by a dialect: PostgreSQL,
+// MySQL and SQLite are provided, and any other can be plugged in.
+
+
+type (
+	// SQLDialect abstracts the SQL differences among database engines.
+	SQLDialect interface {
+		// Placeholder returns the n-th (1-based) query parameter.
+		Placeholder(n int) string
+		// Upsert returns an INSERT statement which updates the value columns
+		// when a row with the same key columns already exists. Parameters are
+		// the key columns, then the value columns.
+		Upsert(table string, keyColumns []string, valueColumns []string) string
+		// KeyType returns the column type for session IDs and keys.
+		KeyType() string
+		// BlobType returns the column type for serialized values.
+		BlobType() string
+	}
+
+	// SQLStorageMode tells how the values are stored.
+	SQLStorageMode int
+
+	// SQLDBOptions configures a SQLDB.
+	SQLDBOptions struct {
+		// The SQL dialect of the database. Required.
+		Dialect SQLDialect
+		// The name of the sessions table (values go to "<Table>_values").
+		// Default value: "sessions".
+		Table string
+		// How the values are stored. Default value: SQLPerKey.
+		Mode SQLStorageMode
+		// The interval between purges of expired sessions.
+		// Default value: DefaultSQLDBPurgeInterval. Negative disables it.
+		PurgeInterval time.Duration
+	}
+
+	// SQLDB is the database/sql session database. See NewSQLDB.
+	SQLDB struct {
+		db      *sql.DB
+		options SQLDBOptions
+		mu      sync.Mutex
+		err     error
+		closed  chan struct{}
+		once    sync.Once
+	}
+)
+
+const (
+	// SQLPerKey stores each value in its own row.
+	SQLPerKey SQLStorageMode = iota
+	// SQLBlob stores all the values of a session serialized in a single column.
+	SQLBlob
+)
+
+// DefaultSQLDBPurgeInterval is the default interval between purges of expired sessions.
+var DefaultSQLDBPurgeInterval = 5 * time.Minute
+
+var _ sessions.Database = (*SQLDB)(nil)
+
+
+type postgresDialect struct{}
+
+func (postgresDialect) Placeholder(n int) string { return fmt.Sprintf("$%d", n) }
+func (postgresDialect) KeyType() string          { return "VARCHAR(255)" }
+func (postgresDialect) BlobType() string         { return "BYTEA" }
+func (d postgresDialect) Upsert(table string, keyColumns []string, valueColumns []string) string {
+	return onConflictUpsert(d, table, keyColumns, valueColumns)
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Placeholder(n int) string { return "?" }
+func (sqliteDialect) KeyType() string          { return "TEXT" }
+func (sqliteDialect) BlobType() string         { return "BLOB" }
+func (d sqliteDialect) Upsert(table string, keyColumns []string, valueColumns []string) string {
+	return onConflictUpsert(d, table, keyColumns, valueColumns)
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Placeholder(n int) string { return "?" }
+func (mysqlDialect) KeyType() string          { return "VARCHAR(255)" }
+func (mysqlDialect) BlobType() string         { return "LONGBLOB" }
+func (d mysqlDialect) Upsert(table string, keyColumns []string, valueColumns []string) string {
+	updates := make([]string, len(valueColumns))
+	for i, column := range valueColumns {
+		updates[i] = fmt.Sprintf("%s = VALUES(%s)", column, column)
+	}
+	return insertStatement(d, table, keyColumns, valueColumns) + " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+}
+
+// The provided dialects.
+var (
+	PostgresDialect SQLDialect = postgresDialect{}
+	MySQLDialect    SQLDialect = mysqlDialect{}
+	SQLiteDialect   SQLDialect = sqliteDialect{}
+)
+
+func insertStatement(dialect SQLDialect, table string, keyColumns []string, valueColumns []string) string {
+	columns := append(append([]string(nil), keyColumns...), valueColumns...)
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = dialect.Placeholder(i + 1)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+}
+
+func onConflictUpsert(dialect SQLDialect, table string, keyColumns []string, valueColumns []string) string {
+	updates := make([]string, len(valueColumns))
+	for i, column := range valueColumns {
+		updates[i] = fmt.Sprintf("%s = EXCLUDED.%s", column, column)
+	}
+	return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s",
+		insertStatement(dialect, table, keyColumns, valueColumns), strings.Join(keyColumns, ", "), strings.Join(updates, ", "))
+}
+
+
+// NewSQLDB returns a session database over the given connection. The schema is
+// not created: call `Migrate` once (e.g. when the application starts).
+func NewSQLDB(db *sql.DB, options SQLDBOptions) *SQLDB {
+	if options.Table == "" {
+		options.Table = "sessions"
+	}
+	if options.PurgeInterval == 0 {
+		options.PurgeInterval = DefaultSQLDBPurgeInterval
+	}
+
+	sqlDB := &SQLDB{db: db, options: options, closed: make(chan struct{})}
+	if options.PurgeInterval > 0 {
+		go sqlDB.purgeLoop()
+	}
+	return sqlDB
+}
+
+func (db *SQLDB) sessionsTable() string { return db.options.Table }
+func (db *SQLDB) valuesTable() string   { return db.options.Table + "_values" }
+func (db *SQLDB) versionTable() string  { return db.options.Table + "_schema" }
+
+// p returns the n-th placeholder of the dialect.
+func (db *SQLDB) p(n int) string {
+	return db.options.Dialect.Placeholder(n)
+}
+
+// migrations returns the statements of each schema version, in order.
+// Never change a released migration: append a new one instead.
+func (db *SQLDB) migrations() [][]string {
+	dialect := db.options.Dialect
+	return [][]string{
+		// 1: sessions and values.
+		{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (sid %s NOT NULL PRIMARY KEY, expires_at BIGINT NULL, data %s NULL)",
+				db.sessionsTable(), dialect.KeyType(), dialect.BlobType()),
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (sid %s NOT NULL, name %s NOT NULL, value %s NOT NULL, PRIMARY KEY (sid, name))",
+				db.valuesTable(), dialect.KeyType(), dialect.KeyType(), dialect.BlobType()),
+		},
+		// 2: expiration index, for the purge.
+		{
+			fmt.Sprintf("CREATE INDEX %s_expires_at ON %s (expires_at)", db.sessionsTable(), db.sessionsTable()),
+		},
+		// 3: revision of the blob, for the optimistic locking of its writes.
+		{
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN revision BIGINT NOT NULL DEFAULT 0", db.sessionsTable()),
+		},
+	}
+}
+
+// SchemaVersion returns the current schema version (0 if there is no schema).
+func (db *SQLDB) SchemaVersion() (int, error) {
+	if _, err := db.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version INTEGER NOT NULL)", db.versionTable())); err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	if err := db.db.QueryRow(fmt.Sprintf("SELECT MAX(version) FROM %s", db.versionTable())).Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Migrate creates or upgrades the schema to the latest version.
+// Each version is applied in its own transaction, where supported.
+func (db *SQLDB) Migrate() error {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	migrations := db.migrations()
+	for version < len(migrations) {
+		tx, err := db.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range migrations[version] {
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migrating sessions schema to version %d: %v", version+1, err)
+			}
+		}
+		version++
+		if _, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (version) VALUES (%s)", db.versionTable(), db.p(1)), version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail keeps the error, since the session database methods cannot report them.
+func (db *SQLDB) fail(err error) {
+	if err != nil && err != sql.ErrNoRows {
+		db.mu.Lock()
+		db.err = err
+		db.mu.Unlock()
+	}
+}
+
+// Err returns the last error talking to the database, if any.
+func (db *SQLDB) Err() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.err
+}
+
+// Acquire receives a session's lifetime from the database. Stored sessions
+// keep their expiration time, so the session manager revives their timers.
+func (db *SQLDB) Acquire(sid string, expires time.Duration) sessions.LifeTime {
+	var expiresAt sql.NullInt64
+	err := db.db.QueryRow(fmt.Sprintf("SELECT expires_at FROM %s WHERE sid = %s", db.sessionsTable(), db.p(1)), sid).Scan(&expiresAt)
+	if err == nil {
+		if !expiresAt.Valid {
+			return sessions.LifeTime{}
+		}
+		if when := time.Unix(expiresAt.Int64, 0); when.After(time.Now()) {
+			return sessions.LifeTime{Time: when}
+		}
+		// expired but not purged yet: start over.
+		db.Release(sid)
+	} else {
+		db.fail(err)
+	}
+
+	newExpiresAt := sql.NullInt64{}
+	if expires > 0 {
+		newExpiresAt = sql.NullInt64{Int64: time.Now().Add(expires).Unix(), Valid: true}
+	}
+	_, err = db.db.Exec(db.options.Dialect.Upsert(db.sessionsTable(), []string{"sid"}, []string{"expires_at", "data"}), sid, newExpiresAt, nil)
+	db.fail(err)
+	return sessions.LifeTime{}
+}
+
+// OnUpdateExpiration stores the new expiration time of the session.
+func (db *SQLDB) OnUpdateExpiration(sid string, newExpires time.Duration) error {
+	result, err := db.db.Exec(fmt.Sprintf("UPDATE %s SET expires_at = %s WHERE sid = %s", db.sessionsTable(), db.p(1), db.p(2)),
+		time.Now().Add(newExpires).Unix(), sid)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// readBlob returns the values of a session in blob mode, and their revision.
+// Whether the session was found is also returned.
+func (db *SQLDB) readBlob(sid string) (map[string][]byte, int64, bool) {
+	var data []byte
+	var revision int64
+	err := db.db.QueryRow(fmt.Sprintf("SELECT data, revision FROM %s WHERE sid = %s", db.sessionsTable(), db.p(1)), sid).Scan(&data, &revision)
+	values := make(map[string][]byte)
+	if err != nil {
+		db.fail(err)
+		return values, 0, false
+	}
+	if len(data) > 0 {
+		db.fail(json.Unmarshal(data, &values))
+	}
+	return values, revision, true
+}
+
+// updateBlob changes the values of a session in blob mode. They are written
+// back only if their revision did not change since they were read (i.e. no
+// concurrent write happened), and read and changed again otherwise, so no
+// concurrent write is lost. Retrying always terminates: each conflict means
+// another write (or a release) succeeded.
+func (db *SQLDB) updateBlob(sid string, change func(values map[string][]byte)) {
+	for {
+		values, revision, found := db.readBlob(sid)
+		if !found {
+			return
+		}
+		change(values)
+		data, err := json.Marshal(values)
+		if err != nil {
+			db.fail(err)
+			return
+		}
+
+		result, err := db.db.Exec(fmt.Sprintf("UPDATE %s SET data = %s, revision = revision + 1 WHERE sid = %s AND revision = %s",
+			db.sessionsTable(), db.p(1), db.p(2), db.p(3)), data, sid, revision)
+		if err != nil {
+			db.fail(err)
+			return
+		}
+		if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+			db.fail(err)
+			return
+		}
+	}
+}
+
+// Set stores a value. The "immutable" flag is not supported.
+func (db *SQLDB) Set(sid string, lifetime sessions.LifeTime, key string, value interface{}, immutable bool) {
+	encoded, err := encodeStoredValue(value)
+	if err != nil {
+		db.fail(err)
+		return
+	}
+
+	if db.options.Mode == SQLBlob {
+		db.updateBlob(sid, func(values map[string][]byte) {
+			values[key] = encoded
+		})
+		return
+	}
+
+	_, err = db.db.Exec(db.options.Dialect.Upsert(db.valuesTable(), []string{"sid", "name"}, []string{"value"}), sid, key, encoded)
+	db.fail(err)
+}
+
+// Get retrieves a value, or nil if it is not found.
+func (db *SQLDB) Get(sid string, key string) interface{} {
+	if db.options.Mode == SQLBlob {
+		values, _, _ := db.readBlob(sid)
+		return decodeStoredValue(values[key])
+	}
+
+	var encoded []byte
+	err := db.db.QueryRow(fmt.Sprintf("SELECT value FROM %s WHERE sid = %s AND name = %s", db.valuesTable(), db.p(1), db.p(2)), sid, key).Scan(&encoded)
+	if err != nil {
+		db.fail(err)
+		return nil
+	}
+	return decodeStoredValue(encoded)
+}
+
+// values returns all the encoded values of a session.
+func (db *SQLDB) values(sid string) map[string][]byte {
+	if db.options.Mode == SQLBlob {
+		values, _, _ := db.readBlob(sid)
+		return values
+	}
+
+	values := make(map[string][]byte)
+	rows, err := db.db.Query(fmt.Sprintf("SELECT name, value FROM %s WHERE sid = %s", db.valuesTable(), db.p(1)), sid)
+	if err != nil {
+		db.fail(err)
+		return values
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var encoded []byte
+		if err := rows.Scan(&key, &encoded); err != nil {
+			db.fail(err)
+			break
+		}
+		values[key] = encoded
+	}
+	db.fail(rows.Err())
+	return values
+}
+
+// Visit loops through all the session's keys and values.
+func (db *SQLDB) Visit(sid string, cb func(key string, value interface{})) {
+	for key, encoded := range db.values(sid) {
+		cb(key, decodeStoredValue(encoded))
+	}
+}
+
+// Len returns the number of the session's keys.
+func (db *SQLDB) Len(sid string) int {
+	if db.options.Mode == SQLBlob {
+		values, _, _ := db.readBlob(sid)
+		return len(values)
+	}
+
+	var n int
+	err := db.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE sid = %s", db.valuesTable(), db.p(1)), sid).Scan(&n)
+	db.fail(err)
+	return n
+}
+
+// Delete removes a key of the session.
+func (db *SQLDB) Delete(sid string, key string) (deleted bool) {
+	if db.options.Mode == SQLBlob {
+		db.updateBlob(sid, func(values map[string][]byte) {
+			_, deleted = values[key]
+			delete(values, key)
+		})
+		return
+	}
+
+	result, err := db.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE sid = %s AND name = %s", db.valuesTable(), db.p(1), db.p(2)), sid, key)
+	if err != nil {
+		db.fail(err)
+		return false
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0
+}
+
+// Clear removes all the keys of the session.
+func (db *SQLDB) Clear(sid string) {
+	if db.options.Mode == SQLBlob {
+		_, err := db.db.Exec(fmt.Sprintf("UPDATE %s SET data = NULL, revision = revision + 1 WHERE sid = %s", db.sessionsTable(), db.p(1)), sid)
+		db.fail(err)
+		return
+	}
+
+	_, err := db.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE sid = %s", db.valuesTable(), db.p(1)), sid)
+	db.fail(err)
+}
+
+// Release removes the session.
+func (db *SQLDB) Release(sid string) {
+	_, err := db.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE sid = %s", db.valuesTable(), db.p(1)), sid)
+	db.fail(err)
+	_, err = db.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE sid = %s", db.sessionsTable(), db.p(1)), sid)
+	db.fail(err)
+}
+
+// Purge removes the expired sessions (and their values).
+func (db *SQLDB) Purge() error {
+	now := time.Now().Unix()
+	if _, err := db.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE sid IN (SELECT sid FROM %s WHERE expires_at IS NOT NULL AND expires_at < %s)",
+		db.valuesTable(), db.sessionsTable(), db.p(1)), now); err != nil {
+		return err
+	}
+	_, err := db.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE expires_at IS NOT NULL AND expires_at < %s", db.sessionsTable(), db.p(1)), now)
+	return err
+}
+
+func (db *SQLDB) purgeLoop() {
+	ticker := time.NewTicker(db.options.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			db.fail(db.Purge())
+		case <-db.closed:
+			return
+		}
+	}
+}
+
+// Close stops the purge. The connection is not closed.
+func (db *SQLDB) Close() error {
+	db.once.Do(func() {
+		close(db.closed)
+	})
+	return nil
+}
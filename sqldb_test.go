@@ -0,0 +1,600 @@
+package jwt_sessions
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+
+// The SQLDB tests run over an in-process fake driver: an in-memory engine
+// understanding just the statements SQLDB sends, in any of the provided
+// dialects. Each statement is atomic, and transactions are not isolated.
+
+
+func init() {
+	sql.Register("jwt_sessions_fake", fakeSQLDriver{})
+}
+
+var (
+	fakeSQLEnginesMu sync.Mutex
+	fakeSQLEngines   = make(map[string]*fakeSQLEngine)
+	// numbers the engines, so a test run again (e.g. -count) gets a new one.
+	fakeSQLEngineSeq uint64
+
+	fakeCreateTable = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+) \((.*)\)$`)
+	fakeCreateIndex = regexp.MustCompile(`^CREATE INDEX (\w+) ON (\w+) \((\w+)\)$`)
+	fakeAddColumn   = regexp.MustCompile(`^ALTER TABLE (\w+) ADD COLUMN (\w+) .* DEFAULT (\d+)$`)
+	fakeInsert      = regexp.MustCompile(`^INSERT INTO (\w+) \(([^)]*)\) VALUES \(([^)]*)\)(?: ON CONFLICT \([^)]*\) DO UPDATE SET (.*)| ON DUPLICATE KEY UPDATE (.*))?$`)
+	fakeSelect      = regexp.MustCompile(`^SELECT (.+?) FROM (\w+)(?: WHERE (.*))?$`)
+	fakeUpdate      = regexp.MustCompile(`^UPDATE (\w+) SET (.+?) WHERE (.*)$`)
+	fakeDelete      = regexp.MustCompile(`^DELETE FROM (\w+)(?: WHERE (.*))?$`)
+	fakeSubquery    = regexp.MustCompile(`^(\w+) IN \(SELECT (\w+) FROM (\w+) WHERE (.*)\)$`)
+	fakeCondition   = regexp.MustCompile(`^(\w+) (=|<|IS NOT) (\S+)$`)
+	fakeAssignment  = regexp.MustCompile(`^(\w+) = (.+)$`)
+)
+
+
+type (
+	fakeSQLDriver struct{}
+
+	fakeSQLEngine struct {
+		mu      sync.Mutex
+		tables  map[string]*fakeSQLTable
+		indexes map[string]bool
+	}
+
+	fakeSQLTable struct {
+		key      []string
+		defaults map[string]driver.Value
+		rows     []map[string]driver.Value
+	}
+
+	fakeSQLConn struct{ engine *fakeSQLEngine }
+	fakeSQLStmt struct {
+		engine *fakeSQLEngine
+		query  string
+	}
+	fakeSQLTx struct{}
+
+	fakeSQLRows struct {
+		columns []string
+		rows    [][]driver.Value
+	}
+
+	// fakeSQLArgs binds the placeholders of a statement to its arguments.
+	fakeSQLArgs struct {
+		args []driver.Value
+		next int
+	}
+
+	// fakeSQLCondition is a condition of a WHERE clause, bound to its arguments.
+	fakeSQLCondition struct {
+		column string
+		op     string
+		value  driver.Value
+		in     map[string]bool
+	}
+)
+
+
+func (fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	fakeSQLEnginesMu.Lock()
+	defer fakeSQLEnginesMu.Unlock()
+	engine, ok := fakeSQLEngines[name]
+	if !ok {
+		engine = &fakeSQLEngine{tables: make(map[string]*fakeSQLTable), indexes: make(map[string]bool)}
+		fakeSQLEngines[name] = engine
+	}
+	return &fakeSQLConn{engine: engine}, nil
+}
+
+func (conn *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{engine: conn.engine, query: query}, nil
+}
+func (conn *fakeSQLConn) Close() error              { return nil }
+func (conn *fakeSQLConn) Begin() (driver.Tx, error) { return fakeSQLTx{}, nil }
+
+func (fakeSQLTx) Commit() error   { return nil }
+func (fakeSQLTx) Rollback() error { return nil }
+
+func (stmt *fakeSQLStmt) Close() error  { return nil }
+func (stmt *fakeSQLStmt) NumInput() int { return -1 }
+
+func (stmt *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	stmt.engine.mu.Lock()
+	defer stmt.engine.mu.Unlock()
+	affected, err := stmt.engine.exec(stmt.query, &fakeSQLArgs{args: args})
+	return driver.RowsAffected(affected), err
+}
+
+func (stmt *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	// let other statements run in between, as they would over a network.
+	defer time.Sleep(time.Millisecond)
+	stmt.engine.mu.Lock()
+	defer stmt.engine.mu.Unlock()
+	return stmt.engine.query(stmt.query, &fakeSQLArgs{args: args})
+}
+
+func (rows *fakeSQLRows) Columns() []string { return rows.columns }
+func (rows *fakeSQLRows) Close() error      { return nil }
+func (rows *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(rows.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.rows[0])
+	rows.rows = rows.rows[1:]
+	return nil
+}
+
+// bind returns the value of a placeholder ("?" or "$n"), or of a literal.
+func (args *fakeSQLArgs) bind(token string) driver.Value {
+	switch {
+	case token == "?":
+		args.next++
+		return args.args[args.next-1]
+	case strings.HasPrefix(token, "$"):
+		n, _ := strconv.Atoi(token[1:])
+		return args.args[n-1]
+	case token == "NULL":
+		return nil
+	}
+	n, _ := strconv.ParseInt(token, 10, 64)
+	return n
+}
+
+func fakeSQLEqual(a, b driver.Value) bool {
+	if bytes, ok := a.([]byte); ok {
+		a = string(bytes)
+	}
+	if bytes, ok := b.([]byte); ok {
+		b = string(bytes)
+	}
+	return a == b
+}
+
+func fakeSQLCopy(value driver.Value) driver.Value {
+	if bytes, ok := value.([]byte); ok {
+		return append([]byte(nil), bytes...)
+	}
+	return value
+}
+
+// splitTopLevel splits by commas outside of parentheses.
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+func (engine *fakeSQLEngine) table(name string) (*fakeSQLTable, error) {
+	table, ok := engine.tables[name]
+	if !ok {
+		return nil, fmt.Errorf("no such table: %s", name)
+	}
+	return table, nil
+}
+
+// where binds the conditions of a WHERE clause (joined by AND).
+func (engine *fakeSQLEngine) where(clause string, args *fakeSQLArgs) ([]fakeSQLCondition, error) {
+	if clause == "" {
+		return nil, nil
+	}
+	if match := fakeSubquery.FindStringSubmatch(clause); match != nil {
+		table, err := engine.table(match[3])
+		if err != nil {
+			return nil, err
+		}
+		conditions, err := engine.where(match[4], args)
+		if err != nil {
+			return nil, err
+		}
+		in := make(map[string]bool)
+		for _, row := range table.matching(conditions) {
+			in[fmt.Sprint(row[match[2]])] = true
+		}
+		return []fakeSQLCondition{{column: match[1], op: "IN", in: in}}, nil
+	}
+
+	var conditions []fakeSQLCondition
+	for _, term := range strings.Split(clause, " AND ") {
+		match := fakeCondition.FindStringSubmatch(term)
+		if match == nil {
+			return nil, fmt.Errorf("unsupported condition: %s", term)
+		}
+		condition := fakeSQLCondition{column: match[1], op: match[2]}
+		if condition.op != "IS NOT" {
+			condition.value = args.bind(match[3])
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+func (condition fakeSQLCondition) matches(row map[string]driver.Value) bool {
+	value := row[condition.column]
+	switch condition.op {
+	case "IN":
+		return condition.in[fmt.Sprint(value)]
+	case "IS NOT":
+		return value != nil
+	case "<":
+		a, ok1 := value.(int64)
+		b, ok2 := condition.value.(int64)
+		return ok1 && ok2 && a < b
+	}
+	return fakeSQLEqual(value, condition.value)
+}
+
+func fakeSQLMatches(row map[string]driver.Value, conditions []fakeSQLCondition) bool {
+	for _, condition := range conditions {
+		if !condition.matches(row) {
+			return false
+		}
+	}
+	return true
+}
+
+func (table *fakeSQLTable) matching(conditions []fakeSQLCondition) []map[string]driver.Value {
+	var rows []map[string]driver.Value
+	for _, row := range table.rows {
+		if fakeSQLMatches(row, conditions) {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// find returns the row with the same primary key, if any.
+func (table *fakeSQLTable) find(row map[string]driver.Value) map[string]driver.Value {
+	if len(table.key) == 0 {
+		return nil
+	}
+	for _, existing := range table.rows {
+		same := true
+		for _, column := range table.key {
+			same = same && fakeSQLEqual(existing[column], row[column])
+		}
+		if same {
+			return existing
+		}
+	}
+	return nil
+}
+
+func (engine *fakeSQLEngine) exec(query string, args *fakeSQLArgs) (int64, error) {
+	if match := fakeCreateTable.FindStringSubmatch(query); match != nil {
+		if _, ok := engine.tables[match[1]]; ok {
+			return 0, nil
+		}
+		table := &fakeSQLTable{defaults: make(map[string]driver.Value)}
+		for _, definition := range splitTopLevel(match[2]) {
+			if strings.HasPrefix(definition, "PRIMARY KEY (") {
+				table.key = strings.Split(strings.TrimSuffix(strings.TrimPrefix(definition, "PRIMARY KEY ("), ")"), ", ")
+			} else if strings.HasSuffix(definition, "PRIMARY KEY") {
+				table.key = []string{strings.Fields(definition)[0]}
+			}
+		}
+		engine.tables[match[1]] = table
+		return 0, nil
+	}
+
+	if match := fakeCreateIndex.FindStringSubmatch(query); match != nil {
+		if engine.indexes[match[1]] {
+			return 0, fmt.Errorf("index %s already exists", match[1])
+		}
+		engine.indexes[match[1]] = true
+		return 0, nil
+	}
+
+	if match := fakeAddColumn.FindStringSubmatch(query); match != nil {
+		table, err := engine.table(match[1])
+		if err != nil {
+			return 0, err
+		}
+		value, _ := strconv.ParseInt(match[3], 10, 64)
+		table.defaults[match[2]] = value
+		for _, row := range table.rows {
+			row[match[2]] = value
+		}
+		return 0, nil
+	}
+
+	if match := fakeInsert.FindStringSubmatch(query); match != nil {
+		table, err := engine.table(match[1])
+		if err != nil {
+			return 0, err
+		}
+		row := make(map[string]driver.Value)
+		for column, value := range table.defaults {
+			row[column] = value
+		}
+		values := strings.Split(match[3], ", ")
+		for i, column := range strings.Split(match[2], ", ") {
+			row[column] = fakeSQLCopy(args.bind(values[i]))
+		}
+		updates := match[4] + match[5]
+
+		existing := table.find(row)
+		if existing == nil {
+			table.rows = append(table.rows, row)
+			return 1, nil
+		}
+		if updates == "" {
+			return 0, fmt.Errorf("duplicate key in %s", match[1])
+		}
+		for _, update := range strings.Split(updates, ", ") {
+			column := strings.Fields(update)[0]
+			existing[column] = row[column]
+		}
+		return 1, nil
+	}
+
+	if match := fakeUpdate.FindStringSubmatch(query); match != nil {
+		table, err := engine.table(match[1])
+		if err != nil {
+			return 0, err
+		}
+		type assignment struct {
+			column, increment string
+			value             driver.Value
+		}
+		var assignments []assignment
+		for _, part := range strings.Split(match[2], ", ") {
+			set := fakeAssignment.FindStringSubmatch(part)
+			if set == nil {
+				return 0, fmt.Errorf("unsupported assignment: %s", part)
+			}
+			if strings.HasSuffix(set[2], " + 1") {
+				assignments = append(assignments, assignment{column: set[1], increment: strings.Fields(set[2])[0]})
+			} else {
+				assignments = append(assignments, assignment{column: set[1], value: fakeSQLCopy(args.bind(set[2]))})
+			}
+		}
+		conditions, err := engine.where(match[3], args)
+		if err != nil {
+			return 0, err
+		}
+		rows := table.matching(conditions)
+		for _, row := range rows {
+			for _, a := range assignments {
+				if a.increment != "" {
+					row[a.column] = row[a.increment].(int64) + 1
+				} else {
+					row[a.column] = a.value
+				}
+			}
+		}
+		return int64(len(rows)), nil
+	}
+
+	if match := fakeDelete.FindStringSubmatch(query); match != nil {
+		table, err := engine.table(match[1])
+		if err != nil {
+			return 0, err
+		}
+		conditions, err := engine.where(match[2], args)
+		if err != nil {
+			return 0, err
+		}
+		kept := table.rows[:0]
+		for _, row := range table.rows {
+			if !fakeSQLMatches(row, conditions) {
+				kept = append(kept, row)
+			}
+		}
+		deleted := int64(len(table.rows) - len(kept))
+		table.rows = kept
+		return deleted, nil
+	}
+
+	return 0, fmt.Errorf("unsupported statement: %s", query)
+}
+
+func (engine *fakeSQLEngine) query(query string, args *fakeSQLArgs) (driver.Rows, error) {
+	match := fakeSelect.FindStringSubmatch(query)
+	if match == nil {
+		return nil, fmt.Errorf("unsupported query: %s", query)
+	}
+	table, err := engine.table(match[2])
+	if err != nil {
+		return nil, err
+	}
+	conditions, err := engine.where(match[3], args)
+	if err != nil {
+		return nil, err
+	}
+	rows := table.matching(conditions)
+
+	columns := strings.Split(match[1], ", ")
+	result := &fakeSQLRows{columns: columns}
+	switch {
+	case columns[0] == "COUNT(*)":
+		result.rows = [][]driver.Value{{int64(len(rows))}}
+	case strings.HasPrefix(columns[0], "MAX("):
+		column := strings.TrimSuffix(strings.TrimPrefix(columns[0], "MAX("), ")")
+		var max driver.Value
+		for _, row := range rows {
+			if max == nil || row[column].(int64) > max.(int64) {
+				max = row[column]
+			}
+		}
+		result.rows = [][]driver.Value{{max}}
+	default:
+		for _, row := range rows {
+			values := make([]driver.Value, len(columns))
+			for i, column := range columns {
+				values[i] = fakeSQLCopy(row[column])
+			}
+			result.rows = append(result.rows, values)
+		}
+	}
+	return result, nil
+}
+
+
+// newFakeSQLDB returns a migrated database over a new fake engine.
+func newFakeSQLDB(t *testing.T, dialect SQLDialect, mode SQLStorageMode) *SQLDB {
+	name := fmt.Sprintf("%s/%T/%d/%d", t.Name(), dialect, mode, atomic.AddUint64(&fakeSQLEngineSeq, 1))
+	conn, err := sql.Open("jwt_sessions_fake", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewSQLDB(conn, SQLDBOptions{Dialect: dialect, Mode: mode, PurgeInterval: -1})
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// forEachSQLDB runs a test over each dialect and storage mode.
+func forEachSQLDB(t *testing.T, test func(t *testing.T, db *SQLDB)) {
+	dialects := map[string]SQLDialect{"postgres": PostgresDialect, "mysql": MySQLDialect, "sqlite": SQLiteDialect}
+	modes := map[string]SQLStorageMode{"per-key": SQLPerKey, "blob": SQLBlob}
+	for dialectName, dialect := range dialects {
+		for modeName, mode := range modes {
+			dialect, mode := dialect, mode
+			t.Run(dialectName+"/"+modeName, func(t *testing.T) {
+				db := newFakeSQLDB(t, dialect, mode)
+				defer db.Close()
+				test(t, db)
+				if err := db.Err(); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+
+func TestSQLDBMigrate(t *testing.T) {
+	db := newFakeSQLDB(t, PostgresDialect, SQLPerKey)
+	version, err := db.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(db.migrations()) {
+		t.Fatalf("got schema version %d, want %d", version, len(db.migrations()))
+	}
+	// the index would be created twice if a migration was applied again.
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLDBStoresValues(t *testing.T) {
+	forEachSQLDB(t, func(t *testing.T, db *SQLDB) {
+		lifetime := db.Acquire("a", time.Hour)
+		db.Set("a", lifetime, "count", 2.0, false)
+		db.Set("a", lifetime, "name", "alice", false)
+		db.Set("a", lifetime, "name", "bob", false)
+
+		if got := db.Get("a", "count"); got != 2.0 {
+			t.Fatalf("count: got %#v, want 2", got)
+		}
+		if got := db.Get("a", "name"); got != "bob" {
+			t.Fatalf("name: got %#v, want bob", got)
+		}
+		if db.Get("a", "missing") != nil || db.Get("b", "name") != nil {
+			t.Fatal("got a value which was not set")
+		}
+		visited := make(map[string]interface{})
+		db.Visit("a", func(key string, value interface{}) { visited[key] = value })
+		if db.Len("a") != 2 || len(visited) != 2 || visited["name"] != "bob" {
+			t.Fatalf("got %d values, visited %v", db.Len("a"), visited)
+		}
+
+		if !db.Delete("a", "count") || db.Delete("a", "count") {
+			t.Fatal("the value was not deleted once")
+		}
+		db.Clear("a")
+		if db.Len("a") != 0 {
+			t.Fatal("the values were not cleared")
+		}
+		db.Set("a", lifetime, "name", "carol", false)
+		db.Release("a")
+		if db.Len("a") != 0 || !db.Acquire("a", time.Hour).IsZero() {
+			t.Fatal("the session was not released")
+		}
+	})
+}
+
+func TestSQLDBKeepsTheLifetime(t *testing.T) {
+	forEachSQLDB(t, func(t *testing.T, db *SQLDB) {
+		if !db.Acquire("a", time.Hour).IsZero() {
+			t.Fatal("a new session has a stored lifetime")
+		}
+		lifetime := db.Acquire("a", time.Minute)
+		if remaining := time.Until(lifetime.Time); remaining < 50*time.Minute || remaining > time.Hour {
+			t.Fatalf("got %v remaining, want about an hour", remaining)
+		}
+
+		if err := db.OnUpdateExpiration("a", 2*time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		lifetime = db.Acquire("a", time.Minute)
+		if remaining := time.Until(lifetime.Time); remaining < 110*time.Minute {
+			t.Fatalf("got %v remaining, want about two hours", remaining)
+		}
+		if err := db.OnUpdateExpiration("missing", time.Hour); !ErrNotFound.Equal(err) {
+			t.Fatalf("got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestSQLDBPurgesTheExpiredSessions(t *testing.T) {
+	forEachSQLDB(t, func(t *testing.T, db *SQLDB) {
+		db.Set("expired", db.Acquire("expired", time.Hour), "name", "alice", false)
+		db.Set("live", db.Acquire("live", time.Hour), "name", "bob", false)
+		db.OnUpdateExpiration("expired", -time.Hour)
+
+		if err := db.Purge(); err != nil {
+			t.Fatal(err)
+		}
+		if db.Len("expired") != 0 {
+			t.Fatal("the expired session was not purged")
+		}
+		if db.Get("live", "name") != "bob" {
+			t.Fatal("the live session was purged")
+		}
+	})
+}
+
+func TestSQLDBConcurrentSetsAreNotLost(t *testing.T) {
+	forEachSQLDB(t, func(t *testing.T, db *SQLDB) {
+		lifetime := db.Acquire("a", time.Hour)
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				db.Set("a", lifetime, fmt.Sprintf("key%d", i), i, false)
+			}(i)
+		}
+		wg.Wait()
+		if n := db.Len("a"); n != 20 {
+			t.Fatalf("got %d values, want 20", n)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package jwt_sessions
+
+import (
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/context"
+)
+
+
+// Authentication events (a login, a re-authentication, a passed MFA challenge)
+// are recorded in the session with their time and assurance level. The token
+// exposes the current level in "acr-like" claims: "acr" (the level), "amr"
+// (the methods) and "auth_time" (the last authentication) until the events
+// decay (see Config.AssuranceDecay), when the middleware re-issues the token.
+
+
+const (
+	authEventsKey = internalKeyPrefix + "auth_events"
+	acrClaim      = "acr"
+	amrClaim      = "amr"
+	authTimeClaim = "auth_time"
+
+	// only the most recent events are kept in the session.
+	maxAuthEvents = 16
+)
+
+
+// AuthEvent is an authentication of the session's user.
+type AuthEvent struct {
+	// The method used to authenticate (e.g. "pwd", "otp", "hwk").
+	Method string
+	// The assurance level reached by the authentication.
+	Level int
+	// When the authentication happened.
+	Time time.Time
+}
+
+
+// AuthEvents returns the authentication events recorded in this session,
+// oldest first.
+func (s *JWTSession) AuthEvents() []AuthEvent {
+	events, _ := s.get(authEventsKey).([]AuthEvent)
+	return append([]AuthEvent(nil), events...)
+}
+
+// AuthenticatedSince returns the time of the most recent authentication
+// reaching at least the given level, if any.
+func (s *JWTSession) AuthenticatedSince(minLevel int) (time.Time, bool) {
+	events := s.AuthEvents()
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Level >= minLevel {
+			return events[i].Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Authenticate records an authentication event in the request's session
+// (started if needed) and re-issues the token with the new assurance level.
+func (sessions *JWTSessions) Authenticate(ctx context.Context, method string, level int) {
+	sess := sessions.Start(ctx)
+
+	event := AuthEvent{Method: method, Level: level, Time: time.Now()}
+	events := append(sess.AuthEvents(), event)
+	if len(events) > maxAuthEvents {
+		events = events[len(events)-maxAuthEvents:]
+	}
+	sess.set(authEventsKey, events, false)
+	sessions.provider.fireSessionEvent(sess, Event{Kind: EventAuthenticate, Time: event.Time, Value: event, Context: ctx})
+
+	claims := sessions.tokenClaims(ctx, sess.ID())
+	sessions.assuranceClaims(sess, claims)
+	sessions.issueJWT(ctx, claims)
+}
+
+// AssuranceLevel returns the highest level among the authentication
+// events of the session which did not decay yet.
+func (sessions *JWTSessions) AssuranceLevel(sess *JWTSession) int {
+	level := 0
+	for _, event := range sessions.liveAuthEvents(sess) {
+		if event.Level > level {
+			level = event.Level
+		}
+	}
+	return level
+}
+
+func (sessions *JWTSessions) liveAuthEvents(sess *JWTSession) []AuthEvent {
+	events := sess.AuthEvents()
+	if sessions.config.AssuranceDecay <= 0 {
+		return events
+	}
+
+	live := events[:0]
+	for _, event := range events {
+		if time.Since(event.Time) <= sessions.config.AssuranceDecay {
+			live = append(live, event)
+		}
+	}
+	return live
+}
+
+// assuranceClaims sets (or removes, if everything decayed) the assurance
+// claims of the session into the given claims.
+func (sessions *JWTSessions) assuranceClaims(sess *JWTSession, claims jwt.MapClaims) {
+	delete(claims, acrClaim)
+	delete(claims, amrClaim)
+	delete(claims, authTimeClaim)
+
+	events := sessions.liveAuthEvents(sess)
+	if len(events) == 0 {
+		return
+	}
+
+	level := 0
+	methods := make([]string, 0, len(events))
+	seen := make(map[string]bool, len(events))
+	for _, event := range events {
+		if event.Level > level {
+			level = event.Level
+		}
+		if !seen[event.Method] {
+			seen[event.Method] = true
+			methods = append(methods, event.Method)
+		}
+	}
+	claims[acrClaim] = level
+	claims[amrClaim] = methods
+	claims[authTimeClaim] = events[len(events)-1].Time.Unix()
+}
+
+// refreshAssurance re-issues the request's token if its assurance level
+// is not the current one of the session (i.e. some events decayed).
+func (sessions *JWTSessions) refreshAssurance(ctx context.Context) {
+	sess := Get(ctx)
+	current := sessions.claimsFromContext(ctx)
+	if sess == nil || !sess.IsSaved() || current == nil {
+		return
+	}
+
+	if level, _ := toFloat64(current[acrClaim]); int(level) != sessions.AssuranceLevel(sess) {
+		claims := sessions.tokenClaims(ctx, sess.ID())
+		sessions.assuranceClaims(sess, claims)
+		sessions.issueJWT(ctx, claims)
+	}
+}
+
+// RequireRecentAuth returns a middleware which only lets the request go on if
+// the session's user authenticated with at least the given level in the last
+// "maxAge". Otherwise, it responds with 401 (so the client may step up).
+func (sessions *JWTSessions) RequireRecentAuth(maxAge time.Duration, minLevel int, onFailure context.Handler) context.Handler {
+	fail := failWith(iris.StatusUnauthorized, onFailure)
+	return func(ctx context.Context) {
+		sess := sessions.existingSession(ctx)
+		if sess == nil {
+			fail(ctx)
+			return
+		}
+		if when, ok := sess.AuthenticatedSince(minLevel); !ok || time.Since(when) > maxAge {
+			fail(ctx)
+			return
+		}
+		ctx.Next()
+	}
+}
@@ -0,0 +1,136 @@
+package jwt_sessions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/context"
+)
+
+
+// tokenClaimsOf parses the token issued for a request.
+func tokenClaimsOf(t *testing.T, sessions *JWTSessions, ctx context.Context) jwt.MapClaims {
+	t.Helper()
+	issued := issuedToken(ctx)
+	if issued == "" {
+		t.Fatal("no token issued")
+	}
+	token, err := sessions.config.Parser.Parse(issued[len("Bearer "):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.Claims.(jwt.MapClaims)
+}
+
+// checkAssurance fails the test if the claims do not carry the given assurance.
+func checkAssurance(t *testing.T, claims jwt.MapClaims, level int, methods []string, authTime time.Time) {
+	t.Helper()
+	if acr, _ := toFloat64(claims[acrClaim]); int(acr) != level {
+		t.Errorf("got acr %v, want %d", claims[acrClaim], level)
+	}
+	amr, _ := claims[amrClaim].([]interface{})
+	if len(amr) != len(methods) {
+		t.Fatalf("got amr %v, want %v", claims[amrClaim], methods)
+	}
+	for i, method := range methods {
+		if amr[i] != method {
+			t.Errorf("got amr %v, want %v", amr, methods)
+		}
+	}
+	if when, _ := toFloat64(claims[authTimeClaim]); int64(when) != authTime.Unix() {
+		t.Errorf("got auth_time %v, want %d", claims[authTimeClaim], authTime.Unix())
+	}
+}
+
+
+func TestAuthenticateIssuesTheAssuranceClaims(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	sessions.Authenticate(ctx, "pwd", 1)
+	sessions.Authenticate(ctx, "otp", 2)
+
+	events := sess.AuthEvents()
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	checkAssurance(t, tokenClaimsOf(t, sessions, ctx), 2, []string{"pwd", "otp"}, events[1].Time)
+	if sessions.AssuranceLevel(sess) != 2 {
+		t.Fatalf("got the level %d, want 2", sessions.AssuranceLevel(sess))
+	}
+}
+
+func TestReissuedTokensCarryTheAssuranceClaims(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	sessions.Authenticate(ctx, "pwd", 1)
+	authTime := sess.AuthEvents()[0].Time
+
+	// a later request re-issues the token for another reason.
+	next := newTestContext(issuedToken(ctx))
+	sessions.SetScopes(next, "profile")
+	claims := tokenClaimsOf(t, sessions, next)
+	checkAssurance(t, claims, 1, []string{"pwd"}, authTime)
+	if claims[scopeClaim] != "profile" {
+		t.Fatalf("got the scope %v", claims[scopeClaim])
+	}
+}
+
+func TestHandlerRefreshesDecayedAssurance(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour, AssuranceDecay: time.Minute})
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	sessions.Authenticate(ctx, "pwd", 1)
+	token := issuedToken(ctx)
+	// the event decays.
+	sess.set(authEventsKey, []AuthEvent{{Method: "pwd", Level: 1, Time: time.Now().Add(-time.Hour)}}, false)
+
+	response := serveWithHandler(t, sessions, token, func(ctx context.Context) {
+		if level, _ := toFloat64(Claims(ctx)[acrClaim]); level != 0 {
+			t.Errorf("the handler saw the level %v", level)
+		}
+		ctx.WriteString("body")
+	})
+	refreshed := response.Header().Get("Authorization")
+	if refreshed == "" || refreshed == token {
+		t.Fatal("the token was not refreshed")
+	}
+	parsed, err := sessions.config.Parser.Parse(refreshed[len("Bearer "):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := parsed.Claims.(jwt.MapClaims)[acrClaim]; found {
+		t.Fatal("the refreshed token still claims the decayed level")
+	}
+}
+
+func TestRequireRecentAuth(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	guard := sessions.RequireRecentAuth(10*time.Minute, 2, nil)
+
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	sessions.Authenticate(ctx, "otp", 2)
+	if _, reached := serveGuarded(t, sessions, issuedToken(ctx), guard); !reached {
+		t.Error("a recent authentication was refused")
+	}
+
+	// a stale one.
+	sess.set(authEventsKey, []AuthEvent{{Method: "otp", Level: 2, Time: time.Now().Add(-time.Hour)}}, false)
+	if code, reached := serveGuarded(t, sessions, issuedToken(ctx), guard); reached || code != iris.StatusUnauthorized {
+		t.Errorf("a stale authentication: got %d (reached: %v), want 401", code, reached)
+	}
+
+	// a recent one, with a lower level.
+	sess.set(authEventsKey, []AuthEvent{{Method: "pwd", Level: 1, Time: time.Now()}}, false)
+	if code, reached := serveGuarded(t, sessions, issuedToken(ctx), guard); reached || code != iris.StatusUnauthorized {
+		t.Errorf("a lower level: got %d (reached: %v), want 401", code, reached)
+	}
+
+	if code, reached := serveGuarded(t, sessions, "", guard); reached || code != iris.StatusUnauthorized {
+		t.Errorf("without a session: got %d (reached: %v), want 401", code, reached)
+	}
+}
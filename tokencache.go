@@ -0,0 +1,207 @@
+package jwt_sessions
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+
+// A TokenCache keeps the claims of the tokens already verified by a JWTParser
+// (see JWTParser.Cache), so a token sent again skips the signature check. It
+// is keyed by a hash of the raw token, and an entry lasts until the earlier
+// of the token's expiration ("exp") and the cache's TTL.
+//
+// An entry also remembers the key which verified the token: if the parser's
+// ValidationKeyGetter returns a different key (i.e. the keys were rotated),
+// the token is verified again. The tokens of the sessions destroyed by the
+// manager using the cache are removed; other revoked tokens must be removed
+// with Revoke or RevokeWhere.
+
+
+// Default values of TokenCacheOptions.
+var (
+	DefaultTokenCacheMaxEntries = 10000
+	DefaultTokenCacheTTL        = 5 * time.Minute
+)
+
+
+type (
+	// TokenCacheOptions configures a TokenCache.
+	TokenCacheOptions struct {
+		// The maximum number of cached tokens, evicted in LRU order.
+		// Default value: DefaultTokenCacheMaxEntries.
+		MaxEntries int
+		// The maximum time a token is cached.
+		// Default value: DefaultTokenCacheTTL.
+		TTL time.Duration
+	}
+
+	// TokenCache is the verified-token cache. See NewTokenCache.
+	TokenCache struct {
+		options TokenCacheOptions
+		mu      sync.Mutex
+		entries map[[sha256.Size]byte]*list.Element
+		lru     *list.List
+	}
+
+	tokenCacheEntry struct {
+		hash    [sha256.Size]byte
+		header  map[string]interface{}
+		method  jwt.SigningMethod
+		claims  jwt.MapClaims
+		key     interface{}
+		expires time.Time
+	}
+)
+
+
+// NewTokenCache returns an empty verified-token cache.
+func NewTokenCache(options TokenCacheOptions) *TokenCache {
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = DefaultTokenCacheMaxEntries
+	}
+	if options.TTL <= 0 {
+		options.TTL = DefaultTokenCacheTTL
+	}
+	return &TokenCache{
+		options: options,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached, still valid, token, if verified with the key
+// the keyfunc returns now.
+func (cache *TokenCache) get(raw string, keyfunc jwt.Keyfunc) (*jwt.Token, bool) {
+	hash := sha256.Sum256([]byte(raw))
+
+	cache.mu.Lock()
+	element, found := cache.entries[hash]
+	if !found {
+		cache.mu.Unlock()
+		return nil, false
+	}
+	entry := element.Value.(*tokenCacheEntry)
+	if time.Now().After(entry.expires) {
+		cache.remove(element)
+		cache.mu.Unlock()
+		return nil, false
+	}
+	cache.lru.MoveToFront(element)
+	cache.mu.Unlock()
+
+	token := &jwt.Token{
+		Raw:    raw,
+		Method: entry.method,
+		Header: entry.header,
+		Claims: copyClaims(entry.claims),
+		Valid:  true,
+	}
+	if key, err := keyfunc(token); err != nil || !sameKey(key, entry.key) {
+		cache.Revoke(raw)
+		return nil, false
+	}
+	return token, true
+}
+
+// put caches a verified token.
+func (cache *TokenCache) put(token *jwt.Token, key interface{}) {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return
+	}
+
+	expires := time.Now().Add(cache.options.TTL)
+	if exp, ok := claims["exp"].(float64); ok {
+		if tokenExpires := time.Unix(int64(exp), 0); tokenExpires.Before(expires) {
+			expires = tokenExpires
+		}
+	}
+	entry := &tokenCacheEntry{
+		hash:    sha256.Sum256([]byte(token.Raw)),
+		header:  token.Header,
+		method:  token.Method,
+		claims:  copyClaims(claims),
+		key:     key,
+		expires: expires,
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if element, found := cache.entries[entry.hash]; found {
+		cache.remove(element)
+	}
+	cache.entries[entry.hash] = cache.lru.PushFront(entry)
+	for cache.lru.Len() > cache.options.MaxEntries {
+		cache.remove(cache.lru.Back())
+	}
+}
+
+// remove removes an entry. The lock must be held.
+func (cache *TokenCache) remove(element *list.Element) {
+	cache.lru.Remove(element)
+	delete(cache.entries, element.Value.(*tokenCacheEntry).hash)
+}
+
+// Revoke removes a token, which will be verified again if it is sent.
+func (cache *TokenCache) Revoke(raw string) {
+	hash := sha256.Sum256([]byte(raw))
+	cache.mu.Lock()
+	if element, found := cache.entries[hash]; found {
+		cache.remove(element)
+	}
+	cache.mu.Unlock()
+}
+
+// RevokeWhere removes the tokens whose claims match the predicate,
+// e.g. all the tokens of a subject or of a session.
+func (cache *TokenCache) RevokeWhere(predicate func(claims jwt.MapClaims) bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for element := cache.lru.Front(); element != nil; {
+		next := element.Next()
+		if predicate(element.Value.(*tokenCacheEntry).claims) {
+			cache.remove(element)
+		}
+		element = next
+	}
+}
+
+// Purge removes all the tokens, e.g. after rotating the keys
+// without changing what the ValidationKeyGetter returns.
+func (cache *TokenCache) Purge() {
+	cache.mu.Lock()
+	cache.entries = make(map[[sha256.Size]byte]*list.Element)
+	cache.lru.Init()
+	cache.mu.Unlock()
+}
+
+// Len returns the number of cached tokens.
+func (cache *TokenCache) Len() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.lru.Len()
+}
+
+func copyClaims(claims jwt.MapClaims) jwt.MapClaims {
+	copied := make(jwt.MapClaims, len(claims))
+	for name, value := range claims {
+		copied[name] = value
+	}
+	return copied
+}
+
+// sameKey tells whether two verification keys are the same.
+func sameKey(a interface{}, b interface{}) bool {
+	if aBytes, ok := a.([]byte); ok {
+		bBytes, ok := b.([]byte)
+		return ok && bytes.Equal(aBytes, bBytes)
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,66 @@
+package jwt_sessions
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+
+// cachedToken tells whether the token of an authorization header is cached.
+func cachedToken(sessions *JWTSessions, authorization string) bool {
+	parser := sessions.config.Parser
+	_, found := parser.Cache.get(strings.TrimPrefix(authorization, "Bearer "), parser.ValidationKeyGetter)
+	return found
+}
+
+
+func TestTokenCacheVerifiesOnce(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour, Parser: JWTParser{Cache: NewTokenCache(TokenCacheOptions{})}})
+	ctx := newTestContext("")
+	sessions.Start(ctx).Set("user_id", 7)
+	token := issuedToken(ctx)
+
+	sessions.Start(newTestContext(token))
+	if !cachedToken(sessions, token) {
+		t.Fatal("the verified token was not cached")
+	}
+	if sess := sessions.Start(newTestContext(token)); sess.Get("user_id") != 7 {
+		t.Fatalf("user_id: got %#v from the cached token", sess.Get("user_id"))
+	}
+}
+
+func TestDestroyRevokesTheCachedTokensOfTheSession(t *testing.T) {
+	for name, destroy := range map[string]func(sessions *JWTSessions, token string){
+		"revoked": func(sessions *JWTSessions, token string) {
+			sessions.DestroyByID(sessions.Start(newTestContext(token)).ID())
+		},
+		"logout": func(sessions *JWTSessions, token string) {
+			sessions.Destroy(newTestContext(token))
+		},
+	} {
+		destroy := destroy
+		t.Run(name, func(t *testing.T) {
+			cache := NewTokenCache(TokenCacheOptions{})
+			sessions := newTestSessions(Config{Expires: time.Hour, Parser: JWTParser{Cache: cache}})
+			var tokens []string
+			for i := 0; i < 2; i++ {
+				ctx := newTestContext("")
+				sessions.Start(ctx).Set("user_id", i)
+				tokens = append(tokens, issuedToken(ctx))
+				sessions.Start(newTestContext(tokens[i]))
+			}
+			if cache.Len() != 2 {
+				t.Fatalf("%d tokens were cached, want 2", cache.Len())
+			}
+
+			destroy(sessions, tokens[0])
+			if cachedToken(sessions, tokens[0]) {
+				t.Fatal("the token of the destroyed session is still cached")
+			}
+			if !cachedToken(sessions, tokens[1]) {
+				t.Fatal("the token of another session was revoked")
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package jwt_sessions
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/sessions"
+)
+
+
+// Tracing hooks: a Tracer starts a Span around starting a session (see
+// `UseTracer`), parsing and serializing a token (see JWTParser.Tracer) and
+// every call to the session database (see TracedDB). The interface is kept
+// minimal, so it can be bridged to any tracing system. By default, nothing
+// is traced (see NoopTracer), and RecordingTracer keeps the spans in memory
+// for tests.
+
+
+type (
+	// Tracer starts the spans.
+	Tracer interface {
+		StartSpan(name string) Span
+	}
+
+	// Span is a timed operation, ended once.
+	Span interface {
+		SetAttribute(key string, value interface{})
+		End()
+	}
+
+	noopTracer struct{}
+	noopSpan   struct{}
+
+	// RecordedSpan is a span ended in a RecordingTracer.
+	RecordedSpan struct {
+		Name       string
+		Start      time.Time
+		End        time.Time
+		Attributes map[string]interface{}
+	}
+
+	// RecordingTracer keeps the ended spans in memory, e.g. for tests.
+	RecordingTracer struct {
+		mu    sync.Mutex
+		spans []RecordedSpan
+	}
+
+	recordingSpan struct {
+		tracer *RecordingTracer
+		span   RecordedSpan
+		ended  bool
+		mu     sync.Mutex
+	}
+
+	// TracedDB is a session database starting a span around each call
+	// to another database.
+	TracedDB struct {
+		inner  sessions.Database
+		tracer Tracer
+	}
+)
+
+// NoopTracer is a tracer which traces nothing.
+var NoopTracer Tracer = noopTracer{}
+
+var _ sessions.Database = (*TracedDB)(nil)
+
+
+// UseTracer starts tracing the sessions' start, the tokens parsed and
+// serialized, and the calls to the current database (and any later one).
+func (sessions *JWTSessions) UseTracer(tracer Tracer) {
+	sessions.tracer = tracer
+	sessions.config.Parser.Tracer = tracer
+	sessions.provider.decorateDatabase(tracedDatabases(tracer))
+}
+
+
+func (noopTracer) StartSpan(string) Span          { return noopSpan{} }
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) End()                             {}
+
+
+// NewRecordingTracer returns an empty recording tracer.
+func NewRecordingTracer() *RecordingTracer {
+	return &RecordingTracer{}
+}
+
+// StartSpan starts a span, recorded when it ends.
+func (tracer *RecordingTracer) StartSpan(name string) Span {
+	return &recordingSpan{tracer: tracer, span: RecordedSpan{
+		Name: name, Start: time.Now(), Attributes: make(map[string]interface{}),
+	}}
+}
+
+// Spans returns the ended spans, in the order they ended.
+func (tracer *RecordingTracer) Spans() []RecordedSpan {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	return append([]RecordedSpan(nil), tracer.spans...)
+}
+
+// Reset forgets the ended spans.
+func (tracer *RecordingTracer) Reset() {
+	tracer.mu.Lock()
+	tracer.spans = nil
+	tracer.mu.Unlock()
+}
+
+func (span *recordingSpan) SetAttribute(key string, value interface{}) {
+	span.mu.Lock()
+	if !span.ended {
+		span.span.Attributes[key] = value
+	}
+	span.mu.Unlock()
+}
+
+func (span *recordingSpan) End() {
+	span.mu.Lock()
+	if span.ended {
+		span.mu.Unlock()
+		return
+	}
+	span.ended = true
+	span.span.End = time.Now()
+	span.mu.Unlock()
+
+	span.tracer.mu.Lock()
+	span.tracer.spans = append(span.tracer.spans, span.span)
+	span.tracer.mu.Unlock()
+}
+
+
+// NewTracedDB returns a database tracing the calls to another one.
+func NewTracedDB(inner sessions.Database, tracer Tracer) *TracedDB {
+	return &TracedDB{inner: inner, tracer: tracer}
+}
+
+// tracedDatabases returns a decorator tracing the calls to the databases.
+func tracedDatabases(tracer Tracer) func(sessions.Database) sessions.Database {
+	return func(db sessions.Database) sessions.Database {
+		return NewTracedDB(db, tracer)
+	}
+}
+
+func (db *TracedDB) unwrap() sessions.Database {
+	return db.inner
+}
+
+// span starts the span of a call.
+func (db *TracedDB) span(operation string, sid string) Span {
+	span := db.tracer.StartSpan("db." + operation)
+	span.SetAttribute("db.operation", operation)
+	span.SetAttribute("session.id", sid)
+	return span
+}
+
+func (db *TracedDB) Acquire(sid string, expires time.Duration) sessions.LifeTime {
+	span := db.span("acquire", sid)
+	defer span.End()
+	return db.inner.Acquire(sid, expires)
+}
+
+func (db *TracedDB) OnUpdateExpiration(sid string, newExpires time.Duration) error {
+	span := db.span("update_expiration", sid)
+	defer span.End()
+	err := db.inner.OnUpdateExpiration(sid, newExpires)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+	}
+	return err
+}
+
+func (db *TracedDB) Set(sid string, lifetime sessions.LifeTime, key string, value interface{}, immutable bool) {
+	span := db.span("set", sid)
+	defer span.End()
+	span.SetAttribute("session.key", key)
+	db.inner.Set(sid, lifetime, key, value, immutable)
+}
+
+func (db *TracedDB) Get(sid string, key string) interface{} {
+	span := db.span("get", sid)
+	defer span.End()
+	span.SetAttribute("session.key", key)
+	return db.inner.Get(sid, key)
+}
+
+func (db *TracedDB) Visit(sid string, cb func(key string, value interface{})) {
+	span := db.span("visit", sid)
+	defer span.End()
+	db.inner.Visit(sid, cb)
+}
+
+func (db *TracedDB) Len(sid string) int {
+	span := db.span("len", sid)
+	defer span.End()
+	return db.inner.Len(sid)
+}
+
+func (db *TracedDB) Delete(sid string, key string) bool {
+	span := db.span("delete", sid)
+	defer span.End()
+	span.SetAttribute("session.key", key)
+	return db.inner.Delete(sid, key)
+}
+
+func (db *TracedDB) Clear(sid string) {
+	span := db.span("clear", sid)
+	defer span.End()
+	db.inner.Clear(sid)
+}
+
+func (db *TracedDB) Release(sid string) {
+	span := db.span("release", sid)
+	defer span.End()
+	db.inner.Release(sid)
+}
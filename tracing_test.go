@@ -0,0 +1,87 @@
+package jwt_sessions
+
+import (
+	"testing"
+	"time"
+)
+
+
+// spansNamed returns the recorded spans with the given name.
+func spansNamed(tracer *RecordingTracer, name string) []RecordedSpan {
+	var spans []RecordedSpan
+	for _, span := range tracer.Spans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// sessionSpan returns the single recorded span with the given name.
+func sessionSpan(t *testing.T, tracer *RecordingTracer, name string) RecordedSpan {
+	t.Helper()
+	spans := spansNamed(tracer, name)
+	if len(spans) != 1 {
+		t.Fatalf("got %d %s spans, want 1", len(spans), name)
+	}
+	if spans[0].End.Before(spans[0].Start) {
+		t.Fatalf("the %s span ended before it started", name)
+	}
+	return spans[0]
+}
+
+
+func TestTracerRecordsTheStartOfASession(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	tracer := NewRecordingTracer()
+	sessions.UseTracer(tracer)
+
+	ctx := newTestContext("")
+	sess := sessions.Start(ctx)
+	span := sessionSpan(t, tracer, "session.start")
+	if span.Attributes["session.id"] != sess.ID() || span.Attributes["session.new"] != true {
+		t.Fatalf("got the attributes %v", span.Attributes)
+	}
+	sessionSpan(t, tracer, "token.serialize")
+
+	tracer.Reset()
+	sessions.Start(newTestContext(issuedToken(ctx)))
+	span = sessionSpan(t, tracer, "session.start")
+	if span.Attributes["session.id"] != sess.ID() {
+		t.Fatalf("got the attributes %v", span.Attributes)
+	}
+	if _, failed := sessionSpan(t, tracer, "token.parse").Attributes["error"]; failed {
+		t.Fatal("the valid token was traced as failed")
+	}
+
+	tracer.Reset()
+	sessions.Start(newTestContext("Bearer invalid"))
+	if _, failed := sessionSpan(t, tracer, "token.parse").Attributes["error"]; !failed {
+		t.Fatal("the invalid token was not traced as failed")
+	}
+}
+
+func TestTracerRecordsTheDatabaseCalls(t *testing.T) {
+	sessions := newTestSessions(Config{Expires: time.Hour})
+	tracer := NewRecordingTracer()
+	sessions.UseTracer(tracer)
+
+	sess := sessions.Start(newTestContext(""))
+	sess.Set("user_id", 7)
+	sess.Get("user_id")
+	sess.Delete("user_id")
+
+	if len(spansNamed(tracer, "db.acquire")) == 0 {
+		t.Fatal("the acquire call was not traced")
+	}
+	for _, operation := range []string{"set", "get", "delete"} {
+		spans := spansNamed(tracer, "db."+operation)
+		if len(spans) == 0 {
+			t.Fatalf("the %s call was not traced", operation)
+		}
+		attributes := spans[len(spans)-1].Attributes
+		if attributes["db.operation"] != operation || attributes["session.id"] != sess.ID() || attributes["session.key"] != "user_id" {
+			t.Fatalf("%s: got the attributes %v", operation, attributes)
+		}
+	}
+}